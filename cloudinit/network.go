@@ -1,6 +1,7 @@
 package cloudinit
 
 import (
+	"fmt"
 	"github.com/samber/lo"
 	"gopkg.in/yaml.v3"
 	"net"
@@ -15,10 +16,38 @@ type NetworkConfig struct {
 	Gateway4 net.IP
 	// Gateway6 is the IPv6 gateway address. If nil, no ipv6 gateway is set.
 	Gateway6 net.IP
+	// Routes are static routes via the network interface, besides the default ones.
+	Routes []*Route
 }
 
-// GenerateNetworkConfig generates a network configuration for cloud-init.
-func GenerateNetworkConfig(c *NetworkConfig) ([]byte, error) {
+// Route is a static route.
+type Route struct {
+	// To is the destination.
+	To *net.IPNet
+	// Via is the gateway. A route without it is on-link, such as the host route to a gateway out of the subnet of
+	// addresses.
+	Via net.IP
+}
+
+// GenerateNetworkConfig generates a network configuration for cloud-init, with an ethernet for each of `cs`.
+// The ethernets are named net0, net1... in order.
+func GenerateNetworkConfig(cs ...*NetworkConfig) ([]byte, error) {
+	n := &cloudInitNetwork{
+		Version:   2,
+		Ethernets: map[string]*ethernet{},
+	}
+	for i, c := range cs {
+		// Use fixed names.
+		n.Ethernets[fmt.Sprintf("net%d", i)] = generateEthernet(c)
+	}
+	out, err := yaml.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("#cloud-config\n"), out...), nil
+}
+
+func generateEthernet(c *NetworkConfig) *ethernet {
 	eth := &ethernet{
 		Match: &match{
 			Macaddress: c.Mac.String(),
@@ -33,18 +62,13 @@ func GenerateNetworkConfig(c *NetworkConfig) ([]byte, error) {
 	if c.Gateway6 != nil {
 		eth.Gateway6 = lo.ToPtr(c.Gateway6.String())
 	}
-	n := &cloudInitNetwork{
-		Version: 2,
-		Ethernets: map[string]*ethernet{
-			// Use a fixed name.
-			"net0": eth,
-		},
-	}
-	out, err := yaml.Marshal(n)
-	if err != nil {
-		return nil, err
-	}
-	return append([]byte("#cloud-config\n"), out...), nil
+	eth.Routes = lo.Map(c.Routes, func(item *Route, index int) *route {
+		if item.Via == nil {
+			return &route{To: item.To.String(), Scope: "link"}
+		}
+		return &route{To: item.To.String(), Via: item.Via.String()}
+	})
+	return eth
 }
 
 type cloudInitNetwork struct {
@@ -57,6 +81,7 @@ type ethernet struct {
 	Addresses []string `yaml:"addresses,omitempty"`
 	Gateway4  *string  `yaml:"gateway4,omitempty"`
 	Gateway6  *string  `yaml:"gateway6,omitempty"`
+	Routes    []*route `yaml:"routes,omitempty"`
 	// For lower version of cloud-init, it's necessary to set the set-name or the name of the network interface
 	// must exactly match the name of the network in guest VM.
 	SetName string `yaml:"set-name,omitempty"`
@@ -65,3 +90,9 @@ type ethernet struct {
 type match struct {
 	Macaddress string `yaml:"macaddress,omitempty"`
 }
+
+type route struct {
+	To    string `yaml:"to"`
+	Via   string `yaml:"via,omitempty"`
+	Scope string `yaml:"scope,omitempty"`
+}
@@ -1,6 +1,7 @@
 package cloudinit
 
 import (
+	"github.com/vishvananda/netlink"
 	"gotest.tools/v3/assert"
 	"net"
 	"testing"
@@ -28,3 +29,42 @@ ethernets:
         gateway6: 2001:db8:1::1
 `)
 }
+
+func TestGenerateMultiNetworkConfig(t *testing.T) {
+	mac0, _ := net.ParseMAC("02:42:ac:11:00:02")
+	mac1, _ := net.ParseMAC("02:42:ac:12:00:02")
+	ip0, _ := netlink.ParseIPNet("172.17.0.2/16")
+	ip1, _ := netlink.ParseIPNet("172.18.0.2/16")
+	_, dst, _ := net.ParseCIDR("10.18.0.0/16")
+	_, gwDst, _ := net.ParseCIDR("169.254.1.1/32")
+	config, err := GenerateNetworkConfig(&NetworkConfig{
+		Mac:       mac0,
+		Addresses: []*net.IPNet{ip0},
+		Gateway4:  net.ParseIP("172.17.0.1"),
+	}, &NetworkConfig{
+		Mac:       mac1,
+		Addresses: []*net.IPNet{ip1},
+		Routes:    []*Route{{To: dst, Via: net.ParseIP("172.18.0.1")}, {To: gwDst}},
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, string(config), `#cloud-config
+version: 2
+ethernets:
+    net0:
+        match:
+            macaddress: 02:42:ac:11:00:02
+        addresses:
+            - 172.17.0.2/16
+        gateway4: 172.17.0.1
+    net1:
+        match:
+            macaddress: 02:42:ac:12:00:02
+        addresses:
+            - 172.18.0.2/16
+        routes:
+            - to: 10.18.0.0/16
+              via: 172.18.0.1
+            - to: 169.254.1.1/32
+              scope: link
+`)
+}
@@ -1,282 +1,273 @@
 package main
 
 import (
-	"fmt"
-	"github.com/cox96de/containervm/cloudinit"
-	"github.com/cox96de/containervm/network"
-	"github.com/cox96de/containervm/resolvconf"
-	"github.com/cox96de/containervm/util"
-	"github.com/jackpal/gateway"
-	"github.com/pkg/errors"
-	log "github.com/sirupsen/logrus"
-	"github.com/spf13/pflag"
-	"golang.org/x/exp/rand"
+	"context"
 	"net"
 	"os"
-	"os/exec"
 	"os/signal"
-	"path/filepath"
-	"strconv"
-	"strings"
 	"syscall"
+	"time"
+
+	"github.com/cox96de/containervm/network"
+	"github.com/cox96de/containervm/qemu"
+	"github.com/cox96de/containervm/vm"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "recover" {
+		runRecover(os.Args[2:])
+		return
+	}
 	var (
-		inheritResolv    bool
-		extraNameservers []string
+		inheritResolv      bool
+		extraNameservers   []string
+		journalPath        string
+		shutdownTimeout    time.Duration
+		configPath         string
+		autoResources      bool
+		cpuOverhead        float64
+		memoryOverhead     string
+		requireKVM         bool
+		networkMode        string
+		forwards           []string
+		networkBackend     string
+		interfaces         []string
+		allInterfaces      bool
+		networkQueues      int
+		disableVhost       bool
+		ntpServers         []string
+		domainName         string
+		leaseTime          time.Duration
+		renewalTime        time.Duration
+		rebindingTime      time.Duration
+		dhcpOptions        []string
+		pxeBootFile        string
+		ipxeScript         string
+		tftpRoot           string
+		pxeBootServer      string
+		gratuitousARPCount int
 	)
 	pflag.BoolVar(&inheritResolv, "inherit-resolv", true, "inherit resolv.conf from host")
 	pflag.StringSliceVar(&extraNameservers, "nameserver", []string{}, "extra nameserver to use")
+	pflag.StringVar(&journalPath, "journal", vm.DefaultJournalPath, "path to persist the original network state, "+
+		"used by `containervm recover`")
+	pflag.DurationVar(&shutdownTimeout, "shutdown-timeout", vm.DefaultShutdownTimeout,
+		"how long to wait for the guest to power off on SIGTERM before terminating qemu")
+	pflag.StringVar(&configPath, "config", "", "path of the VM spec, used instead of a qemu command after `--`")
+	pflag.BoolVar(&autoResources, "auto-resources", false, "size vcpus and memory of the vm from the cgroup limits "+
+		"of the container, or validate -smp and -m against them")
+	pflag.Float64Var(&cpuOverhead, "cpu-overhead", 0, "cpus reserved for qemu itself with --auto-resources")
+	pflag.StringVar(&memoryOverhead, "memory-overhead", "256M", "memory reserved for qemu itself with --auto-resources")
+	pflag.BoolVar(&requireKVM, "require-kvm", false, "fail if kvm is not usable instead of falling back to tcg")
+	pflag.StringVar(&networkMode, "network-mode", string(vm.NetworkModePod), "how the vm is connected to the network: "+
+		"pod (hand the pod IP over to the vm, requires privileges) or user (user-mode network of qemu, unprivileged)")
+	pflag.StringSliceVar(&forwards, "forward", []string{}, "forward a port of the pod into the vm in user network "+
+		"mode, in the format of protocol:hostPort:guestPort, such as tcp:2222:22")
+	pflag.StringVar(&networkBackend, "network-backend", network.BackendMacvtap, "how the pod NIC is connected to the "+
+		"vm in pod network mode: macvtap, bridge (a tap device and a linux bridge, for where macvlan is restricted), "+
+		"or ipvtap (keeps the MAC of the NIC, for CNIs which only allow the MAC of the pod)")
+	pflag.StringSliceVar(&interfaces, "interfaces", []string{}, "pod interfaces bridged into the vm in pod network "+
+		"mode, in order, the default one if empty")
+	pflag.BoolVar(&allInterfaces, "all-interfaces", false, "bridge all pod interfaces into the vm in pod network mode, "+
+		"such as networks attached by multus")
+	pflag.IntVar(&networkQueues, "network-queues", 0, "queues of each nic of the vm in pod network mode, "+
+		"0 means the number of vcpus")
+	pflag.BoolVar(&disableVhost, "disable-vhost", false, "process packets of the vm in qemu instead of vhost-net, "+
+		"which is disabled anyway if /dev/vhost-net is not usable")
+	pflag.StringSliceVar(&ntpServers, "ntp-server", []string{}, "ntp server handed to the vm by dhcp")
+	pflag.StringVar(&domainName, "domain-name", "", "domain name handed to the vm by dhcp, the first search "+
+		"domain if empty")
+	pflag.DurationVar(&leaseTime, "dhcp-lease-time", 0, "lease time of the address of the vm, 0 means infinite")
+	pflag.DurationVar(&renewalTime, "dhcp-renewal-time", 0, "renewal time (T1) of the lease, "+
+		"0 means the vm derives it from the lease time")
+	pflag.DurationVar(&rebindingTime, "dhcp-rebinding-time", 0, "rebinding time (T2) of the lease, "+
+		"0 means the vm derives it from the lease time")
+	pflag.StringSliceVar(&dhcpOptions, "dhcp-option", []string{}, "raw dhcp option handed to the vm in the format "+
+		"of code:value, value is hex if prefixed by 0x, such as 252:http://wpad/wpad.dat")
+	pflag.StringVar(&pxeBootFile, "pxe-boot-file", "", "boot file handed to pxe roms of the vm by dhcp, "+
+		"such as undionly.kpxe")
+	pflag.StringVar(&ipxeScript, "ipxe-script", "", "boot file handed to ipxe instead of --pxe-boot-file, "+
+		"such as http://10.0.0.1/boot.ipxe")
+	pflag.StringVar(&tftpRoot, "tftp-root", "", "directory served to the vm by the built-in tftp server, "+
+		"which is the boot server of pxe")
+	pflag.StringVar(&pxeBootServer, "pxe-boot-server", "", "ip address of an external boot server, "+
+		"exclusive with --tftp-root")
+	pflag.IntVar(&gratuitousARPCount, "gratuitous-arp-count", vm.DefaultGratuitousARPCount, "gratuitous arp packets, or "+
+		"unsolicited neighbor advertisements for ipv6, sent for each address of the vm once it gets the address, "+
+		"0 disables them")
 	pflag.Parse()
-	args := pflag.Args()
 	log.SetLevel(log.DebugLevel)
-	if len(args) == 0 {
-		log.Fatalf("qemu launch command is required")
-	}
-	var (
-		nameservers   []string
-		searchDomains []string
-		err           error
-	)
-	if inheritResolv {
-		nameservers, searchDomains, err = getNameserversAndSearchDomain()
+	var resources *vm.ResourceOptions
+	if autoResources {
+		overhead, err := vm.ParseSize(memoryOverhead)
 		if err != nil {
-			log.Fatalf("failed to get nameservers and search domains: %+v", err)
+			log.Errorf("invalid --memory-overhead: %+v", err)
+			os.Exit(vm.ExitCodeOptions)
 		}
+		resources = &vm.ResourceOptions{CPUOverhead: cpuOverhead, MemoryOverhead: overhead}
 	}
-	// TODO: validate nameservers
-	nameservers = append(nameservers, extraNameservers...)
-	ns := make([]net.IP, 0, len(nameservers))
-	for _, nameserver := range nameservers {
-		ip := net.ParseIP(nameserver)
-		if ip.IsLoopback() {
-			// Nameserver in containers might be a loopback address.
-			// It can be seen in docker-compose.
-			continue
+	var spec *qemu.Spec
+	if configPath != "" {
+		var err error
+		spec, err = qemu.LoadSpec(configPath)
+		if err != nil {
+			log.Errorf("%+v", err)
+			os.Exit(vm.ExitCodeOptions)
 		}
-		ns = append(ns, ip)
-	}
-	nw, cleanFunc := configureNetwork(ns, searchDomains)
-	defer func() {
-		log.Infof("cleaning up network...")
-		if err := cleanFunc(); err != nil {
-			log.Errorf("failed to clean up network: %+v", err)
+		// Flags take precedence over the spec.
+		if spec.Network != nil {
+			if !pflag.CommandLine.Changed("network-mode") && spec.Network.Mode != "" {
+				networkMode = spec.Network.Mode
+			}
+			forwards = append(append([]string{}, spec.Network.Forwards...), forwards...)
+			if !pflag.CommandLine.Changed("gratuitous-arp-count") && spec.Network.GratuitousARPCount != nil {
+				gratuitousARPCount = *spec.Network.GratuitousARPCount
+			}
+			if dhcp := spec.Network.DHCP; dhcp != nil {
+				if !pflag.CommandLine.Changed("ntp-server") {
+					ntpServers = dhcp.NTPServers
+				}
+				if !pflag.CommandLine.Changed("domain-name") {
+					domainName = dhcp.DomainName
+				}
+				if !pflag.CommandLine.Changed("dhcp-lease-time") {
+					leaseTime = dhcp.LeaseTime
+				}
+				if !pflag.CommandLine.Changed("dhcp-renewal-time") {
+					renewalTime = dhcp.RenewalTime
+				}
+				if !pflag.CommandLine.Changed("dhcp-rebinding-time") {
+					rebindingTime = dhcp.RebindingTime
+				}
+				dhcpOptions = append(append([]string{}, dhcp.Options...), dhcpOptions...)
+			}
+			if pxe := spec.Network.PXE; pxe != nil {
+				if !pflag.CommandLine.Changed("pxe-boot-file") {
+					pxeBootFile = pxe.BootFile
+				}
+				if !pflag.CommandLine.Changed("ipxe-script") {
+					ipxeScript = pxe.IPXEScript
+				}
+				if !pflag.CommandLine.Changed("tftp-root") {
+					tftpRoot = pxe.TFTPRoot
+				}
+				if !pflag.CommandLine.Changed("pxe-boot-server") {
+					pxeBootServer = pxe.BootServer
+				}
+			}
 		}
-	}()
-	tapFile, err := os.Open(nw.BridgeName)
-	if err != nil {
-		log.Fatalf("failed to open tap dev(%s): %+v", nw.BridgeName, err)
-	}
-	qemuNetworkOpt := generateQEMUNetworkOpt(tapFile, nw.BridgeMacAddr, nw.MTU)
-	args = append(args, qemuNetworkOpt...)
-	if nw.Gateway6 != nil {
-		log.Infof("use cloud-init to setup ipv6 network...")
-		cloudInitOpt := generateCloudInitOpt(nw)
-		args = append(args, cloudInitOpt...)
-	}
-	log.Infof("run qemu with command: %s", strings.Join(args, " "))
-	exitSig := make(chan os.Signal)
-	signal.Notify(exitSig, syscall.SIGTERM, syscall.SIGINT)
-	qemuCMD := exec.Command(args[0], args[1:]...)
-	qemuCMD.Stdin = os.Stdin
-	qemuCMD.Stdout = os.Stdout
-	qemuCMD.Stderr = os.Stderr
-	qemuCMD.ExtraFiles = []*os.File{tapFile}
-	if err := qemuCMD.Start(); err != nil {
-		log.Fatalf("failed to start qemu: %+v", err)
 	}
-	go func() {
-		sig := <-exitSig
-		log.Infof("recieve signal %+v", sig)
-		_ = qemuCMD.Process.Kill()
-	}()
-	if err := qemuCMD.Wait(); err != nil {
-		log.Errorf("failed to wait for qemu: %+v", err)
-		return
-	}
-	log.Infof("qemu exited with code %d", qemuCMD.ProcessState.ExitCode())
-}
-
-func generateQEMUNetworkOpt(vtapFile *os.File, macAddr net.HardwareAddr, mtu int) []string {
-	return []string{"-netdev", fmt.Sprintf("tap,id=net0,vhost=on,fd=%d", vtapFile.Fd()),
-		"-device", "virtio-net-pci,netdev=net0,mac=" + macAddr.String() + ",host_mtu=" + strconv.Itoa(mtu)}
-}
-
-func generateCloudInitOpt(n *Network) []string {
-	c := &cloudinit.NetworkConfig{
-		Mac:       n.BridgeMacAddr,
-		Addresses: n.Address,
-		Gateway4:  n.Gateway,
-		Gateway6:  n.Gateway6,
-	}
-	content, err := cloudinit.GenerateNetworkConfig(c)
-	if err != nil {
-		log.Fatalf("failed to generate network config: %+v", err)
-	}
-	tempDir, err := os.MkdirTemp("", "cloud-init-*")
-	if err != nil {
-		log.Fatalf("failed to create temp dir: %+v", err)
-	}
-	err = os.WriteFile(filepath.Join(tempDir, "network-config"), content, os.ModePerm)
-	if err != nil {
-		log.Fatalf("failed to write network-config: %+v", err)
-	}
-	err = os.WriteFile(filepath.Join(tempDir, "user-data"), []byte(`#cloud-config
-`), os.ModePerm)
-	if err != nil {
-		log.Fatalf("failed to write user-data: %+v", err)
-	}
-	err = os.WriteFile(filepath.Join(tempDir, "meta-data"), []byte(`#cloud-config
-instance-id: someid/somehost
-`), os.ModePerm)
-	if err != nil {
-		log.Fatalf("failed to write meta-data: %+v", err)
-	}
-	isoFile := "seed.iso"
-
-	err = util.GenISO(tempDir, isoFile, []string{"network-config", "meta-data", "user-data"}, "cidata")
-	if err != nil {
-		log.Fatalf("failed to write network-config: %+v", err)
-	}
-	return []string{"-drive", fmt.Sprintf("driver=raw,file=%s,if=virtio", filepath.Join(tempDir, isoFile))}
-}
-
-type Network struct {
-	NIC           *util.NIC
-	Address       []*net.IPNet
-	Gateway       net.IP
-	Gateway6      net.IP
-	BridgeName    string
-	BridgeMacAddr net.HardwareAddr
-	MTU           int
-}
-
-func configureNetwork(dnsServers []net.IP, searchDomains []string) (nw *Network,
-	clean func() error) {
-
-	nic, err := util.GetDefaultNIC()
-	if err != nil {
-		log.Fatalf("failed to get default nic: %+v", err)
-	}
-	nw = &Network{
-		NIC:           nic,
-		BridgeMacAddr: nic.HardwareAddr,
-		MTU:           nic.MTU,
-	}
-	ipv4Gateway, err := util.GetIPv4DefaultGateway()
-	if err != nil {
-		log.Warnf("failed to get default ipv4 gateway address: %+v", err)
-	}
-	nw.Gateway = ipv4Gateway
-	ipv6Gateway, err := util.GetIPv6DefaultGateway()
-	if err != nil {
-		log.Warnf("failed to get default ipv6 gateway address: %+v", err)
-	}
-	nw.Gateway6 = ipv6Gateway
-	ifIP, err := gateway.DiscoverInterface()
-	if err != nil {
-		log.Warnf("failed to get default gateway interface: %+v", err)
+	portForwards := make([]*vm.PortForward, 0, len(forwards))
+	for _, f := range forwards {
+		forward, err := vm.ParsePortForward(f)
+		if err != nil {
+			log.Errorf("invalid port forward: %+v", err)
+			os.Exit(vm.ExitCodeOptions)
+		}
+		portForwards = append(portForwards, forward)
 	}
-	log.Infof("reconfiguring nic %s", nic.Name)
-	defaultNIC, err := net.InterfaceByName(nic.Name)
-	if err != nil {
-		log.Fatalf("failed to get nic %s: %+v", nic.Name, err)
+	dhcpOpt := &vm.DHCPOptions{
+		DomainName:    domainName,
+		LeaseTime:     leaseTime,
+		RenewalTime:   renewalTime,
+		RebindingTime: rebindingTime,
 	}
-	addrs, err := defaultNIC.Addrs()
-	for _, addr := range addrs {
-		ipNet, ok := addr.(*net.IPNet)
-		if !ok {
-			continue
+	for _, s := range ntpServers {
+		ip := net.ParseIP(s)
+		if ip.To4() == nil {
+			log.Errorf("invalid ntp server: %s", s)
+			os.Exit(vm.ExitCodeOptions)
 		}
-		nw.Address = append(nw.Address, ipNet)
+		dhcpOpt.NTPServers = append(dhcpOpt.NTPServers, ip)
 	}
-	if err != nil {
-		log.Fatalf("failed to get addresses of nic %s: %+v", nic.Name, err)
+	for _, o := range dhcpOptions {
+		opt, err := network.ParseDHCPOption(o)
+		if err != nil {
+			log.Errorf("invalid dhcp option: %+v", err)
+			os.Exit(vm.ExitCodeOptions)
+		}
+		dhcpOpt.Options = append(dhcpOpt.Options, opt)
 	}
-	var ipv4Addr net.Addr
-	for _, addr := range addrs {
-		switch ip := addr.(type) {
-		case *net.IPAddr:
-			if !ifIP.Equal(ip.IP) {
-				continue
-			}
-		case *net.IPNet:
-			if !ifIP.Equal(ip.IP) {
-				continue
+	var pxeOpt *vm.PXEOptions
+	if pxeBootFile != "" || ipxeScript != "" || tftpRoot != "" || pxeBootServer != "" {
+		pxeOpt = &vm.PXEOptions{BootFile: pxeBootFile, IPXEScript: ipxeScript, TFTPRoot: tftpRoot}
+		if pxeBootServer != "" {
+			pxeOpt.BootServer = net.ParseIP(pxeBootServer)
+			if pxeOpt.BootServer == nil {
+				log.Errorf("invalid pxe boot server: %s", pxeBootServer)
+				os.Exit(vm.ExitCodeOptions)
 			}
-		default:
-			continue
 		}
-		ipv4Addr = addr
-		break
 	}
-
-	tapName := fmt.Sprintf("macvtap%s", randomString(3))
-	lanName := fmt.Sprintf("macvlan%s", randomString(3))
-	configure := network.NewBridgeConfigure(nic.Name, util.GetRandomMAC(), tapName, lanName)
-	err = configure.SetupBridge()
+	launcher, err := vm.NewLauncher(&vm.Options{
+		QEMUArgs:           pflag.Args(),
+		Spec:               spec,
+		InheritResolv:      inheritResolv,
+		Nameservers:        extraNameservers,
+		DHCP:               dhcpOpt,
+		PXE:                pxeOpt,
+		GratuitousARPCount: gratuitousARPCount,
+		JournalPath:        journalPath,
+		ShutdownTimeout:    shutdownTimeout,
+		Resources:          resources,
+		RequireKVM:         requireKVM,
+		NetworkMode:        vm.NetworkMode(networkMode),
+		NetworkBackend:     networkBackend,
+		Interfaces:         interfaces,
+		AllInterfaces:      allInterfaces,
+		NetworkQueues:      networkQueues,
+		DisableVhost:       disableVhost,
+		PortForwards:       portForwards,
+		Stdin:              os.Stdin,
+		Stdout:             os.Stdout,
+		Stderr:             os.Stderr,
+	})
 	if err != nil {
-		log.Fatalf("failed to set up bridge: %+v", err)
+		log.Errorf("%+v", err)
+		os.Exit(vm.ExitCode(err))
 	}
-
-	log.Infof("tap device %s is created", tapName)
-	// Start a DHCP server.
-	hostname, _ := os.Hostname()
-
-	if ipv4Addr != nil && ipv4Gateway != nil {
-		log.Infof("start dhcp server")
-		ds, err := network.NewDHCPServerFromAddr(&network.DHCPOption{
-			HardwareAddr:  nic.HardwareAddr,
-			IP:            ipv4Addr,
-			GatewayIP:     ipv4Gateway,
-			DNSServers:    dnsServers,
-			SearchDomains: searchDomains,
-			Hostname:      hostname,
-		})
-		if err != nil {
-			log.Fatalf("failed to create dhcp server: %+v", err)
-		}
-		go func() {
-			if err := ds.Run(lanName); err != nil {
-				log.Errorf("failed to start dhcp server: %+v", err)
-			}
-		}()
-	}
-	var gatewayMacAddr net.HardwareAddr
-
-	if ipv4Gateway != nil {
-		gatewayMacAddr, err = util.GetHardwareAddr(nic.Index, ipv4Gateway)
-		if err != nil {
-			log.Warnf("failed to get gateway mac address for ipv4 gateway %+v: %+v", ipv4Gateway, err)
-		}
+	exitSig := make(chan os.Signal, 1)
+	signal.Notify(exitSig, syscall.SIGTERM, syscall.SIGINT)
+	// Start restores the network itself if it fails.
+	if err := launcher.Start(context.Background()); err != nil {
+		log.Errorf("failed to launch vm: %+v", err)
+		os.Exit(vm.ExitCode(err))
 	}
-	if ipv4Gateway != nil && gatewayMacAddr != nil {
-		log.Infof("start arp server")
+	go func() {
+		sig := <-exitSig
+		log.Infof("recieve signal %+v, shutting down the guest", sig)
 		go func() {
-			if err := network.ServeARP(lanName, ipv4Addr, nic.HardwareAddr, gatewayMacAddr); err != nil {
-				log.Errorf("failed to start arp server: %+v", err)
+			sig := <-exitSig
+			log.Infof("recieve signal %+v again, killing qemu", sig)
+			if err := launcher.Stop(); err != nil {
+				log.Errorf("failed to stop qemu: %+v", err)
 			}
 		}()
-	}
-	nw.BridgeName = configure.GetMacVtapDevicePath()
-	return nw, func() error {
-		return configure.Recover()
-	}
-}
-
-func getNameserversAndSearchDomain() (nameservers []string, searchDomains []string, err error) {
-	resolvFile, err := os.ReadFile("/etc/resolv.conf")
+		if err := launcher.Shutdown(); err != nil {
+			log.Errorf("failed to shut down qemu: %+v", err)
+		}
+	}()
+	// Wait stops servers for the VM, such as the DHCP server, and restores the network whether qemu exits cleanly
+	// or not.
+	err = launcher.Wait()
 	if err != nil {
-		return nil, nil, errors.WithMessagef(err, "failed to read /etc/resolv.conf")
+		log.Errorf("failed to wait for qemu: %+v", err)
 	}
-	nameservers = resolvconf.GetNameservers(resolvFile)
-	searchDomains = resolvconf.GetSearchDomains(resolvFile)
-	return nameservers, searchDomains, nil
+	log.Infof("qemu exited with code %d", launcher.ExitCode())
+	os.Exit(vm.ExitCode(err))
 }
 
-func randomString(b int) string {
-	bs := make([]byte, b)
-	_, _ = rand.Read(bs)
-	return fmt.Sprintf("%x", bs)
+// runRecover restores the pod network left by a killed containervm.
+func runRecover(args []string) {
+	var journalPath string
+	flags := pflag.NewFlagSet("recover", pflag.ExitOnError)
+	flags.StringVar(&journalPath, "journal", vm.DefaultJournalPath, "path of the network journal to recover from")
+	_ = flags.Parse(args)
+	log.SetLevel(log.DebugLevel)
+	if err := vm.RecoverNetwork(journalPath); err != nil {
+		log.Errorf("%+v", err)
+		os.Exit(vm.ExitCode(err))
+	}
 }
@@ -0,0 +1,102 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/mdlayher/arp"
+	"github.com/mdlayher/ndp"
+	"github.com/mdlayher/packet"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// announceInterval is the interval between announcements of an address (RFC 5227 ANNOUNCE_INTERVAL).
+const announceInterval = time.Second * 2
+
+var broadcastHardwareAddr = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// Announce tells neighbors on `ifName` that `ip` is at `hardwareAddr`, by `count` gratuitous ARP packets
+// (RFC 5227 ARP announcements) for an IPv4 address, or unsolicited neighbor advertisements (RFC 4861 7.2.6) for an
+// IPv6 address. Frames are sent from `hardwareAddr`, so that switches learn where it is as well.
+// Once the MAC of the pod moves to the vm, neighbors and the gateway may keep stale entries until the vm sends
+// traffic. It returns when all are sent or ctx is done.
+func Announce(ctx context.Context, ifName string, ip net.IP, hardwareAddr net.HardwareAddr, count int) error {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to get interface %s", ifName)
+	}
+	var send func() error
+	if ip.To4() != nil {
+		cli, err := arp.Dial(iface)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to listen to arp at %s", ifName)
+		}
+		defer cli.Close()
+		// The target hardware address is ignored (RFC 5227 2.3), it's zero as in ARP probes.
+		p, err := arp.NewPacket(arp.OperationRequest, hardwareAddr, ip.To4(), make(net.HardwareAddr, len(hardwareAddr)),
+			ip.To4())
+		if err != nil {
+			return errors.WithMessage(err, "failed to build gratuitous arp")
+		}
+		send = func() error {
+			return cli.WriteTo(p, broadcastHardwareAddr)
+		}
+	} else {
+		// A raw socket, as the frame is not from the hardware address of the interface.
+		conn, err := packet.Listen(iface, packet.Raw, etherTypeIPv6, nil)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to listen to ipv6 at %s", ifName)
+		}
+		defer conn.Close()
+		frame, err := marshalUnsolicitedNA(ip, hardwareAddr)
+		if err != nil {
+			return err
+		}
+		dstHardwareAddr := multicastHardwareAddr(net.IPv6linklocalallnodes)
+		send = func() error {
+			_, err := conn.WriteTo(frame, &packet.Addr{HardwareAddr: dstHardwareAddr})
+			return err
+		}
+	}
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(announceInterval):
+			}
+		}
+		if err = send(); err != nil {
+			return errors.WithMessagef(err, "failed to announce %s at %s", ip, ifName)
+		}
+		log.Debugf("announced %s is at %s on %s", ip, hardwareAddr, ifName)
+	}
+	return nil
+}
+
+// marshalUnsolicitedNA builds an ethernet frame of the unsolicited neighbor advertisement of `ip`, sent from
+// `hardwareAddr` to all nodes.
+func marshalUnsolicitedNA(ip net.IP, hardwareAddr net.HardwareAddr) ([]byte, error) {
+	target, _ := netip.AddrFromSlice(ip.To16())
+	dst, _ := netip.AddrFromSlice(net.IPv6linklocalallnodes)
+	na := &ndp.NeighborAdvertisement{
+		Override:      true,
+		TargetAddress: target,
+		Options: []ndp.Option{
+			&ndp.LinkLayerAddress{Direction: ndp.Target, Addr: hardwareAddr},
+		},
+	}
+	b, err := ndp.MarshalMessageChecksum(na, target, dst)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to marshal neighbor advertisement")
+	}
+	frame := make([]byte, 14, 14+40+len(b))
+	copy(frame[0:6], multicastHardwareAddr(net.IPv6linklocalallnodes))
+	copy(frame[6:12], hardwareAddr)
+	binary.BigEndian.PutUint16(frame[12:14], etherTypeIPv6)
+	return append(frame, marshalIPv6(ip, net.IPv6linklocalallnodes, protocolICMPv6, 255, b)...), nil
+}
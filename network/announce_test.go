@@ -0,0 +1,77 @@
+package network
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/arp"
+	"github.com/mdlayher/ndp"
+	"gotest.tools/v3/assert"
+)
+
+func TestAnnounce(t *testing.T) {
+	clientIface := "vethan0"
+	serverIface := "vethan1"
+	setupVethPair(t, clientIface, serverIface, "12:34:56:78:9a:bc")
+	// The vm's MAC, not the one of the interface.
+	hw, _ := net.ParseMAC("12:34:56:78:9a:60")
+	iface, err := net.InterfaceByName(clientIface)
+	assert.NilError(t, err)
+
+	t.Run("ipv4", func(t *testing.T) {
+		cli, err := arp.Dial(iface)
+		assert.NilError(t, err)
+		defer cli.Close()
+		ip := net.ParseIP("192.168.60.3")
+		assert.NilError(t, Announce(context.Background(), serverIface, ip, hw, 2))
+		assert.NilError(t, cli.SetReadDeadline(time.Now().Add(time.Second)))
+		for i := 0; i < 2; i++ {
+			p, frame, err := cli.Read()
+			assert.NilError(t, err)
+			assert.Equal(t, p.Operation, arp.OperationRequest)
+			assert.DeepEqual(t, p.SenderHardwareAddr, hw)
+			assert.Equal(t, p.SenderIP.String(), ip.String())
+			assert.Equal(t, p.TargetIP.String(), ip.String())
+			assert.DeepEqual(t, frame.Source, hw)
+			assert.DeepEqual(t, frame.Destination, broadcastHardwareAddr)
+		}
+	})
+	t.Run("ipv6", func(t *testing.T) {
+		conn, err := dialIPv6(clientIface)
+		assert.NilError(t, err)
+		defer conn.Close()
+		ip := net.ParseIP("2001:db8::3")
+		assert.NilError(t, Announce(context.Background(), serverIface, ip, hw, 1))
+		assert.NilError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		for {
+			header, payload, srcHardwareAddr, err := conn.Read()
+			assert.NilError(t, err)
+			if header.NextHeader != protocolICMPv6 {
+				continue
+			}
+			msg, err := ndp.ParseMessage(payload)
+			assert.NilError(t, err)
+			na, ok := msg.(*ndp.NeighborAdvertisement)
+			if !ok {
+				continue
+			}
+			assert.DeepEqual(t, srcHardwareAddr, hw)
+			assert.Assert(t, header.Src.Equal(ip))
+			assert.Assert(t, header.Dst.Equal(net.IPv6linklocalallnodes))
+			assert.Equal(t, header.HopLimit, 255)
+			assert.Assert(t, na.Override && !na.Solicited)
+			assert.Equal(t, na.TargetAddress.String(), ip.String())
+			assert.DeepEqual(t, na.Options, []ndp.Option{&ndp.LinkLayerAddress{Direction: ndp.Target, Addr: hw}})
+			return
+		}
+	})
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		start := time.Now()
+		assert.NilError(t, Announce(ctx, serverIface, net.ParseIP("192.168.60.3"), hw, 10))
+		assert.Assert(t, time.Since(start) < announceInterval)
+	})
+}
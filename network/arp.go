@@ -2,22 +2,51 @@ package network
 
 import (
 	"bytes"
+	"context"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/mdlayher/arp"
 	"github.com/pkg/errors"
+	"github.com/samber/lo"
 	log "github.com/sirupsen/logrus"
 )
 
-// ServeARP starts an ARP answerer on `ifName` to answer ARP requests with `hardwareAddr`.
-// It replies gateway's hardware address.
-// `addr` is the original nic's ip address. ARP requests is from this ip.
-func ServeARP(ifName string, addr net.Addr, hardwareAddr, gatewayHardAddr net.HardwareAddr) error {
+// defaultGatewayRefreshInterval is how often the hardware address of the gateway is resolved again by default.
+const defaultGatewayRefreshInterval = time.Second * 30
+
+// ARPOption configures ServeARP.
+type ARPOption struct {
+	// Only answer ARP requests from HardwareAddr, which is the vm.
+	HardwareAddr net.HardwareAddr
+	// Addr is the original nic's ip address with its subnet. ARP requests are from this ip.
+	Addr net.Addr
+	// GatewayHardwareAddr is replied for addresses in the subnet of Addr. It may be nil to only answer LocalIPs,
+	// or until it's resolved from Gateway.
+	GatewayHardwareAddr net.HardwareAddr
+	// Gateway is the ipv4 gateway. If it's not nil, its hardware address is resolved every RefreshInterval, so that
+	// changes, such as a VRRP failover, are followed and corrected in the vm.
+	Gateway net.IP
+	// RefreshInterval is the interval to resolve Gateway. Zero means defaultGatewayRefreshInterval.
+	RefreshInterval time.Duration
+	// Resolver resolves Gateway. Nil means a Resolver with defaults.
+	Resolver *Resolver
+	// LocalIPs are addresses of servers for the vm on the interface, such as the TFTP server. They are answered
+	// with the hardware address of the interface.
+	LocalIPs []net.IP
+}
+
+// ServeARP starts an ARP answerer on `ifName` to answer ARP requests from `opt.HardwareAddr`.
+// It replies gateway's hardware address, or the hardware address of `ifName` for `opt.LocalIPs`.
+// It stops when ctx is done, or returns ErrInterfaceGone when `ifName` is deleted.
+func ServeARP(ctx context.Context, ifName string, opt *ARPOption) error {
 	log.Debugf("listen on: %s", ifName)
-	log.Debugf("response to arp from: %s with gateway hardware addr: %s", hardwareAddr, gatewayHardAddr)
-	ip, mask, err := getIPAndMask(addr)
+	log.Debugf("response to arp from: %s with gateway %s(%s)", opt.HardwareAddr, opt.Gateway,
+		opt.GatewayHardwareAddr)
+	ip, mask, err := getIPAndMask(opt.Addr)
 	if err != nil {
-		return errors.WithMessagef(err, "failed to parse addr %v", addr)
+		return errors.WithMessagef(err, "failed to parse addr %v", opt.Addr)
 	}
 	ipNet := &net.IPNet{IP: ip.To4(), Mask: mask}
 	log.Debugf("local subnet range: %s", ipNet)
@@ -29,22 +58,72 @@ func ServeARP(ifName string, addr net.Addr, hardwareAddr, gatewayHardAddr net.Ha
 	if err != nil {
 		return errors.WithMessagef(err, "failed to listen to arp at %s", ifName)
 	}
+	defer cli.Close()
+	stop := context.AfterFunc(ctx, func() {
+		_ = cli.Close()
+	})
+	defer stop()
+	gateway := &arpGateway{
+		cli:          cli,
+		iface:        i,
+		ip:           opt.Gateway.To4(),
+		hardwareAddr: opt.GatewayHardwareAddr,
+		vmIP:         ip.To4(),
+		vmHwAddr:     opt.HardwareAddr,
+		answered:     map[string]net.IP{},
+	}
+	if gateway.ip != nil {
+		interval := opt.RefreshInterval
+		if interval == 0 {
+			interval = defaultGatewayRefreshInterval
+		}
+		resolver := opt.Resolver
+		if resolver == nil {
+			resolver = &Resolver{}
+		}
+		refreshCtx, cancel := context.WithCancel(ctx)
+		refreshed := make(chan struct{})
+		defer func() {
+			cancel()
+			<-refreshed
+		}()
+		go func() {
+			defer close(refreshed)
+			gateway.refresh(refreshCtx, resolver, interval)
+		}()
+	}
 	log.Infof("arp answerer started at %s", ifName)
+	guard := newReadGuard(ctx, i)
 	for {
+		_ = cli.SetReadDeadline(guard.deadline())
 		p, _, err := cli.Read()
 		if err != nil {
-			log.Errorf("failed to read arp packet: %v", err)
+			if stop, err := guard.failed(err); stop {
+				return err
+			}
+			continue
+		}
+		guard.succeeded()
+		log.Debugf("get an arp packet: %v", p)
+		if gateway.track(p) {
 			continue
 		}
-		log.Debugf("get an arp request: %v", p)
 		if p.Operation != arp.OperationRequest {
 			log.Debugf("get an arp packet with operation %v", p.Operation)
 			continue
 		}
-		if !bytes.Equal(p.SenderHardwareAddr, hardwareAddr) {
+		if !bytes.Equal(p.SenderHardwareAddr, opt.HardwareAddr) {
 			log.Debugf("get an arp request from %v, not from vm", p.SenderHardwareAddr)
 			continue
 		}
+		if lo.ContainsBy(opt.LocalIPs, p.TargetIP.Equal) {
+			if err := cli.Reply(p, i.HardwareAddr, p.TargetIP); err != nil {
+				log.Errorf("failed to answer arp request: %v", err)
+				continue
+			}
+			log.Debugf("answered arp request for %v to %v", p.TargetIP, i.HardwareAddr)
+			continue
+		}
 		// Ignore:
 		//  1. ARP request for vm.
 		//  2. ARP request not in k8s, only reply to requests in the same subnet.
@@ -52,10 +131,117 @@ func ServeARP(ifName string, addr net.Addr, hardwareAddr, gatewayHardAddr net.Ha
 			log.Debugf("get an arp request for %v, ignore", p.TargetIP)
 			continue
 		}
-		if err := cli.Reply(p, gatewayHardAddr, p.TargetIP); err != nil {
-			log.Errorf("failed to answer arp request: %v", err)
+		gateway.answer(p)
+	}
+}
+
+// arpGateway tracks the hardware address of the gateway for ServeARP, and answers the vm with it.
+type arpGateway struct {
+	cli      *arp.Client
+	iface    *net.Interface
+	ip       net.IP
+	vmIP     net.IP
+	vmHwAddr net.HardwareAddr
+
+	mu           sync.Mutex
+	hardwareAddr net.HardwareAddr
+	// updatedAt is when hardwareAddr was learned. A resolution started before it is stale.
+	updatedAt time.Time
+	// answered are addresses answered with hardwareAddr, the vm caches them.
+	answered map[string]net.IP
+}
+
+// refresh resolves the gateway every `interval` until ctx is done. Requests are sent from the address of the
+// interface, which is serviceIP on service interfaces, so that replies reach it through ipvlan as well.
+// Failures are logged when they start and end, not on every interval.
+func (g *arpGateway) refresh(ctx context.Context, resolver *Resolver, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		start := time.Now()
+		hardwareAddr, err := resolver.Resolve(ctx, g.iface.Name, g.ip)
+		switch {
+		case err == nil:
+			if failing {
+				log.Infof("gateway %s is resolved again", g.ip)
+				failing = false
+			}
+			g.update(hardwareAddr, start)
+		case ctx.Err() == nil && !failing:
+			log.Warnf("failed to resolve gateway %s, keep trying every %s: %v", g.ip, interval, err)
+			failing = true
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// answer answers the ARP request `p` from the vm with the hardware address of the gateway, if it's known.
+func (g *arpGateway) answer(p *arp.Packet) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.hardwareAddr == nil {
+		log.Debugf("get an arp request for %v before the gateway is resolved, ignore", p.TargetIP)
+		return
+	}
+	if err := g.cli.Reply(p, g.hardwareAddr, p.TargetIP); err != nil {
+		log.Errorf("failed to answer arp request: %v", err)
+		return
+	}
+	g.answered[p.TargetIP.String()] = p.TargetIP
+	log.Debugf("answered arp request to %v", g.hardwareAddr)
+}
+
+// track updates the hardware address of the gateway by requests from it, which ask for someone or announce
+// itself, and reports whether `p` is one of them. Replies are left to refresh. Replies sent by ServeARP are seen as
+// well, and they may carry a stale address.
+func (g *arpGateway) track(p *arp.Packet) bool {
+	if g.ip == nil || p.Operation != arp.OperationRequest || !p.SenderIP.Equal(g.ip) ||
+		bytes.Equal(p.SenderHardwareAddr, g.vmHwAddr) {
+		return false
+	}
+	g.update(p.SenderHardwareAddr, time.Now())
+	return true
+}
+
+// update sets the hardware address of the gateway learned at `at`, and corrects the vm if it changes.
+func (g *arpGateway) update(hardwareAddr net.HardwareAddr, at time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if at.Before(g.updatedAt) {
+		return
+	}
+	g.updatedAt = at
+	if bytes.Equal(hardwareAddr, g.hardwareAddr) {
+		return
+	}
+	if g.hardwareAddr == nil {
+		log.Infof("gateway %s is at %s", g.ip, hardwareAddr)
+		g.hardwareAddr = append(net.HardwareAddr(nil), hardwareAddr...)
+		return
+	}
+	log.Warnf("gateway %s moves from %s to %s", g.ip, g.hardwareAddr, hardwareAddr)
+	g.hardwareAddr = append(net.HardwareAddr(nil), hardwareAddr...)
+	g.correct()
+}
+
+// correct sends ARP replies of the new hardware address to the vm for all addresses it may have cached.
+// It requires mu.
+func (g *arpGateway) correct() {
+	g.answered[g.ip.String()] = g.ip
+	for _, ip := range g.answered {
+		p, err := arp.NewPacket(arp.OperationReply, g.hardwareAddr, ip, g.vmHwAddr, g.vmIP)
+		if err == nil {
+			err = g.cli.WriteTo(p, g.vmHwAddr)
+		}
+		if err != nil {
+			log.Errorf("failed to correct arp entry of %s in vm: %v", ip, err)
 			continue
 		}
-		log.Debugf("answered arp request to %v", gatewayHardAddr)
+		log.Debugf("corrected arp entry of %s in vm to %s", ip, g.hardwareAddr)
 	}
 }
@@ -1,9 +1,13 @@
 package network
 
 import (
+	"bytes"
+	"context"
 	"github.com/cox96de/containervm/util"
 	"github.com/mdlayher/arp"
+	"github.com/pkg/errors"
 	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
 	"net"
 	"testing"
 	"time"
@@ -32,16 +36,22 @@ func TestServeARP(t *testing.T) {
 	assert.NilError(t, err, output)
 	output, err = util.Run("ip", "link", "set", serverIface, "up")
 	assert.NilError(t, err, output)
-	go func() {
-		ip, err := net.ResolveIPAddr("", "192.168.1.1")
-		assert.NilError(t, err)
-		hw, err := net.ParseMAC("12:34:56:78:9a:bc")
-		assert.NilError(t, err)
-		gwHW, err := net.ParseMAC("12:34:56:78:9a:02")
-		assert.NilError(t, err)
-		err = ServeARP(serverIface, ip, hw, gwHW)
-		assert.NilError(t, err)
-	}()
+	ip, err := net.ResolveIPAddr("", "192.168.1.1")
+	assert.NilError(t, err)
+	hw, err := net.ParseMAC("12:34:56:78:9a:bc")
+	assert.NilError(t, err)
+	gwHW, err := net.ParseMAC("12:34:56:78:9a:02")
+	assert.NilError(t, err)
+	serve := func(ctx context.Context) chan error {
+		serveErr := make(chan error, 1)
+		go func() {
+			serveErr <- ServeARP(ctx, serverIface, &ARPOption{HardwareAddr: hw, Addr: ip, GatewayHardwareAddr: gwHW})
+		}()
+		return serveErr
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serveErr := serve(ctx)
 	// Wait for server to start
 	time.Sleep(time.Millisecond * 50)
 	iface, err := net.InterfaceByName(clientIface)
@@ -67,5 +77,118 @@ func TestServeARP(t *testing.T) {
 		_, _, err = client.Read()
 		assert.ErrorContains(t, err, "i/o timeout")
 	})
+	t.Run("cancel", func(t *testing.T) {
+		cancel()
+		select {
+		case err := <-serveErr:
+			assert.NilError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("arp server is not stopped")
+		}
+	})
+	t.Run("interface_gone", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		serveErr := serve(ctx)
+		time.Sleep(time.Millisecond * 50)
+		output, err := util.Run("ip", "link", "del", serverIface)
+		assert.NilError(t, err, output)
+		select {
+		case err := <-serveErr:
+			assert.Assert(t, errors.Is(err, ErrInterfaceGone), "unexpected error: %v", err)
+		case <-time.After(linkCheckInterval * 2):
+			t.Fatal("arp server is not stopped")
+		}
+	})
+}
+
+// readARP reads ARP packets by `cli` until one matches `match`.
+func readARP(t *testing.T, cli *arp.Client, match func(p *arp.Packet) bool) *arp.Packet {
+	assert.NilError(t, cli.SetReadDeadline(time.Now().Add(time.Second)))
+	for {
+		p, _, err := cli.Read()
+		assert.NilError(t, err)
+		if match(p) {
+			return p
+		}
+	}
+}
+
+func TestServeARPGatewayChanges(t *testing.T) {
+	clientIface := "vethag0"
+	serverIface := "vethag1"
+	hw, _ := net.ParseMAC("12:34:56:78:9a:70")
+	setupVethPair(t, clientIface, serverIface, hw.String())
+	output, err := util.Run("ip", "addr", "add", "192.168.70.3/24", "dev", clientIface)
+	assert.NilError(t, err, output)
+	output, err = util.Run("ip", "addr", "add", serviceIP, "dev", serverIface)
+	assert.NilError(t, err, output)
+	gwIP := net.ParseIP("192.168.70.1").To4()
+	gwHW, _ := net.ParseMAC("12:34:56:78:9a:01")
+	newGwHW, _ := net.ParseMAC("12:34:56:78:9a:02")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		_ = ServeARP(ctx, serverIface, &ARPOption{
+			HardwareAddr:    hw,
+			Addr:            &net.IPNet{IP: net.ParseIP("192.168.70.3"), Mask: net.CIDRMask(24, 32)},
+			Gateway:         gwIP,
+			RefreshInterval: time.Millisecond * 100,
+		})
+	}()
+	iface, err := net.InterfaceByName(clientIface)
+	assert.NilError(t, err)
+	// cli is both the vm and the gateway, packets of the gateway are sent from its hardware address.
+	cli, err := arp.Dial(iface)
+	assert.NilError(t, err)
+	defer cli.Close()
+	peerIP := net.ParseIP("192.168.70.4").To4()
+	isReplyOf := func(ip net.IP) func(p *arp.Packet) bool {
+		return func(p *arp.Packet) bool {
+			return p.Operation == arp.OperationReply && p.SenderIP.Equal(ip) && bytes.Equal(p.TargetHardwareAddr, hw)
+		}
+	}
+
+	probe := readARP(t, cli, func(p *arp.Packet) bool {
+		return p.Operation == arp.OperationRequest && p.TargetIP.Equal(gwIP)
+	})
+	// The request is from the service interface, so that the reply is dispatched to it by ipvlan.
+	assert.Assert(t, probe.SenderIP.Equal(serviceAddr), probe.SenderIP)
+	reply, err := arp.NewPacket(arp.OperationReply, gwHW, gwIP, probe.SenderHardwareAddr, probe.SenderIP)
+	assert.NilError(t, err)
+	assert.NilError(t, cli.WriteTo(reply, probe.SenderHardwareAddr))
+	// Requests are ignored until the gateway is resolved.
+	var answer *arp.Packet
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		if err := cli.Request(peerIP); err != nil {
+			return poll.Error(err)
+		}
+		if err := cli.SetReadDeadline(time.Now().Add(time.Millisecond * 100)); err != nil {
+			return poll.Error(err)
+		}
+		for {
+			p, _, err := cli.Read()
+			if err != nil {
+				return poll.Continue("the gateway is not resolved")
+			}
+			if isReplyOf(peerIP)(p) {
+				answer = p
+				return poll.Success()
+			}
+		}
+	})
+	assert.DeepEqual(t, answer.SenderHardwareAddr, gwHW)
 
+	// The gateway fails over and announces itself.
+	announcement, err := arp.NewPacket(arp.OperationRequest, newGwHW, gwIP, make(net.HardwareAddr, 6), gwIP)
+	assert.NilError(t, err)
+	assert.NilError(t, cli.WriteTo(announcement, broadcastHardwareAddr))
+	// Corrections are sent in any order, and answers to earlier requests may be read before them.
+	corrected := map[string]bool{}
+	for len(corrected) < 2 {
+		p := readARP(t, cli, func(p *arp.Packet) bool {
+			return (isReplyOf(peerIP)(p) || isReplyOf(gwIP)(p)) && bytes.Equal(p.SenderHardwareAddr, newGwHW)
+		})
+		corrected[p.SenderIP.String()] = true
+	}
 }
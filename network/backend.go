@@ -0,0 +1,282 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// BackendMacvtap connects the VM by a macvtap device upon the pod NIC. It's the default.
+	BackendMacvtap = "macvtap"
+	// BackendBridge connects the VM by a tap device, which is enslaved to a Linux bridge with the pod NIC.
+	// It works where macvlan is restricted.
+	BackendBridge = "bridge"
+	// BackendIPVtap connects the VM by an ipvtap device upon the pod NIC. The NIC keeps its MAC,
+	// it works on CNIs which only allow the MAC of the pod on the wire.
+	BackendIPVtap = "ipvtap"
+)
+
+// Backend connects the pod NIC to the VM. The VM takes over the MAC and addresses of the NIC.
+type Backend interface {
+	// SetJournal makes Setup persist the original state of the NIC to `path` before mutating it.
+	// The journal is removed once Recover succeeds. See RecoverFromJournal.
+	SetJournal(path string)
+	// Setup reconfigures the NIC and creates the devices of the VM.
+	Setup() error
+	// OpenTap opens the tap device of the VM `queues` times, each file is a queue of it for qemu.
+	OpenTap(queues int) ([]*os.File, error)
+	// ServiceInterface returns the interface which shares the link with the VM,
+	// the DHCP, ARP and other servers for the VM run on it.
+	ServiceInterface() string
+	// GetRoutes returns the routes of the NIC captured by Setup.
+	GetRoutes() []netlink.Route
+	// Recover restores the NIC to the state before Setup, and removes devices created by Setup.
+	// It's idempotent: pieces which are already restored are skipped, so it can be retried.
+	Recover() error
+}
+
+// NewBackend creates a Backend of `kind`, which is BackendMacvtap, BackendBridge or BackendIPVtap.
+// The NIC gets `newMac` after Setup, except for BackendIPVtap which keeps the MAC of the NIC. `tapName` and `lanName` are names of the devices created by the backend.
+func NewBackend(kind string, defaultNIC string, newMac net.HardwareAddr, tapName string,
+	lanName string) (Backend, error) {
+	switch kind {
+	case "", BackendMacvtap:
+		return NewBridgeConfigure(defaultNIC, newMac, tapName, lanName), nil
+	case BackendBridge:
+		return NewTapBridgeConfigure(defaultNIC, newMac, tapName, lanName), nil
+	case BackendIPVtap:
+		return NewIPVtapConfigure(defaultNIC, tapName, lanName), nil
+	default:
+		return nil, errors.Errorf("unknown network backend: %s", kind)
+	}
+}
+
+// serviceIP is assigned to the service interface, so that servers for the VM can send packets.
+const serviceIP = "240.0.0.1/32"
+
+// serviceAddr is the address of serviceIP.
+var serviceAddr = net.IPv4(240, 0, 0, 1).To4()
+
+// ServiceAddr returns the address of service interfaces. Servers for the VM, such as the TFTP server, use it.
+func ServiceAddr() net.IP {
+	return append(net.IP(nil), serviceAddr...)
+}
+
+// nicSnapshot is the original state of the pod NIC, which is restored by backends on Recover.
+type nicSnapshot struct {
+	defaultNIC string
+	addresses  []net.Addr
+	routes     []netlink.Route
+	rules      []netlink.Rule
+	// originalMac is the MAC of defaultNIC before Setup.
+	originalMac net.HardwareAddr
+	// journalPath is where the state before Setup is persisted. Empty means no journal.
+	journalPath string
+}
+
+func (s *nicSnapshot) SetJournal(path string) {
+	s.journalPath = path
+}
+
+// GetRoutes returns the routes of the NIC captured by Setup.
+func (s *nicSnapshot) GetRoutes() []netlink.Route {
+	return s.routes
+}
+
+// snapshot captures the addresses, routes and MAC of `link`.
+func (s *nicSnapshot) snapshot(link netlink.Link) error {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to get ip of nic %s", s.defaultNIC)
+	}
+	for _, addr := range addrs {
+		s.addresses = append(s.addresses, addr.IPNet)
+	}
+	// Routes via the NIC are gone along with its IPs, keep all of them to restore.
+	s.routes, s.rules, err = snapshotRoutes(link)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to snapshot routes of nic %s", s.defaultNIC)
+	}
+	s.originalMac = link.Attrs().HardwareAddr
+	return nil
+}
+
+// writeJournal persists `state` if a journal is set.
+func (s *nicSnapshot) writeJournal(state *bridgeState) error {
+	if s.journalPath == "" {
+		return nil
+	}
+	if err := writeJournal(s.journalPath, state); err != nil {
+		return errors.WithMessage(err, "failed to write journal")
+	}
+	log.Infof("journal is written to %s", s.journalPath)
+	return nil
+}
+
+// state returns the state of the NIC to be persisted in the journal.
+func (s *nicSnapshot) state() *bridgeState {
+	state := &bridgeState{
+		NIC:          s.defaultNIC,
+		HardwareAddr: s.originalMac.String(),
+	}
+	for _, addr := range s.addresses {
+		state.Addresses = append(state.Addresses, addr.String())
+	}
+	for _, route := range s.routes {
+		state.Routes = append(state.Routes, newRouteState(&route))
+	}
+	for _, rule := range s.rules {
+		state.Rules = append(state.Rules, newRuleState(&rule))
+	}
+	return state
+}
+
+// changeMac sets the MAC of `link` to `mac`, the link is brought down during it.
+func changeMac(link netlink.Link, mac net.HardwareAddr) error {
+	name := link.Attrs().Name
+	// Identical to `ip link set nicName down`.
+	if err := netlink.LinkSetDown(link); err != nil {
+		return errors.WithMessagef(err, "failed to bring down nic %s", name)
+	}
+	// Identical to `ip link set nicName address mac`.
+	if err := netlink.LinkSetHardwareAddr(link, mac); err != nil {
+		return errors.WithMessagef(err, "failed to set mac '%s' for nic %s ", mac.String(), name)
+	}
+	// Identical to `ip link set nicName up`.
+	if err := netlink.LinkSetUp(link); err != nil {
+		return errors.WithMessagef(err, "failed to bring up nic %s", name)
+	}
+	return nil
+}
+
+// flushAddresses removes all addresses of `link`, identical to `ip addr flush dev nicName`.
+func flushAddresses(link netlink.Link) error {
+	name := link.Attrs().Name
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to get ip of nic %s", name)
+	}
+	for _, addr := range addrs {
+		if err := netlink.AddrDel(link, &addr); err != nil {
+			return errors.WithMessagef(err, "failed to delete ip %s of nic %s", addr.String(), name)
+		}
+	}
+	return nil
+}
+
+// restore restores the MAC, addresses and routes of the NIC, and removes the journal.
+// `originalMac` is used if the snapshot has no MAC. Devices of the backend must be removed before.
+func (s *nicSnapshot) restore(originalMac net.HardwareAddr) error {
+	defaultNIC := s.defaultNIC
+	if s.originalMac != nil {
+		originalMac = s.originalMac
+	}
+	defaultLink, err := netlink.LinkByName(defaultNIC)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to get link by name %s", defaultNIC)
+	}
+	if originalMac != nil && !bytes.Equal(defaultLink.Attrs().HardwareAddr, originalMac) {
+		err = netlink.LinkSetHardwareAddr(defaultLink, originalMac)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to set mac '%s' for nic %s ",
+				originalMac.String(), defaultNIC)
+		}
+	}
+	if err = netlink.LinkSetUp(defaultLink); err != nil {
+		return errors.WithMessagef(err, "failed to bring up nic %s", defaultNIC)
+	}
+	for _, addr := range s.addresses {
+		address, err := netlink.ParseAddr(addr.String())
+		if err != nil {
+			log.Errorf("failed to parse address: %s", addr.String())
+			continue
+		}
+		log.Infof("add ip %s to nic %s", addr.String(), defaultNIC)
+		if err := netlink.AddrAdd(defaultLink, address); err != nil {
+			if errors.Is(err, syscall.EEXIST) {
+				log.Infof("ip %s of nic %s is already restored", addr.String(), defaultNIC)
+				continue
+			}
+			return errors.WithMessagef(err, "failed to assign ip %s to nic %s", addr.String(), defaultNIC)
+		}
+	}
+	if err = restoreRoutes(defaultLink, s.routes, s.rules); err != nil {
+		return errors.WithMessagef(err, "failed to restore routes of nic %s", defaultNIC)
+	}
+	if s.journalPath != "" {
+		if err = os.Remove(s.journalPath); err != nil && !os.IsNotExist(err) {
+			return errors.WithMessagef(err, "failed to remove journal %s", s.journalPath)
+		}
+	}
+	return nil
+}
+
+// deleteLinkIfExists deletes the link named `name` if it exists.
+func deleteLinkIfExists(name string) error {
+	link, err := linkByNameIfExists(name)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to get link by name %s", name)
+	}
+	if link == nil {
+		return nil
+	}
+	if err = netlink.LinkDel(link); err != nil {
+		return errors.WithMessagef(err, "failed to delete device %s", name)
+	}
+	return nil
+}
+
+// tapFlags are the flags of tap devices for qemu, qemu uses vnet headers for offloading.
+// Tap devices are always multi-queue, so that the VM can use one queue per vCPU.
+const tapFlags = unix.IFF_TAP | unix.IFF_NO_PI | unix.IFF_VNET_HDR | unix.IFF_MULTI_QUEUE
+
+// openTap attaches to the persistent tap device `name` `queues` times, each attachment is a queue.
+func openTap(name string, queues int) ([]*os.File, error) {
+	var files []*os.File
+	for i := 0; i < queues; i++ {
+		f, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+		if err != nil {
+			closeFiles(files)
+			return nil, errors.WithMessage(err, "failed to open /dev/net/tun")
+		}
+		files = append(files, f)
+		ifr, err := unix.NewIfreq(name)
+		if err != nil {
+			closeFiles(files)
+			return nil, errors.WithMessagef(err, "bad tap name %s", name)
+		}
+		ifr.SetUint16(tapFlags)
+		if err = unix.IoctlIfreq(int(f.Fd()), unix.TUNSETIFF, ifr); err != nil {
+			closeFiles(files)
+			return nil, errors.WithMessagef(err, "failed to attach queue %d to tap device %s", i, name)
+		}
+	}
+	return files, nil
+}
+
+// openTapDevice opens the device file of a macvtap or ipvtap device `queues` times, each file is a queue.
+func openTapDevice(path string, queues int) ([]*os.File, error) {
+	var files []*os.File
+	for i := 0; i < queues; i++ {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			closeFiles(files)
+			return nil, errors.WithMessagef(err, "failed to open tap dev(%s)", path)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		_ = f.Close()
+	}
+}
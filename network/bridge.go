@@ -13,20 +13,20 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// BridgeConfigure is the macvtap Backend. The VM gets a macvtap device upon the NIC in bridge mode,
+// and servers for the VM run on a macvlan device upon the NIC.
 type BridgeConfigure struct {
-	defaultNIC string
-	tapName    string
-	lanName    string
-	newMac     net.HardwareAddr
-	gateways   []net.IP
-	addresses  []net.Addr
+	nicSnapshot
+	tapName string
+	lanName string
+	newMac  net.HardwareAddr
 
 	macvatpDevicePath string
 }
 
 func NewBridgeConfigure(defaultNIC string, newMac net.HardwareAddr, tapName string, lanName string) *BridgeConfigure {
 	return &BridgeConfigure{
-		defaultNIC:        defaultNIC,
+		nicSnapshot:       nicSnapshot{defaultNIC: defaultNIC},
 		tapName:           tapName,
 		lanName:           lanName,
 		newMac:            newMac,
@@ -34,6 +34,11 @@ func NewBridgeConfigure(defaultNIC string, newMac net.HardwareAddr, tapName stri
 	}
 }
 
+// Setup implements Backend.
+func (b *BridgeConfigure) Setup() error {
+	return b.SetupBridge()
+}
+
 func (b *BridgeConfigure) SetupBridge() error {
 	// Set MAC of NIC to a random one. The original MAC should be assigned to the tap device.
 	nicName := b.defaultNIC
@@ -43,43 +48,14 @@ func (b *BridgeConfigure) SetupBridge() error {
 	if err != nil {
 		return errors.WithMessagef(err, "failed to get link by name %s", nicName)
 	}
-	// Flush the original NIC IPs.
-	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
-	if err != nil {
-		return errors.WithMessagef(err, "failed to get ip of nic %s", nicName)
-	}
-	// Identical to `ip addr flush dev nicName`.
-	for _, addr := range addrs {
-		b.addresses = append(b.addresses, addr.IPNet)
-	}
-	ip4Gateway, err := util.GetIPv4DefaultGateway()
-	if err == nil {
-		b.gateways = append(b.gateways, ip4Gateway)
-	} else {
-		if !errors.Is(err, util.NotFoundError) {
-			return errors.WithMessagef(err, "failed to get ipv4 default gateway")
-		}
-	}
-	ip6Gateway, err := util.GetIPv6DefaultGateway()
-	if err == nil {
-		b.gateways = append(b.gateways, ip6Gateway)
-	} else {
-		if !errors.Is(err, util.NotFoundError) {
-			return errors.WithMessagef(err, "failed to get ipv6 default gateway")
-		}
-	}
-
-	// Identical to `ip link set nicName down`.
-	if err = netlink.LinkSetDown(link); err != nil {
-		return errors.WithMessagef(err, "failed to bring down nic %s", nicName)
+	if err = b.snapshot(link); err != nil {
+		return err
 	}
-	// Identical to `ip link set nicName address opt.NewNICMac.String()`.
-	if err = netlink.LinkSetHardwareAddr(link, b.newMac); err != nil {
-		return errors.WithMessagef(err, "failed to set mac '%s' for nic %s ", b.newMac.String(), nicName)
+	if err = b.writeJournal(b.state()); err != nil {
+		return err
 	}
-	// Identical to `ip link set nicName up`.
-	if err = netlink.LinkSetUp(link); err != nil {
-		return errors.WithMessagef(err, "failed to bring up nic %s", nicName)
+	if err = changeMac(link, b.newMac); err != nil {
+		return err
 	}
 	// Create a MacVTap device upon the NIC and assign the original NIC MAC to it.
 	log.Infof("creating tap device %s upon nic %s", tapName, nicName)
@@ -108,16 +84,8 @@ func (b *BridgeConfigure) SetupBridge() error {
 	if err = netlink.LinkSetUp(macvtap); err != nil {
 		return errors.WithMessagef(err, "failed to bring up macvtap %s", tapName)
 	}
-	// Flush the original NIC IPs.
-	addrs, err = netlink.AddrList(link, netlink.FAMILY_ALL)
-	if err != nil {
-		return errors.WithMessagef(err, "failed to get ip of nic %s", nicName)
-	}
-	// Identical to `ip addr flush dev nicName`.
-	for _, addr := range addrs {
-		if err := netlink.AddrDel(link, &addr); err != nil {
-			return errors.WithMessagef(err, "failed to delete ip %s of nic %s", addr.String(), nicName)
-		}
+	if err = flushAddresses(link); err != nil {
+		return err
 	}
 	major, minor, err := getTapDeviceNum(tapName)
 	if err != nil {
@@ -147,13 +115,12 @@ func (b *BridgeConfigure) SetupBridge() error {
 		return errors.WithMessagef(err, "failed to bring up macvlan %s", lanName)
 	}
 	// Identical to `ip addr add xxxx dev lanName`.
-	lanIP := "240.0.0.1/32"
-	addr, err := netlink.ParseAddr(lanIP)
+	addr, err := netlink.ParseAddr(serviceIP)
 	if err != nil {
-		return errors.WithMessagef(err, "failed to parse ip address '%s'", lanIP)
+		return errors.WithMessagef(err, "failed to parse ip address '%s'", serviceIP)
 	}
 	if err = netlink.AddrAdd(macvtap, addr); err != nil {
-		return errors.WithMessagef(err, "failed to assign ip address '%s' to macvlan device %s", lanIP, lanName)
+		return errors.WithMessagef(err, "failed to assign ip address '%s' to macvlan device %s", serviceIP, lanName)
 	}
 	return nil
 }
@@ -161,73 +128,64 @@ func (b *BridgeConfigure) SetupBridge() error {
 func (b *BridgeConfigure) GetMacVtapDevicePath() string {
 	return b.macvatpDevicePath
 }
+
+// OpenTap implements Backend. Each open of the macvtap device file is a queue.
+func (b *BridgeConfigure) OpenTap(queues int) ([]*os.File, error) {
+	return openTapDevice(b.macvatpDevicePath, queues)
+}
+
+// ServiceInterface implements Backend, it's the macvlan device.
+func (b *BridgeConfigure) ServiceInterface() string {
+	return b.lanName
+}
+
+// Recover restores the NIC to the state before SetupBridge, and removes devices created by SetupBridge.
+// It's idempotent: pieces which are already restored are skipped, so it can be retried.
 func (b *BridgeConfigure) Recover() error {
 	tapName := b.tapName
-	defaultNIC := b.defaultNIC
-	address := b.addresses
-	lanName := b.lanName
-	gateways := b.gateways
-	tapLink, err := netlink.LinkByName(tapName)
+	tapLink, err := linkByNameIfExists(tapName)
 	if err != nil {
 		return errors.WithMessagef(err, "failed to get link by name %s", tapName)
 	}
-	log.Infof("set tap device %s down", tapName)
-	if err = netlink.LinkSetDown(tapLink); err != nil {
-		return errors.WithMessagef(err, "failed to bring down tap device '%s'",
-			tapLink.Attrs().Name)
-	}
-	defaultLink, err := netlink.LinkByName(defaultNIC)
-	if err != nil {
-		return errors.WithMessagef(err, "failed to get link by name %s", defaultNIC)
-	}
-	err = netlink.LinkSetHardwareAddr(defaultLink, tapLink.Attrs().HardwareAddr)
-	if err != nil {
-		return errors.WithMessagef(err, "failed to set mac '%s' for nic %s ",
-			tapLink.Attrs().HardwareAddr.String(), defaultNIC)
-	}
-	for _, addr := range address {
-		address, err := netlink.ParseAddr(addr.String())
-		if err != nil {
-			log.Errorf("failed to parse address: %s", addr.String())
-			continue
-		}
-		log.Infof("add ip %s to nic %s", addr.String(), defaultNIC)
-		if err := netlink.AddrAdd(defaultLink, address); err != nil {
-			return errors.WithMessagef(err, "failed to assign ip %s to nic %s", addr.String(), defaultNIC)
+	var tapMac net.HardwareAddr
+	if tapLink != nil {
+		log.Infof("delete tap device %s", tapName)
+		// The macvtap has the original MAC, which is used if the snapshot has no MAC.
+		tapMac = tapLink.Attrs().HardwareAddr
+		if err = netlink.LinkDel(tapLink); err != nil {
+			return errors.WithMessagef(err, "failed to delete tap device %s", tapName)
 		}
 	}
-	if err = netlink.LinkDel(tapLink); err != nil {
-		return errors.WithMessagef(err, "failed to delete tap device %s", tapLink.Attrs().Name)
-	}
 	if err = os.RemoveAll(b.macvatpDevicePath); err != nil {
 		log.Warnf("failed to delete tap device file %s: %+v", tapName, err)
 	}
-	lanLink, err := netlink.LinkByName(lanName)
+	if err = deleteLinkIfExists(b.lanName); err != nil {
+		return err
+	}
+	return b.restore(tapMac)
+}
+
+// state returns the state to be persisted in the journal.
+func (b *BridgeConfigure) state() *bridgeState {
+	state := b.nicSnapshot.state()
+	state.Backend = BackendMacvtap
+	state.TapName = b.tapName
+	state.LanName = b.lanName
+	state.TapDevicePath = b.macvatpDevicePath
+	return state
+}
+
+// linkByNameIfExists returns the link named `name`, or nil if it doesn't exist.
+func linkByNameIfExists(name string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
 	if err != nil {
-		return errors.WithMessagef(err, "failed to get link by name %s", lanName)
-	}
-	if err = netlink.LinkDel(lanLink); err != nil {
-		return errors.WithMessagef(err, "failed to delete macvlan device %s", lanLink.Attrs().Name)
-	}
-	for _, gateway := range gateways {
-		var dst *net.IPNet
-		if gateway.To4() == nil {
-			_, dst, err = net.ParseCIDR("::/0")
-			if err != nil {
-				panic(err)
-			}
-		}
-		route := &netlink.Route{
-			LinkIndex: defaultLink.Attrs().Index,
-			Gw:        gateway,
-			Dst:       dst,
-		}
-		err = netlink.RouteAdd(route)
-		if err != nil {
-			return errors.WithMessagef(err, "failed to add default router '%+v', %+v", gateway, route)
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil, nil
 		}
+		return nil, err
 	}
-	return nil
+	return link, nil
 }
 
 // getTapDeviceNum returns tap device major/minor device id.
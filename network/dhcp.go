@@ -2,20 +2,38 @@ package network
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv4/server4"
 	"github.com/insomniacslk/dhcp/rfc1035label"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"math"
 	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
+// optionMSClasslessStaticRoute is the Microsoft classless static route option, used by old Windows clients.
+// Its format is identical to the classless static route option (121).
+const optionMSClasslessStaticRoute = dhcpv4.GenericOptionCode(249)
+
+// minDHCPMTU is the minimum value of the interface MTU option (RFC 2132 5.1).
+const minDHCPMTU = 68
+
 type DHCPOption struct {
 	// Only response dhcp request from HardwareAddr.
 	HardwareAddr net.HardwareAddr
 	// Return that IP in dhcp response
 	IP net.Addr
-	// Return GatewayIP in dhcp response.
+	// Return GatewayIP in dhcp response. It's optional, such as for a network only reachable by Routes.
 	GatewayIP net.IP
 	// Return DNSServers in dhcp response.
 	DNSServers []net.IP
@@ -23,6 +41,33 @@ type DHCPOption struct {
 	SearchDomains []string
 	// Return Hostname in dhcp response
 	Hostname string
+	// Routes are the routes of the original nic. IPv4 unicast routes in the main table are returned as
+	// classless static routes (option 121 and 249), so that gateways only reachable by on-link routes work.
+	Routes []netlink.Route
+	// MTU is returned as the interface MTU (option 26) if it's not zero.
+	MTU int
+	// NTPServers are returned as NTP servers (option 42).
+	NTPServers []net.IP
+	// DomainName is returned as the domain name (option 15) if it's not empty.
+	DomainName string
+	// LeaseTime is the lease time of IP. Zero means infinite.
+	LeaseTime time.Duration
+	// RenewalTime (T1) and RebindingTime (T2) are returned if they are not zero, otherwise clients derive them
+	// from LeaseTime.
+	RenewalTime   time.Duration
+	RebindingTime time.Duration
+	// Options are returned as is, they take precedence over options above.
+	Options []dhcpv4.Option
+	// BootServer is the server to boot from over network, returned as siaddr and the TFTP server name (option 66).
+	BootServer net.IP
+	// BootFile is the file to boot from BootServer, returned as file and the bootfile name (option 67).
+	BootFile string
+	// IPXEScript is returned instead of BootFile to iPXE, such as an HTTP URL of an iPXE script. PXE ROMs load iPXE
+	// from BootFile, then iPXE asks again with the user class "iPXE" to get the script.
+	IPXEScript string
+	// OnLease is called with IP once the client gets it, that is, acked in SELECTING or INIT-REBOOT state, but not
+	// on renewals. It must not block.
+	OnLease func(ip net.IP)
 }
 
 // NewDHCPServerFromAddr creates a DHCPServer to distribute `addr` and `gateway`.
@@ -35,6 +80,20 @@ func NewDHCPServerFromAddr(opt *DHCPOption) (*DHCPServer, error) {
 	if err != nil {
 		return nil, errors.WithMessage(err, "failed to get hostname")
 	}
+	routes := classlessRoutes(opt.Routes)
+	if len(routes) > 0 && opt.GatewayIP != nil && !hasDefaultRoute(routes) {
+		routes = append(routes, &dhcpv4.Route{
+			Dest:   &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+			Router: opt.GatewayIP.To4(),
+		})
+	}
+	if opt.MTU != 0 && (opt.MTU < minDHCPMTU || opt.MTU > math.MaxUint16) {
+		return nil, errors.Errorf("bad mtu: %d", opt.MTU)
+	}
+	leaseTime := opt.LeaseTime
+	if leaseTime == 0 {
+		leaseTime = dhcpv4.MaxLeaseTime
+	}
 	return &DHCPServer{
 		clientIP:      clientIP.To4(),
 		clientHwAddr:  opt.HardwareAddr,
@@ -44,6 +103,18 @@ func NewDHCPServerFromAddr(opt *DHCPOption) (*DHCPServer, error) {
 		router:        opt.GatewayIP.To4(),
 		dnsServers:    opt.DNSServers,
 		domains:       opt.SearchDomains,
+		routes:        routes,
+		mtu:           opt.MTU,
+		ntpServers:    opt.NTPServers,
+		domainName:    opt.DomainName,
+		leaseTime:     leaseTime,
+		renewalTime:   opt.RenewalTime,
+		rebindingTime: opt.RebindingTime,
+		options:       opt.Options,
+		bootServer:    opt.BootServer.To4(),
+		bootFile:      opt.BootFile,
+		ipxeScript:    opt.IPXEScript,
+		onLease:       opt.OnLease,
 	}, nil
 }
 
@@ -60,25 +131,39 @@ type DHCPServer struct {
 	router        net.IP
 	dnsServers    []net.IP
 	domains       []string
-}
+	routes        []*dhcpv4.Route
+	mtu           int
+	ntpServers    []net.IP
+	domainName    string
+	leaseTime     time.Duration
+	renewalTime   time.Duration
+	rebindingTime time.Duration
+	options       []dhcpv4.Option
+	bootServer    net.IP
+	bootFile      string
+	ipxeScript    string
+	onLease       func(ip net.IP)
 
-type logger struct{}
-
-func (l *logger) PrintMessage(prefix string, message *dhcpv4.DHCPv4) {
-	log.Debugf("%s: %s", prefix, message.Summary())
-}
-
-func (l *logger) Printf(format string, v ...interface{}) {
-	log.Debugf(format, v...)
+	stats dhcpCounters
 }
 
-// Run starts the server on the interface `ifName`.
-func (s *DHCPServer) Run(ifName string) error {
+// Run starts the server on the interface `ifName`. It stops when ctx is done, or returns ErrInterfaceGone when the
+// interface is deleted.
+func (s *DHCPServer) Run(ctx context.Context, ifName string) error {
 	s.ifName = ifName
-	server, err := server4.NewServer(ifName, nil, s.handle, server4.WithLogger(&logger{}))
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to get interface %s", ifName)
+	}
+	conn, err := server4.NewIPv4UDPConn(ifName, &net.UDPAddr{Port: dhcpv4.ServerPort})
 	if err != nil {
 		return errors.WithMessage(err, "failed to initialize server")
 	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
 	log.Infof("dhcp server runs on %s", ifName)
 	log.Debugf("client ip: %v", s.clientIP)
 	log.Debugf("client hardware addr: %v", s.clientHwAddr)
@@ -88,67 +173,170 @@ func (s *DHCPServer) Run(ifName string) error {
 	log.Debugf("hostname: %s", s.hostname)
 	log.Debugf("dns servers: %+v", s.dnsServers)
 	log.Debugf("search domains: %+v", s.domains)
-	return server.Serve()
+	log.Debugf("routes: %+v", s.routes)
+	log.Debugf("mtu: %d", s.mtu)
+	log.Debugf("ntp servers: %+v", s.ntpServers)
+	log.Debugf("domain name: %s", s.domainName)
+	log.Debugf("lease time: %s, renewal time: %s, rebinding time: %s", s.leaseTime, s.renewalTime, s.rebindingTime)
+	log.Debugf("extra options: %+v", s.options)
+	log.Debugf("boot server: %v, boot file: %s, ipxe script: %s", s.bootServer, s.bootFile, s.ipxeScript)
+	guard := newReadGuard(ctx, iface)
+	buf := make([]byte, 65536)
+	for {
+		// An error of a closed conn is returned by ReadFrom as well.
+		_ = conn.SetReadDeadline(guard.deadline())
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if stop, err := guard.failed(err); stop {
+				return err
+			}
+			continue
+		}
+		guard.succeeded()
+		msg, err := dhcpv4.FromBytes(buf[:n])
+		if err != nil {
+			log.Debugf("failed to parse dhcp message: %+v", err)
+			continue
+		}
+		s.handle(conn, peer, msg)
+	}
 }
 
 func (s *DHCPServer) handle(conn net.PacketConn, peer net.Addr, msg *dhcpv4.DHCPv4) {
-	var (
-		replyMsg *dhcpv4.DHCPv4
-		err      error
-	)
 	if !bytes.Equal(s.clientHwAddr, msg.ClientHWAddr) {
 		log.Debugf("ignoring a dhcp packet from unexpected source, expect '%s', got '%s'",
 			s.clientHwAddr.String(), msg.ClientHWAddr.String())
 		return
 	}
 	log.Debugf("get msg: %s", msg.Summary())
-	msgType := msg.Options.Get(dhcpv4.OptionDHCPMessageType)
-	switch {
-	case bytes.Equal(msgType, dhcpv4.MessageTypeDiscover.ToBytes()):
-		// Get a DISCOVER message. Send an OFFER.
-		log.Debugf("get DISCOVER: %s", msg.Summary())
-		replyMsg, err = s.composeReply(msg, dhcpv4.MessageTypeOffer)
-		if err != nil {
-			log.Errorf("failed to build OFFER message: %+v", err)
-			return
-		}
-		log.Debugf("sending OFFER: %s", replyMsg.Summary())
-	case bytes.Equal(msgType, dhcpv4.MessageTypeRequest.ToBytes()):
-		// Get a REQUEST message. Send an ACK.
-		log.Debugf("get REQUEST: %s", msg.Summary())
-		replyMsg, err = s.composeReply(msg, dhcpv4.MessageTypeAck)
-		if err != nil {
-			log.Errorf("failed to build ACK message: %+v", err)
-			return
-		}
-		log.Debugf("sending ACK: %s", replyMsg.Summary())
-	default:
-		// Get an unrelated message. Just ignore.
-		log.Debugf("ignoring message: %s", msg.Summary())
+	replyMsg, err := s.reply(msg)
+	if err != nil {
+		log.Errorf("failed to build reply for %s: %+v", msg.MessageType(), err)
 		return
 	}
-	_, err = conn.WriteTo(replyMsg.ToBytes(), peer)
+	if replyMsg == nil {
+		return
+	}
+	log.Debugf("sending %s: %s", replyMsg.MessageType(), replyMsg.Summary())
+	_, err = conn.WriteTo(replyMsg.ToBytes(), replyAddr(peer))
 	if err != nil {
 		log.Errorf("failed to send reply: %+v", err)
 		return
 	}
-	return
+	switch replyMsg.MessageType() {
+	case dhcpv4.MessageTypeOffer:
+		s.stats.offers.Add(1)
+	case dhcpv4.MessageTypeAck:
+		s.stats.acks.Add(1)
+		// The client in RENEWING or REBINDING state has ciaddr.
+		renewing := msg.ClientIPAddr != nil && !msg.ClientIPAddr.IsUnspecified()
+		if msg.MessageType() == dhcpv4.MessageTypeRequest && !renewing && s.onLease != nil {
+			s.onLease(s.clientIP)
+		}
+	case dhcpv4.MessageTypeNak:
+		s.stats.naks.Add(1)
+	}
+}
+
+// reply returns the reply to `msg` according to RFC 2131, or nil if `msg` should not be replied.
+func (s *DHCPServer) reply(msg *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error) {
+	switch msg.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		s.stats.discovers.Add(1)
+		return s.composeReply(msg, dhcpv4.MessageTypeOffer)
+	case dhcpv4.MessageTypeRequest:
+		s.stats.requests.Add(1)
+		// A REQUEST in SELECTING state has the server identifier of the selected server.
+		if serverID := msg.ServerIdentifier(); serverID != nil && !serverID.Equal(s.serverID()) {
+			log.Debugf("the client selected another server %s, ignore", serverID)
+			return nil, nil
+		}
+		// The address is the requested IP address in SELECTING or INIT-REBOOT state,
+		// or ciaddr in RENEWING or REBINDING state.
+		requested := msg.RequestedIPAddress()
+		if requested == nil {
+			requested = msg.ClientIPAddr
+		}
+		if !requested.Equal(s.clientIP) {
+			log.Warnf("the client requests %s, which is not %s, send NAK", requested, s.clientIP)
+			return s.composeNak(msg, fmt.Sprintf("requested address %s is not available", requested))
+		}
+		return s.composeReply(msg, dhcpv4.MessageTypeAck)
+	case dhcpv4.MessageTypeInform:
+		// The client has an address already, and asks for other parameters.
+		s.stats.informs.Add(1)
+		return s.composeReply(msg, dhcpv4.MessageTypeAck)
+	case dhcpv4.MessageTypeDecline:
+		s.stats.declines.Add(1)
+		log.Warnf("the client declined %s, the address may be in use by another host on the link",
+			msg.RequestedIPAddress())
+		return nil, nil
+	case dhcpv4.MessageTypeRelease:
+		s.stats.releases.Add(1)
+		log.Infof("the client released %s", msg.ClientIPAddr)
+		return nil, nil
+	default:
+		log.Debugf("ignoring message: %s", msg.Summary())
+		return nil, nil
+	}
+}
+
+// replyAddr returns where to send replies to a client at `peer`.
+// The server has no route to the client, so replies are broadcast on the link, where the VM is the only client.
+func replyAddr(peer net.Addr) net.Addr {
+	port := dhcpv4.ClientPort
+	if udpAddr, ok := peer.(*net.UDPAddr); ok && udpAddr.Port != 0 {
+		port = udpAddr.Port
+	}
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: port}
+}
+
+// serverID returns the server identifier. The server pretends to be the router, or uses the service IP on
+// networks without a router.
+func (s *DHCPServer) serverID() net.IP {
+	if s.router != nil {
+		return s.router
+	}
+	return serviceAddr
 }
 
 func (s *DHCPServer) composeReply(msg *dhcpv4.DHCPv4, msgType dhcpv4.MessageType) (*dhcpv4.DHCPv4, error) {
+	// An ACK to INFORM has neither yiaddr nor lease time, as the address is not leased by the server (RFC 2131 4.3.5).
+	inform := msg.MessageType() == dhcpv4.MessageTypeInform
+	yourIP := s.clientIP
+	if inform {
+		yourIP = net.IPv4zero
+	}
+	serverID := s.serverID()
+	nextServer := serverID
+	if s.bootServer != nil {
+		nextServer = s.bootServer
+	}
 	opts := []dhcpv4.Modifier{
 		dhcpv4.WithReply(msg),
 		dhcpv4.WithClientIP(msg.ClientIPAddr),
-		dhcpv4.WithYourIP(s.clientIP),
-		dhcpv4.WithServerIP(s.router),
+		dhcpv4.WithYourIP(yourIP),
+		dhcpv4.WithServerIP(nextServer),
 		dhcpv4.WithOption(dhcpv4.OptMessageType(msgType)),
-		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.router)),
-		dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(dhcpv4.MaxLeaseTime)),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverID)),
 		dhcpv4.WithOption(dhcpv4.OptBroadcastAddress(s.broadcastAddr)),
-		dhcpv4.WithOption(dhcpv4.OptRouter(s.router)),
 		dhcpv4.WithOption(dhcpv4.OptSubnetMask(s.subnetMask)),
 		dhcpv4.WithOption(dhcpv4.OptHostName(s.hostname)),
 	}
+	if !inform {
+		opts = append(opts, dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(s.leaseTime)))
+		if s.renewalTime > 0 {
+			opts = append(opts, dhcpv4.WithOption(dhcpv4.Option{Code: dhcpv4.OptionRenewTimeValue,
+				Value: dhcpv4.Duration(s.renewalTime)}))
+		}
+		if s.rebindingTime > 0 {
+			opts = append(opts, dhcpv4.WithOption(dhcpv4.Option{Code: dhcpv4.OptionRebindingTimeValue,
+				Value: dhcpv4.Duration(s.rebindingTime)}))
+		}
+	}
+	if s.router != nil {
+		opts = append(opts, dhcpv4.WithOption(dhcpv4.OptRouter(s.router)))
+	}
 	// Windows DHCP client doesn't accept empty options.
 	if len(s.dnsServers) > 0 {
 		opts = append(opts, dhcpv4.WithOption(dhcpv4.OptDNS(s.dnsServers...)))
@@ -156,5 +344,167 @@ func (s *DHCPServer) composeReply(msg *dhcpv4.DHCPv4, msgType dhcpv4.MessageType
 	if len(s.domains) > 0 {
 		opts = append(opts, dhcpv4.WithOption(dhcpv4.OptDomainSearch(&rfc1035label.Labels{Labels: s.domains})))
 	}
+	if len(s.routes) > 0 {
+		opts = append(opts, dhcpv4.WithOption(dhcpv4.OptClasslessStaticRoute(s.routes...)),
+			dhcpv4.WithOption(dhcpv4.Option{Code: optionMSClasslessStaticRoute, Value: dhcpv4.Routes(s.routes)}))
+	}
+	if s.mtu > 0 {
+		mtu := make([]byte, 2)
+		binary.BigEndian.PutUint16(mtu, uint16(s.mtu))
+		opts = append(opts, dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionInterfaceMTU, mtu)))
+	}
+	if len(s.ntpServers) > 0 {
+		opts = append(opts, dhcpv4.WithOption(dhcpv4.OptNTPServers(s.ntpServers...)))
+	}
+	if s.domainName != "" {
+		opts = append(opts, dhcpv4.WithOption(dhcpv4.OptDomainName(s.domainName)))
+	}
+	if s.bootServer != nil {
+		opts = append(opts, dhcpv4.WithOption(dhcpv4.OptTFTPServerName(s.bootServer.String())))
+	}
+	if bootFile := s.bootFileFor(msg); bootFile != "" {
+		opts = append(opts, withBootFileName(bootFile), dhcpv4.WithOption(dhcpv4.OptBootFileName(bootFile)))
+	}
+	// Added last to override options above.
+	for _, opt := range s.options {
+		opts = append(opts, dhcpv4.WithOption(opt))
+	}
 	return dhcpv4.New(opts...)
 }
+
+// bootFileFor returns the boot file for the client of `msg`, the iPXE script if the client is iPXE.
+func (s *DHCPServer) bootFileFor(msg *dhcpv4.DHCPv4) string {
+	if s.ipxeScript != "" && isIPXE(msg) {
+		return s.ipxeScript
+	}
+	return s.bootFile
+}
+
+// isIPXE reports whether `msg` is from iPXE, which sends the user class "iPXE".
+func isIPXE(msg *dhcpv4.DHCPv4) bool {
+	for _, userClass := range msg.UserClass() {
+		if userClass == "iPXE" {
+			return true
+		}
+	}
+	return false
+}
+
+// withBootFileName sets the file field of the header. Names longer than the field are only in option 67.
+func withBootFileName(name string) dhcpv4.Modifier {
+	return func(d *dhcpv4.DHCPv4) {
+		if len(name) < 128 {
+			d.BootFileName = name
+		}
+	}
+}
+
+// composeNak composes a NAK to the REQUEST `msg`, `reason` is sent to the client as the message option.
+func (s *DHCPServer) composeNak(msg *dhcpv4.DHCPv4, reason string) (*dhcpv4.DHCPv4, error) {
+	return dhcpv4.New(
+		dhcpv4.WithReply(msg),
+		// Clients may not be able to receive unicast before they have an address.
+		dhcpv4.WithBroadcast(true),
+		dhcpv4.WithOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeNak)),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.serverID())),
+		dhcpv4.WithOption(dhcpv4.OptMessage(reason)),
+	)
+}
+
+// DHCPStats are counters of messages received and sent by a DHCPServer.
+type DHCPStats struct {
+	// Discovers, Requests, Informs, Declines and Releases are received messages.
+	Discovers int64
+	Requests  int64
+	Informs   int64
+	Declines  int64
+	Releases  int64
+	// Offers, Acks and Naks are sent messages.
+	Offers int64
+	Acks   int64
+	Naks   int64
+}
+
+type dhcpCounters struct {
+	discovers atomic.Int64
+	requests  atomic.Int64
+	informs   atomic.Int64
+	declines  atomic.Int64
+	releases  atomic.Int64
+	offers    atomic.Int64
+	acks      atomic.Int64
+	naks      atomic.Int64
+}
+
+// Stats returns the counters of messages of the server.
+func (s *DHCPServer) Stats() DHCPStats {
+	return DHCPStats{
+		Discovers: s.stats.discovers.Load(),
+		Requests:  s.stats.requests.Load(),
+		Informs:   s.stats.informs.Load(),
+		Declines:  s.stats.declines.Load(),
+		Releases:  s.stats.releases.Load(),
+		Offers:    s.stats.offers.Load(),
+		Acks:      s.stats.acks.Load(),
+		Naks:      s.stats.naks.Load(),
+	}
+}
+
+// classlessRoutes converts IPv4 unicast routes in the main table to classless static routes.
+// Clients ignore the router option if classless static routes are present (RFC 3442),
+// so the default route must be among `routes`.
+func classlessRoutes(routes []netlink.Route) []*dhcpv4.Route {
+	var result []*dhcpv4.Route
+	for _, route := range routes {
+		if route.Table != unix.RT_TABLE_MAIN || route.Type != unix.RTN_UNICAST || len(route.MultiPath) > 0 {
+			continue
+		}
+		dst := route.Dst
+		if dst == nil {
+			dst = &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+		}
+		if dst.IP.To4() == nil {
+			continue
+		}
+		ones, _ := dst.Mask.Size()
+		router := net.IPv4zero.To4()
+		if route.Gw != nil {
+			router = route.Gw.To4()
+		}
+		result = append(result, &dhcpv4.Route{
+			Dest:   &net.IPNet{IP: dst.IP.Mask(dst.Mask).To4(), Mask: net.CIDRMask(ones, 32)},
+			Router: router,
+		})
+	}
+	return result
+}
+
+func hasDefaultRoute(routes []*dhcpv4.Route) bool {
+	for _, route := range routes {
+		if ones, _ := route.Dest.Mask.Size(); ones == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseDHCPOption parses a raw DHCP option in the format of "$CODE:$VALUE", such as "252:http://wpad/wpad.dat".
+// VALUE is taken as bytes in hex if it's prefixed by "0x", such as "43:0x0104c0a80001", otherwise as a string.
+func ParseDHCPOption(s string) (dhcpv4.Option, error) {
+	codeStr, value, ok := strings.Cut(s, ":")
+	if !ok {
+		return dhcpv4.Option{}, errors.Errorf("bad dhcp option '%s', expect $CODE:$VALUE", s)
+	}
+	code, err := strconv.ParseUint(codeStr, 10, 8)
+	if err != nil || code == 0 || code == 255 {
+		return dhcpv4.Option{}, errors.Errorf("bad dhcp option code '%s' in '%s'", codeStr, s)
+	}
+	data := []byte(value)
+	if hexValue, ok := strings.CutPrefix(value, "0x"); ok {
+		data, err = hex.DecodeString(hexValue)
+		if err != nil {
+			return dhcpv4.Option{}, errors.WithMessagef(err, "bad hex value of dhcp option '%s'", s)
+		}
+	}
+	return dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(code), data), nil
+}
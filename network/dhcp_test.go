@@ -1,13 +1,20 @@
 package network
 
 import (
+	"context"
+	"github.com/cox96de/containervm/util"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv4/client4"
 	"github.com/insomniacslk/dhcp/interfaces"
 	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
 	"net"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -23,19 +30,21 @@ func TestNewDHCPServerFromAddr(t *testing.T) {
 	nic := link[0]
 	ip := net.ParseIP("192.168.1.3")
 	gwIP := net.ParseIP("192.168.1.1")
+	dhcpServer, err := NewDHCPServerFromAddr(&DHCPOption{
+		IP: &net.IPAddr{
+			IP: ip,
+		},
+		HardwareAddr:  nic.HardwareAddr,
+		GatewayIP:     gwIP,
+		DNSServers:    []net.IP{},
+		SearchDomains: []string{},
+	})
+	assert.NilError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := make(chan error, 1)
 	go func() {
-		dhcpServer, err := NewDHCPServerFromAddr(&DHCPOption{
-			IP: &net.IPAddr{
-				IP: ip,
-			},
-			HardwareAddr:  nic.HardwareAddr,
-			GatewayIP:     gwIP,
-			DNSServers:    []net.IP{},
-			SearchDomains: []string{},
-		})
-		assert.NilError(t, err)
-		err = dhcpServer.Run(nic.Name)
-		assert.NilError(t, err)
+		runErr <- dhcpServer.Run(ctx, nic.Name)
 	}()
 	// Wait for server to start
 	time.Sleep(time.Millisecond * 50)
@@ -46,4 +55,259 @@ func TestNewDHCPServerFromAddr(t *testing.T) {
 	t.Logf("%+v", exchange)
 	assert.Assert(t, exchange[1].YourIPAddr.Equal(ip))
 	assert.Assert(t, net.IP(exchange[1].Options.Get(dhcpv4.OptionRouter)).Equal(gwIP))
+	cancel()
+	select {
+	case err = <-runErr:
+		assert.NilError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("dhcp server is not stopped")
+	}
+}
+
+func TestClasslessRoutes(t *testing.T) {
+	_, onLink, _ := net.ParseCIDR("169.254.1.1/32")
+	_, local, _ := net.ParseCIDR("10.0.0.1/32")
+	_, v6, _ := net.ParseCIDR("fe80::/64")
+	gwIP := net.ParseIP("169.254.1.1")
+	s, err := NewDHCPServerFromAddr(&DHCPOption{
+		IP:        &net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(32, 32)},
+		GatewayIP: gwIP,
+		Routes: []netlink.Route{
+			{Dst: onLink, Scope: netlink.SCOPE_LINK, Table: unix.RT_TABLE_MAIN, Type: unix.RTN_UNICAST},
+			{Dst: local, Table: unix.RT_TABLE_LOCAL, Type: unix.RTN_LOCAL},
+			{Dst: v6, Table: unix.RT_TABLE_MAIN, Type: unix.RTN_UNICAST},
+		},
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, s.routes, []*dhcpv4.Route{
+		{Dest: &net.IPNet{IP: net.ParseIP("169.254.1.1").To4(), Mask: net.CIDRMask(32, 32)}, Router: net.IPv4zero.To4()},
+		// The default route is added, as clients ignore the router option.
+		{Dest: &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}, Router: gwIP.To4()},
+	})
+	request, err := dhcpv4.NewDiscovery(net.HardwareAddr{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc})
+	assert.NilError(t, err)
+	reply, err := s.composeReply(request, dhcpv4.MessageTypeOffer)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, reply.ClasslessStaticRoute(), s.routes)
+	assert.DeepEqual(t, reply.Options.Get(optionMSClasslessStaticRoute),
+		reply.Options.Get(dhcpv4.OptionClasslessStaticRoute))
+}
+
+func TestComposeReplyWithoutRouter(t *testing.T) {
+	hw, _ := net.ParseMAC("02:42:ac:12:00:02")
+	s, err := NewDHCPServerFromAddr(&DHCPOption{
+		IP:           &net.IPNet{IP: net.ParseIP("172.18.0.2"), Mask: net.CIDRMask(16, 32)},
+		HardwareAddr: hw,
+	})
+	assert.NilError(t, err)
+	discover, err := dhcpv4.NewDiscovery(hw)
+	assert.NilError(t, err)
+	offer, err := s.composeReply(discover, dhcpv4.MessageTypeOffer)
+	assert.NilError(t, err)
+	assert.Assert(t, offer.YourIPAddr.Equal(net.ParseIP("172.18.0.2")))
+	assert.Assert(t, offer.ServerIdentifier().Equal(serviceAddr))
+	assert.Assert(t, offer.Options.Get(dhcpv4.OptionRouter) == nil)
+}
+
+func TestComposeReplyOptions(t *testing.T) {
+	hw, _ := net.ParseMAC("02:42:ac:12:00:02")
+	wpad := dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(252), []byte("http://wpad/wpad.dat"))
+	s, err := NewDHCPServerFromAddr(&DHCPOption{
+		IP:            &net.IPNet{IP: net.ParseIP("172.18.0.2"), Mask: net.CIDRMask(16, 32)},
+		HardwareAddr:  hw,
+		GatewayIP:     net.ParseIP("172.18.0.1"),
+		MTU:           1450,
+		NTPServers:    []net.IP{net.ParseIP("10.0.0.123").To4()},
+		DomainName:    "example.com",
+		LeaseTime:     time.Hour,
+		RenewalTime:   time.Minute * 30,
+		RebindingTime: time.Minute * 50,
+		// Overrides the hostname.
+		Options: []dhcpv4.Option{wpad, dhcpv4.OptHostName("vm")},
+	})
+	assert.NilError(t, err)
+	discover, err := dhcpv4.NewDiscovery(hw)
+	assert.NilError(t, err)
+	offer, err := s.composeReply(discover, dhcpv4.MessageTypeOffer)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, offer.Options.Get(dhcpv4.OptionInterfaceMTU), []byte{0x05, 0xaa})
+	assert.DeepEqual(t, offer.NTPServers(), []net.IP{net.ParseIP("10.0.0.123").To4()})
+	assert.Equal(t, offer.DomainName(), "example.com")
+	assert.Equal(t, offer.IPAddressLeaseTime(0), time.Hour)
+	assert.Equal(t, offer.IPAddressRenewalTime(0), time.Minute*30)
+	assert.Equal(t, offer.IPAddressRebindingTime(0), time.Minute*50)
+	assert.DeepEqual(t, offer.Options.Get(wpad.Code), []byte("http://wpad/wpad.dat"))
+	assert.Equal(t, offer.HostName(), "vm")
+
+	_, err = NewDHCPServerFromAddr(&DHCPOption{
+		IP:           &net.IPNet{IP: net.ParseIP("172.18.0.2"), Mask: net.CIDRMask(16, 32)},
+		HardwareAddr: hw,
+		MTU:          10,
+	})
+	assert.ErrorContains(t, err, "bad mtu")
+}
+
+func TestComposeReplyPXE(t *testing.T) {
+	hw, _ := net.ParseMAC("02:42:ac:12:00:02")
+	bootServer := net.ParseIP("172.18.255.254").To4()
+	s, err := NewDHCPServerFromAddr(&DHCPOption{
+		IP:           &net.IPNet{IP: net.ParseIP("172.18.0.2"), Mask: net.CIDRMask(16, 32)},
+		HardwareAddr: hw,
+		GatewayIP:    net.ParseIP("172.18.0.1"),
+		BootServer:   bootServer,
+		BootFile:     "undionly.kpxe",
+		IPXEScript:   "http://172.18.0.10/boot.ipxe",
+	})
+	assert.NilError(t, err)
+	discover, err := dhcpv4.NewDiscovery(hw, dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient:Arch:00000")))
+	assert.NilError(t, err)
+	offer, err := s.composeReply(discover, dhcpv4.MessageTypeOffer)
+	assert.NilError(t, err)
+	assert.Assert(t, offer.ServerIPAddr.Equal(bootServer))
+	assert.Assert(t, offer.ServerIdentifier().Equal(net.ParseIP("172.18.0.1")))
+	assert.Equal(t, offer.TFTPServerName(), "172.18.255.254")
+	assert.Equal(t, offer.BootFileName, "undionly.kpxe")
+	assert.Equal(t, offer.BootFileNameOption(), "undionly.kpxe")
+
+	// iPXE asks again for the script.
+	discover, err = dhcpv4.NewDiscovery(hw, dhcpv4.WithUserClass("iPXE", false))
+	assert.NilError(t, err)
+	offer, err = s.composeReply(discover, dhcpv4.MessageTypeOffer)
+	assert.NilError(t, err)
+	assert.Equal(t, offer.BootFileName, "http://172.18.0.10/boot.ipxe")
+	assert.Equal(t, offer.BootFileNameOption(), "http://172.18.0.10/boot.ipxe")
+}
+
+func TestParseDHCPOption(t *testing.T) {
+	opt, err := ParseDHCPOption("252:http://wpad/wpad.dat")
+	assert.NilError(t, err)
+	assert.Equal(t, opt.Code.Code(), uint8(252))
+	assert.DeepEqual(t, opt.Value.ToBytes(), []byte("http://wpad/wpad.dat"))
+	opt, err = ParseDHCPOption("43:0x0104c0a80001")
+	assert.NilError(t, err)
+	assert.Equal(t, opt.Code.Code(), uint8(43))
+	assert.DeepEqual(t, opt.Value.ToBytes(), []byte{0x01, 0x04, 0xc0, 0xa8, 0x00, 0x01})
+	for _, s := range []string{"252", "abc:1", "0:1", "255:1", "256:1", "43:0xzz"} {
+		_, err = ParseDHCPOption(s)
+		assert.Assert(t, err != nil, s)
+	}
+}
+
+func TestDHCPServerMessages(t *testing.T) {
+	clientIface := "vethd40"
+	serverIface := "vethd41"
+	hw, _ := net.ParseMAC("12:34:56:78:9a:40")
+	setupVethPair(t, clientIface, serverIface, hw.String())
+	output, err := util.Run("ip", "addr", "add", serviceIP, "dev", serverIface)
+	assert.NilError(t, err, output)
+	// The kernel fills the source of packets from client4 with a local address, accept them.
+	err = os.WriteFile(filepath.Join("/proc/sys/net/ipv4/conf", serverIface, "accept_local"), []byte("1"), 0o644)
+	assert.NilError(t, err)
+	ip := net.ParseIP("192.168.40.3").To4()
+	foreignIP := net.ParseIP("192.168.40.4").To4()
+	gwIP := net.ParseIP("192.168.40.1").To4()
+	var leases atomic.Int32
+	s, err := NewDHCPServerFromAddr(&DHCPOption{
+		IP:           &net.IPNet{IP: ip, Mask: net.CIDRMask(24, 32)},
+		HardwareAddr: hw,
+		GatewayIP:    gwIP,
+		OnLease: func(leased net.IP) {
+			assert.Check(t, leased.Equal(ip))
+			leases.Add(1)
+		},
+	})
+	assert.NilError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		_ = s.Run(ctx, serverIface)
+	}()
+	// Wait for server to start
+	time.Sleep(time.Millisecond * 50)
+	cli := client4.NewClient()
+	cli.ReadTimeout = time.Millisecond * 500
+	var sockets []int
+	defer func() {
+		for _, fd := range sockets {
+			_ = unix.Close(fd)
+		}
+	}()
+
+	for _, c := range []struct {
+		name    string
+		msgType dhcpv4.MessageType
+		mods    []dhcpv4.Modifier
+		// replyType is the type of the reply, MessageTypeNone means no reply.
+		replyType dhcpv4.MessageType
+		yourIP    net.IP
+	}{
+		{name: "discover", msgType: dhcpv4.MessageTypeDiscover, replyType: dhcpv4.MessageTypeOffer, yourIP: ip},
+		{name: "select", msgType: dhcpv4.MessageTypeRequest, mods: []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(gwIP)),
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)),
+		}, replyType: dhcpv4.MessageTypeAck, yourIP: ip},
+		{name: "select another server", msgType: dhcpv4.MessageTypeRequest, mods: []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.ParseIP("192.168.40.2"))),
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(foreignIP)),
+		}, replyType: dhcpv4.MessageTypeNone},
+		{name: "init-reboot foreign", msgType: dhcpv4.MessageTypeRequest, mods: []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(foreignIP)),
+		}, replyType: dhcpv4.MessageTypeNak, yourIP: net.IPv4zero},
+		{name: "renew", msgType: dhcpv4.MessageTypeRequest, mods: []dhcpv4.Modifier{
+			dhcpv4.WithClientIP(ip),
+		}, replyType: dhcpv4.MessageTypeAck, yourIP: ip},
+		{name: "renew foreign", msgType: dhcpv4.MessageTypeRequest, mods: []dhcpv4.Modifier{
+			dhcpv4.WithClientIP(foreignIP),
+		}, replyType: dhcpv4.MessageTypeNak, yourIP: net.IPv4zero},
+		{name: "inform", msgType: dhcpv4.MessageTypeInform, mods: []dhcpv4.Modifier{
+			dhcpv4.WithClientIP(ip),
+		}, replyType: dhcpv4.MessageTypeAck, yourIP: net.IPv4zero},
+		{name: "decline", msgType: dhcpv4.MessageTypeDecline, mods: []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(gwIP)),
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)),
+		}, replyType: dhcpv4.MessageTypeNone},
+		{name: "release", msgType: dhcpv4.MessageTypeRelease, mods: []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(gwIP)),
+			dhcpv4.WithClientIP(ip),
+		}, replyType: dhcpv4.MessageTypeNone},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			msg, err := dhcpv4.New(append([]dhcpv4.Modifier{
+				dhcpv4.WithHwAddr(hw),
+				dhcpv4.WithMessageType(c.msgType),
+			}, c.mods...)...)
+			assert.NilError(t, err)
+			// A timed out receive leaves a reader on the socket, use new sockets for each message.
+			// They are closed after all messages, otherwise the reader would read a new socket reusing the fd.
+			sendFd, err := client4.MakeBroadcastSocket(clientIface)
+			assert.NilError(t, err)
+			sockets = append(sockets, sendFd)
+			recvFd, err := client4.MakeListeningSocket(clientIface)
+			assert.NilError(t, err)
+			sockets = append(sockets, recvFd)
+			reply, err := cli.SendReceive(sendFd, recvFd, msg, dhcpv4.MessageTypeNone)
+			if c.replyType == dhcpv4.MessageTypeNone {
+				assert.ErrorContains(t, err, "timed out")
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, reply.MessageType(), c.replyType)
+			assert.Assert(t, reply.YourIPAddr.Equal(c.yourIP), reply.YourIPAddr)
+			assert.Assert(t, reply.ServerIdentifier().Equal(gwIP))
+			if c.msgType == dhcpv4.MessageTypeInform {
+				assert.Equal(t, reply.IPAddressLeaseTime(0), time.Duration(0))
+				assert.Assert(t, reply.Router()[0].Equal(gwIP))
+			}
+		})
+	}
+	poll.WaitOn(t, func(t poll.LogT) poll.Result {
+		if s.Stats().Acks != 3 {
+			return poll.Continue("replies are not counted")
+		}
+		return poll.Success()
+	})
+	assert.DeepEqual(t, s.Stats(), DHCPStats{Discovers: 1, Requests: 5, Informs: 1, Declines: 1, Releases: 1,
+		Offers: 1, Acks: 3, Naks: 2})
+	// Renewals and informs are not leases.
+	assert.Equal(t, leases.Load(), int32(1))
 }
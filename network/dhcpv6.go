@@ -0,0 +1,186 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	dhcpv6ClientPort = 546
+	dhcpv6ServerPort = 547
+	// dhcpv6InfiniteLifetime is the infinite lifetime of addresses (RFC 8415 7.7).
+	dhcpv6InfiniteLifetime = time.Duration(0xffffffff) * time.Second
+)
+
+type DHCPv6Option struct {
+	// Only response dhcpv6 request from HardwareAddr.
+	HardwareAddr net.HardwareAddr
+	// Return that IP in dhcpv6 response.
+	IP net.IP
+	// Return DNSServers in dhcpv6 response. IPv4 servers are ignored.
+	DNSServers []net.IP
+	// Return SearchDomains in dhcpv6 response.
+	SearchDomains []string
+	// OnLease is called with IP once the client gets it by a request, but not on renewals. It must not block.
+	OnLease func(ip net.IP)
+}
+
+// NewDHCPv6Server creates a DHCPv6Server to distribute `opt.IP`.
+func NewDHCPv6Server(opt *DHCPv6Option) (*DHCPv6Server, error) {
+	if opt.IP.To16() == nil || opt.IP.To4() != nil {
+		return nil, errors.Errorf("%v is not an ipv6 address", opt.IP)
+	}
+	var dnsServers []net.IP
+	for _, ip := range opt.DNSServers {
+		if ip.To4() == nil && ip.To16() != nil {
+			dnsServers = append(dnsServers, ip)
+		}
+	}
+	return &DHCPv6Server{
+		clientIP:     opt.IP,
+		clientHwAddr: opt.HardwareAddr,
+		dnsServers:   dnsServers,
+		domains:      opt.SearchDomains,
+		onLease:      opt.OnLease,
+	}, nil
+}
+
+// DHCPv6Server is a simplified stateful DHCPv6 server that only provides a single IP address.
+// It listens on the macvlan NIC at the link layer, so that it only answers packets sent from the vm's MAC,
+// no matter what DUID or link-local address the vm uses.
+type DHCPv6Server struct {
+	clientIP     net.IP
+	clientHwAddr net.HardwareAddr
+	dnsServers   []net.IP
+	domains      []string
+	serverID     dhcpv6.DUID
+	onLease      func(ip net.IP)
+}
+
+// Run starts the server on the interface `ifName`. It stops when ctx is done, or returns ErrInterfaceGone when the
+// interface is deleted.
+func (s *DHCPv6Server) Run(ctx context.Context, ifName string) error {
+	conn, err := dialIPv6(ifName)
+	if err != nil {
+		return errors.WithMessage(err, "failed to initialize server")
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+	s.serverID = &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: conn.iface.HardwareAddr}
+	serverIP := linkLocalAddr(conn.iface.HardwareAddr)
+	log.Infof("dhcpv6 server runs on %s", ifName)
+	log.Debugf("client ip: %v", s.clientIP)
+	log.Debugf("client hardware addr: %v", s.clientHwAddr)
+	log.Debugf("dns servers: %+v", s.dnsServers)
+	log.Debugf("search domains: %+v", s.domains)
+	guard := newReadGuard(ctx, conn.iface)
+	for {
+		_ = conn.SetReadDeadline(guard.deadline())
+		header, payload, srcHardwareAddr, err := conn.Read()
+		if err != nil {
+			if stop, err := guard.failed(err); stop {
+				return err
+			}
+			continue
+		}
+		guard.succeeded()
+		if header.NextHeader != protocolUDP {
+			continue
+		}
+		_, dstPort, udpPayload, err := parseUDP(payload)
+		if err != nil || dstPort != dhcpv6ServerPort {
+			continue
+		}
+		if !bytes.Equal(s.clientHwAddr, srcHardwareAddr) {
+			log.Debugf("ignoring a dhcpv6 packet from unexpected source, expect '%s', got '%s'",
+				s.clientHwAddr.String(), srcHardwareAddr.String())
+			continue
+		}
+		msg, err := dhcpv6.MessageFromBytes(udpPayload)
+		if err != nil {
+			log.Debugf("failed to parse dhcpv6 message: %+v", err)
+			continue
+		}
+		replyMsg, err := s.handle(msg)
+		if err != nil {
+			log.Errorf("failed to build reply for %s: %+v", msg.Type(), err)
+			continue
+		}
+		if replyMsg == nil {
+			continue
+		}
+		log.Debugf("sending %s: %s", replyMsg.Type(), replyMsg.Summary())
+		reply := marshalUDP(serverIP, header.Src, dhcpv6ServerPort, dhcpv6ClientPort, replyMsg.ToBytes())
+		if err = conn.Write(srcHardwareAddr, serverIP, header.Src, protocolUDP, 64, reply); err != nil {
+			log.Errorf("failed to send reply: %+v", err)
+			continue
+		}
+		// A solicit is answered by a reply with rapid commit.
+		leased := msg.Type() == dhcpv6.MessageTypeRequest || msg.Type() == dhcpv6.MessageTypeSolicit
+		if replyMsg.Type() == dhcpv6.MessageTypeReply && leased && s.onLease != nil {
+			s.onLease(s.clientIP)
+		}
+	}
+}
+
+// handle returns the reply to `msg`, or nil if `msg` should be ignored.
+func (s *DHCPv6Server) handle(msg *dhcpv6.Message) (*dhcpv6.Message, error) {
+	log.Debugf("get msg: %s", msg.Summary())
+	if serverID := msg.Options.ServerID(); serverID != nil && !serverID.Equal(s.serverID) {
+		log.Debugf("ignoring message to another server %s", serverID)
+		return nil, nil
+	}
+	switch msg.Type() {
+	case dhcpv6.MessageTypeSolicit:
+		if msg.GetOneOption(dhcpv6.OptionRapidCommit) != nil {
+			return dhcpv6.NewReplyFromMessage(msg, s.modifiers(msg, true)...)
+		}
+		return dhcpv6.NewAdvertiseFromSolicit(msg, s.modifiers(msg, true)...)
+	case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind:
+		return dhcpv6.NewReplyFromMessage(msg, s.modifiers(msg, true)...)
+	case dhcpv6.MessageTypeInformationRequest:
+		return dhcpv6.NewReplyFromMessage(msg, s.modifiers(msg, false)...)
+	case dhcpv6.MessageTypeConfirm, dhcpv6.MessageTypeRelease:
+		return dhcpv6.NewReplyFromMessage(msg, dhcpv6.WithServerID(s.serverID),
+			dhcpv6.WithOption(&dhcpv6.OptStatusCode{StatusCode: iana.StatusSuccess}))
+	default:
+		// Get an unrelated message. Just ignore.
+		log.Debugf("ignoring message: %s", msg.Summary())
+		return nil, nil
+	}
+}
+
+// modifiers returns the options of a reply to `msg`. The address is included if `withAddress`.
+func (s *DHCPv6Server) modifiers(msg *dhcpv6.Message, withAddress bool) []dhcpv6.Modifier {
+	modifiers := []dhcpv6.Modifier{dhcpv6.WithServerID(s.serverID)}
+	if withAddress {
+		iaNA := &dhcpv6.OptIANA{}
+		if requested := msg.Options.OneIANA(); requested != nil {
+			iaNA.IaId = requested.IaId
+		}
+		iaNA.Options.Add(&dhcpv6.OptIAAddress{
+			IPv6Addr:          s.clientIP,
+			PreferredLifetime: dhcpv6InfiniteLifetime,
+			ValidLifetime:     dhcpv6InfiniteLifetime,
+		})
+		modifiers = append(modifiers, dhcpv6.WithOption(iaNA))
+	}
+	// Windows DHCP client doesn't accept empty options.
+	if len(s.dnsServers) > 0 {
+		modifiers = append(modifiers, dhcpv6.WithDNS(s.dnsServers...))
+	}
+	if len(s.domains) > 0 {
+		modifiers = append(modifiers, dhcpv6.WithDomainSearchList(s.domains...))
+	}
+	return modifiers
+}
@@ -0,0 +1,89 @@
+package network
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cox96de/containervm/util"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/client6"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+)
+
+// setupVethPair creates a veth pair, and waits until link-local addresses of both ends are usable.
+func setupVethPair(t *testing.T, clientIface, serverIface, clientMac string) {
+	clean := func() {
+		_, _ = util.Run("ip", "link", "del", clientIface)
+	}
+	clean()
+	t.Cleanup(clean)
+	output, err := util.Run("ip", "link", "add", clientIface, "address", clientMac, "type", "veth",
+		"peer", "name", serverIface)
+	assert.NilError(t, err, output)
+	output, err = util.Run("ip", "link", "set", clientIface, "up")
+	assert.NilError(t, err, output)
+	output, err = util.Run("ip", "link", "set", serverIface, "up")
+	assert.NilError(t, err, output)
+	poll.WaitOn(t, func(t poll.LogT) poll.Result {
+		output, err := util.Run("ip", "-6", "addr", "show", "dev", clientIface, "scope", "link", "-tentative")
+		if err != nil || len(output) == 0 {
+			return poll.Continue("link-local address of %s is not ready", clientIface)
+		}
+		return poll.Success()
+	}, poll.WithTimeout(time.Second*5), poll.WithDelay(time.Millisecond*100))
+}
+
+func TestDHCPv6Server(t *testing.T) {
+	clientIface := "vethd60"
+	serverIface := "vethd61"
+	setupVethPair(t, clientIface, serverIface, "12:34:56:78:9a:bc")
+	ip := net.ParseIP("2001:db8::3")
+	dns := net.ParseIP("2001:db8::53")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		hw, _ := net.ParseMAC("12:34:56:78:9a:bc")
+		s, err := NewDHCPv6Server(&DHCPv6Option{
+			HardwareAddr:  hw,
+			IP:            ip,
+			DNSServers:    []net.IP{net.ParseIP("8.8.8.8"), dns},
+			SearchDomains: []string{"example.com"},
+		})
+		assert.NilError(t, err)
+		_ = s.Run(ctx, serverIface)
+	}()
+	// Wait for server to start
+	time.Sleep(time.Millisecond * 50)
+	cli := client6.NewClient()
+	cli.ReadTimeout = time.Second * 3
+	exchange, err := cli.Exchange(clientIface)
+	assert.NilError(t, err)
+	assert.Equal(t, len(exchange), 4)
+	reply := exchange[3].(*dhcpv6.Message)
+	assert.Equal(t, reply.Type(), dhcpv6.MessageTypeReply)
+	iaNA := reply.Options.OneIANA()
+	assert.Assert(t, iaNA != nil)
+	assert.Assert(t, iaNA.Options.OneAddress().IPv6Addr.Equal(ip))
+	assert.DeepEqual(t, reply.Options.DNS(), []net.IP{dns})
+	assert.DeepEqual(t, reply.Options.DomainSearchList().Labels, []string{"example.com"})
+}
+
+func TestDHCPv6ServerIgnoreOtherServer(t *testing.T) {
+	hw, _ := net.ParseMAC("12:34:56:78:9a:bc")
+	s, err := NewDHCPv6Server(&DHCPv6Option{HardwareAddr: hw, IP: net.ParseIP("2001:db8::3")})
+	assert.NilError(t, err)
+	s.serverID = &dhcpv6.DUIDLL{HWType: 1, LinkLayerAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}}
+	request, err := dhcpv6.NewMessage(dhcpv6.WithClientID(&dhcpv6.DUIDLL{HWType: 1, LinkLayerAddr: hw}),
+		dhcpv6.WithServerID(&dhcpv6.DUIDLL{HWType: 1, LinkLayerAddr: net.HardwareAddr{2, 0, 0, 0, 0, 2}}))
+	assert.NilError(t, err)
+	request.MessageType = dhcpv6.MessageTypeRequest
+	reply, err := s.handle(request)
+	assert.NilError(t, err)
+	assert.Assert(t, reply == nil)
+
+	_, err = NewDHCPv6Server(&DHCPv6Option{HardwareAddr: hw, IP: net.ParseIP("192.168.1.3")})
+	assert.ErrorContains(t, err, "not an ipv6 address")
+}
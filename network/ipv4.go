@@ -0,0 +1,89 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/mdlayher/packet"
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+)
+
+const etherTypeIPv4 = 0x0800
+
+// ipv4Conn is the IPv4 counterpart of ipv6Conn. Servers on it don't need any address on the interface, so they
+// can pretend to be any host in the subnet of the vm.
+type ipv4Conn struct {
+	conn  *packet.Conn
+	iface *net.Interface
+	buf   []byte
+}
+
+func dialIPv4(ifName string) (*ipv4Conn, error) {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to get interface %s", ifName)
+	}
+	conn, err := packet.Listen(iface, packet.Datagram, etherTypeIPv4, nil)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to listen to ipv4 at %s", ifName)
+	}
+	return &ipv4Conn{conn: conn, iface: iface, buf: make([]byte, 65536)}, nil
+}
+
+// Read reads an IPv4 packet which is not fragmented.
+// The payload is valid until the next Read.
+func (c *ipv4Conn) Read() (header *ipv4.Header, payload []byte, srcHardwareAddr net.HardwareAddr, err error) {
+	for {
+		n, addr, err := c.conn.ReadFrom(c.buf)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		header, err := ipv4.ParseHeader(c.buf[:n])
+		if err != nil || header.Version != ipv4.Version || header.TotalLen > n || header.TotalLen < header.Len {
+			continue
+		}
+		if header.Flags&ipv4.MoreFragments != 0 || header.FragOff != 0 {
+			continue
+		}
+		return header, c.buf[header.Len:header.TotalLen], addr.(*packet.Addr).HardwareAddr, nil
+	}
+}
+
+// Write sends `payload` from `src` to `dst` whose hardware address is `dstHardwareAddr`.
+func (c *ipv4Conn) Write(dstHardwareAddr net.HardwareAddr, src, dst net.IP, protocol, ttl int,
+	payload []byte) error {
+	b := make([]byte, ipv4.HeaderLen+len(payload))
+	b[0] = ipv4.Version<<4 | ipv4.HeaderLen/4
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	binary.BigEndian.PutUint16(b[6:8], uint16(ipv4.DontFragment)<<13)
+	b[8] = byte(ttl)
+	b[9] = byte(protocol)
+	copy(b[12:16], src.To4())
+	copy(b[16:20], dst.To4())
+	binary.BigEndian.PutUint16(b[10:12], headerChecksum(b[:ipv4.HeaderLen]))
+	copy(b[ipv4.HeaderLen:], payload)
+	_, err := c.conn.WriteTo(b, &packet.Addr{HardwareAddr: dstHardwareAddr})
+	return err
+}
+
+func (c *ipv4Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *ipv4Conn) Close() error {
+	return c.conn.Close()
+}
+
+// headerChecksum computes the checksum of IPv4 header `b` whose checksum field is zero (RFC 791).
+func headerChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
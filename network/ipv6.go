@@ -0,0 +1,160 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/mdlayher/packet"
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	etherTypeIPv6 = 0x86dd
+
+	protocolUDP    = 17
+	protocolICMPv6 = 58
+)
+
+// ipv6Conn sends and receives IPv6 packets at the link layer of an interface.
+// Unlike an IP socket, the source hardware address of every packet is known, so that packets from the vm
+// can be identified. Packets sent are not restricted to addresses of the interface either.
+type ipv6Conn struct {
+	conn  *packet.Conn
+	iface *net.Interface
+	buf   []byte
+}
+
+func dialIPv6(ifName string) (*ipv6Conn, error) {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to get interface %s", ifName)
+	}
+	conn, err := packet.Listen(iface, packet.Datagram, etherTypeIPv6, nil)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to listen to ipv6 at %s", ifName)
+	}
+	return &ipv6Conn{conn: conn, iface: iface, buf: make([]byte, 65536)}, nil
+}
+
+// Read reads an IPv6 packet without extension headers.
+// The payload is valid until the next Read.
+func (c *ipv6Conn) Read() (header *ipv6.Header, payload []byte, srcHardwareAddr net.HardwareAddr, err error) {
+	for {
+		n, addr, err := c.conn.ReadFrom(c.buf)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		header, err := ipv6.ParseHeader(c.buf[:n])
+		if err != nil || header.Version != ipv6.Version || ipv6.HeaderLen+header.PayloadLen > n {
+			continue
+		}
+		return header, c.buf[ipv6.HeaderLen : ipv6.HeaderLen+header.PayloadLen], addr.(*packet.Addr).HardwareAddr, nil
+	}
+}
+
+// Write sends `payload` from `src` to `dst` whose hardware address is `dstHardwareAddr`.
+func (c *ipv6Conn) Write(dstHardwareAddr net.HardwareAddr, src, dst net.IP, nextHeader, hopLimit int,
+	payload []byte) error {
+	_, err := c.conn.WriteTo(marshalIPv6(src, dst, nextHeader, hopLimit, payload),
+		&packet.Addr{HardwareAddr: dstHardwareAddr})
+	return err
+}
+
+func (c *ipv6Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *ipv6Conn) Close() error {
+	return c.conn.Close()
+}
+
+// marshalIPv6 builds an IPv6 packet without extension headers.
+func marshalIPv6(src, dst net.IP, nextHeader, hopLimit int, payload []byte) []byte {
+	b := make([]byte, ipv6.HeaderLen+len(payload))
+	b[0] = ipv6.Version << 4
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(payload)))
+	b[6] = byte(nextHeader)
+	b[7] = byte(hopLimit)
+	copy(b[8:24], src.To16())
+	copy(b[24:40], dst.To16())
+	copy(b[ipv6.HeaderLen:], payload)
+	return b
+}
+
+// marshalUDP builds an UDP datagram with checksum.
+func marshalUDP(src, dst net.IP, srcPort, dstPort int, payload []byte) []byte {
+	b := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(b[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(b[2:4], uint16(dstPort))
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(b)))
+	copy(b[8:], payload)
+	checksum := pseudoHeaderChecksum(src, dst, protocolUDP, b)
+	if checksum == 0 {
+		// Zero means no checksum, which is not allowed in IPv6.
+		checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(b[6:8], checksum)
+	return b
+}
+
+// parseUDP parses an UDP datagram. The checksum is not verified.
+func parseUDP(b []byte) (srcPort, dstPort int, payload []byte, err error) {
+	if len(b) < 8 {
+		return 0, 0, nil, errors.New("udp datagram is too short")
+	}
+	length := int(binary.BigEndian.Uint16(b[4:6]))
+	if length < 8 || length > len(b) {
+		return 0, 0, nil, errors.Errorf("bad udp length %d", length)
+	}
+	return int(binary.BigEndian.Uint16(b[0:2])), int(binary.BigEndian.Uint16(b[2:4])), b[8:length], nil
+}
+
+// pseudoHeaderChecksum computes the checksum of upper-layer `payload` with the IPv6 pseudo-header
+// (RFC 8200 8.1), or the IPv4 one (RFC 768) if `src` is an IPv4 address.
+func pseudoHeaderChecksum(src, dst net.IP, nextHeader int, payload []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	if src.To4() != nil {
+		add(src.To4())
+		add(dst.To4())
+	} else {
+		add(src.To16())
+		add(dst.To16())
+	}
+	// The length is 16 bits in the IPv4 pseudo-header, and its upper 16 bits are zero anyway.
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(payload)))
+	add(length[:])
+	sum += uint32(nextHeader)
+	add(payload)
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// linkLocalAddr returns the EUI-64 based link-local address of `hardwareAddr`.
+func linkLocalAddr(hardwareAddr net.HardwareAddr) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	ip[0], ip[1] = 0xfe, 0x80
+	copy(ip[8:11], hardwareAddr[0:3])
+	ip[8] ^= 0x02
+	ip[11], ip[12] = 0xff, 0xfe
+	copy(ip[13:16], hardwareAddr[3:6])
+	return ip
+}
+
+// multicastHardwareAddr returns the hardware address of IPv6 multicast address `ip` (RFC 2464 7).
+func multicastHardwareAddr(ip net.IP) net.HardwareAddr {
+	ip = ip.To16()
+	return net.HardwareAddr{0x33, 0x33, ip[12], ip[13], ip[14], ip[15]}
+}
@@ -0,0 +1,201 @@
+package network
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/cox96de/containervm/util"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// IPVtapConfigure is the ipvtap Backend. The VM gets an ipvtap device upon the NIC in L2 mode, and servers for
+// the VM run on an ipvlan device upon the NIC. All ipvlan devices share the MAC of the NIC, so the NIC keeps its
+// original MAC and every frame on the wire carries it. It works on CNIs which drop frames from foreign MACs,
+// such as AWS VPC CNI and Azure CNI.
+type IPVtapConfigure struct {
+	nicSnapshot
+	tapName string
+	lanName string
+
+	tapDevicePath string
+}
+
+// NewIPVtapConfigure creates an ipvtap Backend for `defaultNIC`.
+// `tapName` and `lanName` are names of the ipvtap device and the ipvlan device.
+func NewIPVtapConfigure(defaultNIC string, tapName string, lanName string) *IPVtapConfigure {
+	return &IPVtapConfigure{
+		nicSnapshot:   nicSnapshot{defaultNIC: defaultNIC},
+		tapName:       tapName,
+		lanName:       lanName,
+		tapDevicePath: filepath.Join("/dev", tapName),
+	}
+}
+
+// Setup implements Backend.
+func (b *IPVtapConfigure) Setup() error {
+	nicName := b.defaultNIC
+	link, err := netlink.LinkByName(nicName)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to get link by name %s", nicName)
+	}
+	if err = b.snapshot(link); err != nil {
+		return err
+	}
+	if err = b.writeJournal(b.state()); err != nil {
+		return err
+	}
+	log.Infof("creating ipvtap device %s upon nic %s", b.tapName, nicName)
+	// Identical to `ip link add link nicName name tapName type ipvtap mode l2`.
+	if err = addIPVlan("ipvtap", link, b.tapName); err != nil {
+		return errors.WithMessagef(err, "failed to create ipvtap device %s", b.tapName)
+	}
+	tap, err := netlink.LinkByName(b.tapName)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to get ipvtap link by name %s", b.tapName)
+	}
+	// The link-local address of the NIC is moved to the ipvtap device, don't generate another one.
+	if err = setIPv6Conf(b.tapName, "addr_gen_mode", "1"); err != nil {
+		return err
+	}
+	if err = netlink.LinkSetUp(tap); err != nil {
+		return errors.WithMessagef(err, "failed to bring up ipvtap %s", b.tapName)
+	}
+	major, minor, err := getTapDeviceNum(b.tapName)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to get tap device number")
+	}
+	if output, err := util.Run("mknod", b.tapDevicePath, "c", major, minor); err != nil {
+		return errors.WithMessagef(err, "failed to create dev file: %s", output)
+	}
+	log.Infof("creating ipvlan device %s upon nic %s", b.lanName, nicName)
+	// Identical to `ip link add link nicName name lanName type ipvlan mode l2`.
+	if err = addIPVlan("ipvlan", link, b.lanName); err != nil {
+		return errors.WithMessagef(err, "failed to create ipvlan device %s", b.lanName)
+	}
+	lan, err := netlink.LinkByName(b.lanName)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to get ipvlan link by name %s", b.lanName)
+	}
+	// The ipvlan device has the same MAC as the VM, its link-local address would conflict with the VM's.
+	if err = setIPv6Conf(b.lanName, "disable_ipv6", "1"); err != nil {
+		return err
+	}
+	if err = netlink.LinkSetUp(lan); err != nil {
+		return errors.WithMessagef(err, "failed to bring up ipvlan %s", b.lanName)
+	}
+	addr, err := netlink.ParseAddr(serviceIP)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to parse ip address '%s'", serviceIP)
+	}
+	if err = netlink.AddrAdd(lan, addr); err != nil {
+		return errors.WithMessagef(err, "failed to assign ip address '%s' to ipvlan device %s", serviceIP, b.lanName)
+	}
+	if err = flushAddresses(link); err != nil {
+		return err
+	}
+	return b.moveAddresses(tap)
+}
+
+// moveAddresses assigns the addresses of the NIC to the ipvtap device `tap`.
+// ipvlan dispatches packets by the addresses of its devices, so packets to the addresses go to the VM.
+// Routes created for the addresses are removed, otherwise the pod would take packets to the VM as its own.
+func (b *IPVtapConfigure) moveAddresses(tap netlink.Link) error {
+	for _, addr := range b.addresses {
+		address, err := netlink.ParseAddr(addr.String())
+		if err != nil {
+			return errors.WithMessagef(err, "failed to parse address %s", addr.String())
+		}
+		// The VM owns the address, the duplicate address detection is up to it.
+		address.Flags = unix.IFA_F_NODAD
+		if err = netlink.AddrAdd(tap, address); err != nil {
+			return errors.WithMessagef(err, "failed to assign ip %s to ipvtap %s", addr.String(), b.tapName)
+		}
+	}
+	for _, table := range []int{unix.RT_TABLE_LOCAL, unix.RT_TABLE_MAIN} {
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL,
+			&netlink.Route{LinkIndex: tap.Attrs().Index, Table: table},
+			netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to list routes of ipvtap %s", b.tapName)
+		}
+		for _, route := range routes {
+			if err = netlink.RouteDel(&route); err != nil && !errors.Is(err, unix.ESRCH) {
+				return errors.WithMessagef(err, "failed to delete route %s of ipvtap %s", route.String(), b.tapName)
+			}
+		}
+	}
+	return nil
+}
+
+// OpenTap implements Backend. Each open of the ipvtap device file is a queue.
+func (b *IPVtapConfigure) OpenTap(queues int) ([]*os.File, error) {
+	return openTapDevice(b.tapDevicePath, queues)
+}
+
+// ServiceInterface implements Backend, it's the ipvlan device.
+func (b *IPVtapConfigure) ServiceInterface() string {
+	return b.lanName
+}
+
+// GetTapDevicePath returns the path of the device file of the ipvtap device.
+func (b *IPVtapConfigure) GetTapDevicePath() string {
+	return b.tapDevicePath
+}
+
+// Recover implements Backend.
+func (b *IPVtapConfigure) Recover() error {
+	// Addresses moved to the ipvtap device are gone along with it.
+	if err := deleteLinkIfExists(b.tapName); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(b.tapDevicePath); err != nil {
+		log.Warnf("failed to delete tap device file %s: %+v", b.tapName, err)
+	}
+	if err := deleteLinkIfExists(b.lanName); err != nil {
+		return err
+	}
+	return b.restore(nil)
+}
+
+// state returns the state to be persisted in the journal.
+func (b *IPVtapConfigure) state() *bridgeState {
+	state := b.nicSnapshot.state()
+	state.Backend = BackendIPVtap
+	state.TapName = b.tapName
+	state.LanName = b.lanName
+	state.TapDevicePath = b.tapDevicePath
+	return state
+}
+
+// addIPVlan creates an ipvlan device of `kind` ("ipvlan" or "ipvtap") named `name` upon `parent` in L2 mode.
+// netlink.IPVlan can't be used as it doesn't support ipvtap.
+func addIPVlan(kind string, parent netlink.Link, name string) error {
+	req := nl.NewNetlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK)
+	req.AddData(nl.NewIfInfomsg(unix.AF_UNSPEC))
+	req.AddData(nl.NewRtAttr(unix.IFLA_IFNAME, nl.ZeroTerminated(name)))
+	req.AddData(nl.NewRtAttr(unix.IFLA_LINK, nl.Uint32Attr(uint32(parent.Attrs().Index))))
+	req.AddData(nl.NewRtAttr(unix.IFLA_MTU, nl.Uint32Attr(uint32(parent.Attrs().MTU))))
+	linkInfo := nl.NewRtAttr(unix.IFLA_LINKINFO, nil)
+	linkInfo.AddRtAttr(nl.IFLA_INFO_KIND, nl.NonZeroTerminated(kind))
+	data := linkInfo.AddRtAttr(nl.IFLA_INFO_DATA, nil)
+	data.AddRtAttr(nl.IFLA_IPVLAN_MODE, nl.Uint16Attr(uint16(netlink.IPVLAN_MODE_L2)))
+	req.AddData(linkInfo)
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+// setIPv6Conf sets the ipv6 sysctl `key` of the interface `ifName`. It's a no-op if ipv6 is not enabled.
+func setIPv6Conf(ifName string, key string, value string) error {
+	path := filepath.Join("/proc/sys/net/ipv6/conf", ifName, key)
+	if err := os.WriteFile(path, []byte(value), 0o644); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.WithMessagef(err, "failed to set %s of %s to %s", key, ifName, value)
+	}
+	return nil
+}
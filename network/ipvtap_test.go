@@ -0,0 +1,104 @@
+package network
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/cox96de/containervm/util"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"gotest.tools/v3/assert"
+)
+
+func TestIPVtapConfigure(t *testing.T) {
+	nicName := "vethi0"
+	clean := func() {
+		_, _ = util.Run("ip", "link", "del", nicName)
+		_, _ = util.Run("ip", "link", "del", "ipvtapi0")
+		_, _ = util.Run("ip", "link", "del", "ipvlani0")
+	}
+	clean()
+	t.Cleanup(clean)
+	output, err := util.Run("ip", "link", "add", nicName, "address", "02:00:00:00:00:04", "type", "veth",
+		"peer", "name", "vethi1")
+	assert.NilError(t, err, output)
+	for _, args := range [][]string{
+		{"link", "set", nicName, "up"},
+		{"link", "set", "vethi1", "up"},
+		{"addr", "add", "192.168.79.2/24", "dev", nicName},
+		{"route", "add", "10.79.0.0/16", "via", "192.168.79.1", "dev", nicName},
+	} {
+		output, err = util.Run("ip", args...)
+		assert.NilError(t, err, output)
+	}
+	nic, err := netlink.LinkByName(nicName)
+	assert.NilError(t, err)
+	if err = addIPVlan("ipvtap", nic, "ipvtapi0"); errors.Is(err, unix.EOPNOTSUPP) {
+		t.Skip("ipvtap is not supported by the kernel")
+	}
+	assert.NilError(t, err)
+	assert.NilError(t, deleteLinkIfExists("ipvtapi0"))
+
+	backend, err := NewBackend(BackendIPVtap, nicName, util.GetRandomMAC(), "ipvtapi0", "ipvlani0")
+	assert.NilError(t, err)
+	journal := filepath.Join(t.TempDir(), "network.json")
+	backend.SetJournal(journal)
+	backend.(*IPVtapConfigure).tapDevicePath = filepath.Join(t.TempDir(), "ipvtapi0")
+	assert.NilError(t, backend.Setup())
+	assert.Equal(t, backend.ServiceInterface(), "ipvlani0")
+
+	nic, err = netlink.LinkByName(nicName)
+	assert.NilError(t, err)
+	tap, err := netlink.LinkByName("ipvtapi0")
+	assert.NilError(t, err)
+	lan, err := netlink.LinkByName("ipvlani0")
+	assert.NilError(t, err)
+	// ipvlan devices share the MAC of the NIC, which is kept.
+	assert.Equal(t, nic.Attrs().HardwareAddr.String(), "02:00:00:00:00:04")
+	assert.Equal(t, tap.Attrs().HardwareAddr.String(), "02:00:00:00:00:04")
+	assert.Equal(t, lan.Attrs().HardwareAddr.String(), "02:00:00:00:00:04")
+	addrs, err := netlink.AddrList(nic, netlink.FAMILY_V4)
+	assert.NilError(t, err)
+	assert.Equal(t, len(addrs), 0)
+	addrs, err = netlink.AddrList(tap, netlink.FAMILY_V4)
+	assert.NilError(t, err)
+	assert.Equal(t, len(addrs), 1)
+	assert.Equal(t, addrs[0].IPNet.String(), "192.168.79.2/24")
+	// The pod doesn't take the address of the VM as its own.
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{LinkIndex: tap.Attrs().Index,
+		Table: unix.RT_TABLE_LOCAL}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	assert.NilError(t, err)
+	assert.Equal(t, len(routes), 0)
+	addrs, err = netlink.AddrList(lan, netlink.FAMILY_V4)
+	assert.NilError(t, err)
+	assert.Equal(t, len(addrs), 1)
+	assert.Equal(t, addrs[0].IPNet.String(), serviceIP)
+	tapFiles, err := backend.OpenTap(4)
+	assert.NilError(t, err)
+	assert.Equal(t, len(tapFiles), 4)
+	closeFiles(tapFiles)
+
+	// Recover as a new containervm does from the journal.
+	assert.NilError(t, RecoverFromJournal(journal))
+	assert.Assert(t, !JournalExists(journal))
+	for _, name := range []string{"ipvtapi0", "ipvlani0"} {
+		link, err := linkByNameIfExists(name)
+		assert.NilError(t, err)
+		assert.Assert(t, link == nil, name)
+	}
+	nic, err = netlink.LinkByName(nicName)
+	assert.NilError(t, err)
+	addrs, err = netlink.AddrList(nic, netlink.FAMILY_V4)
+	assert.NilError(t, err)
+	assert.Equal(t, len(addrs), 1)
+	assert.Equal(t, addrs[0].IPNet.String(), "192.168.79.2/24")
+	_, dst, _ := net.ParseCIDR("10.79.0.0/16")
+	routes, err = netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{LinkIndex: nic.Attrs().Index,
+		Dst: dst}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_DST)
+	assert.NilError(t, err)
+	assert.Equal(t, len(routes), 1)
+	// Recover is idempotent.
+	assert.NilError(t, backend.Recover())
+}
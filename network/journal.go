@@ -0,0 +1,130 @@
+package network
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+// bridgeState is the state of the NIC before a Backend mutates it.
+// It's persisted in the journal, so the NIC can be recovered even if containervm is killed.
+type bridgeState struct {
+	// Backend is the kind of the Backend, empty means BackendMacvtap for journals of old versions.
+	Backend       string       `json:"backend,omitempty"`
+	NIC           string       `json:"nic"`
+	HardwareAddr  string       `json:"hardware_addr"`
+	Addresses     []string     `json:"addresses"`
+	Routes        []routeState `json:"routes"`
+	Rules         []ruleState  `json:"rules"`
+	TapName       string       `json:"tap_name"`
+	LanName       string       `json:"lan_name"`
+	TapDevicePath string       `json:"tap_device_path"`
+}
+
+// writeJournal writes `state` to `path` atomically.
+func writeJournal(path string, state *bridgeState) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.WithMessage(err, "failed to marshal journal")
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return errors.WithMessagef(err, "failed to create directory of journal %s", path)
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return errors.WithMessage(err, "failed to create journal")
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err = tmpFile.Write(content); err != nil {
+		_ = tmpFile.Close()
+		return errors.WithMessagef(err, "failed to write journal %s", tmpFile.Name())
+	}
+	// The journal must survive a crash right after the NIC is mutated.
+	if err = tmpFile.Sync(); err != nil {
+		_ = tmpFile.Close()
+		return errors.WithMessagef(err, "failed to sync journal %s", tmpFile.Name())
+	}
+	if err = tmpFile.Close(); err != nil {
+		return errors.WithMessagef(err, "failed to close journal %s", tmpFile.Name())
+	}
+	if err = os.Rename(tmpFile.Name(), path); err != nil {
+		return errors.WithMessagef(err, "failed to rename journal to %s", path)
+	}
+	return nil
+}
+
+// readJournal reads the state from the journal at `path`.
+func readJournal(path string) (*bridgeState, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read journal %s", path)
+	}
+	state := &bridgeState{}
+	if err = json.Unmarshal(content, state); err != nil {
+		return nil, errors.WithMessagef(err, "failed to unmarshal journal %s", path)
+	}
+	return state, nil
+}
+
+// JournalExists reports whether there is a journal at `path` left by an unfinished run.
+func JournalExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// RecoverFromJournal recovers the NIC from the journal at `path`, and removes the journal on success.
+// It's used when containervm was killed before it could recover the NIC.
+func RecoverFromJournal(path string) error {
+	state, err := readJournal(path)
+	if err != nil {
+		return err
+	}
+	hardwareAddr, err := net.ParseMAC(state.HardwareAddr)
+	if err != nil {
+		return errors.WithMessagef(err, "bad hardware address '%s' in journal", state.HardwareAddr)
+	}
+	snapshot := nicSnapshot{defaultNIC: state.NIC, originalMac: hardwareAddr, journalPath: path}
+	for _, addr := range state.Addresses {
+		ipNet, err := netlink.ParseIPNet(addr)
+		if err != nil {
+			return errors.WithMessagef(err, "bad address '%s' in journal", addr)
+		}
+		snapshot.addresses = append(snapshot.addresses, ipNet)
+	}
+	for _, r := range state.Routes {
+		route, err := r.toRoute()
+		if err != nil {
+			return errors.WithMessage(err, "bad route in journal")
+		}
+		snapshot.routes = append(snapshot.routes, *route)
+	}
+	for _, r := range state.Rules {
+		rule, err := r.toRule()
+		if err != nil {
+			return errors.WithMessage(err, "bad rule in journal")
+		}
+		snapshot.rules = append(snapshot.rules, *rule)
+	}
+	switch state.Backend {
+	case "", BackendMacvtap:
+		b := NewBridgeConfigure(state.NIC, nil, state.TapName, state.LanName)
+		b.nicSnapshot = snapshot
+		b.macvatpDevicePath = state.TapDevicePath
+		return b.Recover()
+	case BackendBridge:
+		b := NewTapBridgeConfigure(state.NIC, nil, state.TapName, state.LanName)
+		b.nicSnapshot = snapshot
+		return b.Recover()
+	case BackendIPVtap:
+		b := NewIPVtapConfigure(state.NIC, state.TapName, state.LanName)
+		b.nicSnapshot = snapshot
+		b.tapDevicePath = state.TapDevicePath
+		return b.Recover()
+	default:
+		return errors.Errorf("unknown backend '%s' in journal", state.Backend)
+	}
+}
@@ -0,0 +1,84 @@
+package network
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/cox96de/containervm/util"
+	"github.com/vishvananda/netlink"
+	"gotest.tools/v3/assert"
+)
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal", "network.json")
+	state := &bridgeState{
+		NIC:          "eth0",
+		HardwareAddr: "12:34:56:78:9a:bc",
+		Addresses:    []string{"192.168.1.2/24"},
+		Routes:       []routeState{{Dst: "0.0.0.0/0", Gw: "192.168.1.1", Table: 254, Type: 1}},
+		Rules: []ruleState{
+			{Priority: 100, Family: 2, Table: 100, Mark: -1, Mask: -1, Goto: -1, Flow: -1, Src: "192.168.1.2/32",
+				SuppressIfgroup: -1, SuppressPrefixlen: -1},
+		},
+		TapName:       "macvtap0",
+		LanName:       "macvlan0",
+		TapDevicePath: "/dev/macvtap0",
+	}
+	assert.Assert(t, !JournalExists(path))
+	err := writeJournal(path, state)
+	assert.NilError(t, err)
+	assert.Assert(t, JournalExists(path))
+	got, err := readJournal(path)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, state)
+}
+
+func TestRecoverFromJournal(t *testing.T) {
+	nicName := "vethj0"
+	clean := func() {
+		_, _ = util.Run("ip", "link", "del", nicName)
+	}
+	clean()
+	t.Cleanup(clean)
+	output, err := util.Run("ip", "link", "add", nicName, "address", "02:00:00:00:00:01", "type", "veth",
+		"peer", "name", "vethj1")
+	assert.NilError(t, err, output)
+	output, err = util.Run("ip", "link", "set", nicName, "up")
+	assert.NilError(t, err, output)
+	path := filepath.Join(t.TempDir(), "network.json")
+	err = writeJournal(path, &bridgeState{
+		NIC:           nicName,
+		HardwareAddr:  "12:34:56:78:9a:bc",
+		Addresses:     []string{"192.168.77.2/24"},
+		TapName:       "macvtapj0",
+		LanName:       "macvlanj0",
+		TapDevicePath: filepath.Join(t.TempDir(), "macvtapj0"),
+	})
+	assert.NilError(t, err)
+	check := func() {
+		link, err := netlink.LinkByName(nicName)
+		assert.NilError(t, err)
+		assert.Equal(t, link.Attrs().HardwareAddr.String(), "12:34:56:78:9a:bc")
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		assert.NilError(t, err)
+		assert.Equal(t, len(addrs), 1)
+		assert.Assert(t, addrs[0].IP.Equal(net.ParseIP("192.168.77.2")))
+	}
+	err = RecoverFromJournal(path)
+	assert.NilError(t, err)
+	check()
+	assert.Assert(t, !JournalExists(path))
+	// Recovering an already recovered NIC is a no-op.
+	err = writeJournal(path, &bridgeState{
+		NIC:          nicName,
+		HardwareAddr: "12:34:56:78:9a:bc",
+		Addresses:    []string{"192.168.77.2/24"},
+		TapName:      "macvtapj0",
+		LanName:      "macvlanj0",
+	})
+	assert.NilError(t, err)
+	err = RecoverFromJournal(path)
+	assert.NilError(t, err)
+	check()
+}
@@ -0,0 +1,104 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+
+	"github.com/mdlayher/ndp"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// NDPOption configures ServeNDP.
+type NDPOption struct {
+	// Only answer neighbor solicitations from HardwareAddr, which is the vm.
+	HardwareAddr net.HardwareAddr
+	// Addr is the original nic's ipv6 address with its subnet. Neighbor solicitations are from this ip.
+	Addr net.Addr
+	// GatewayHardwareAddr is replied for addresses in the subnet of Addr.
+	GatewayHardwareAddr net.HardwareAddr
+}
+
+// ServeNDP starts a neighbor solicitation answerer on `ifName` to answer neighbor solicitations from
+// `opt.HardwareAddr`. It's the IPv6 counterpart of ServeARP, it replies gateway's hardware address.
+// It stops when ctx is done, or returns ErrInterfaceGone when `ifName` is deleted.
+func ServeNDP(ctx context.Context, ifName string, opt *NDPOption) error {
+	log.Debugf("listen on: %s", ifName)
+	log.Debugf("response to ndp from: %s with gateway hardware addr: %s", opt.HardwareAddr, opt.GatewayHardwareAddr)
+	ip, mask, err := getIPAndMask(opt.Addr)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to parse addr %v", opt.Addr)
+	}
+	if ip.To4() != nil {
+		return errors.Errorf("%v is not an ipv6 address", ip)
+	}
+	ipNet := &net.IPNet{IP: ip.To16(), Mask: mask}
+	log.Debugf("local subnet range: %s", ipNet)
+	conn, err := dialIPv6(ifName)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to listen to ndp at %s", ifName)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+	log.Infof("ndp answerer started at %s", ifName)
+	guard := newReadGuard(ctx, conn.iface)
+	for {
+		_ = conn.SetReadDeadline(guard.deadline())
+		header, payload, srcHardwareAddr, err := conn.Read()
+		if err != nil {
+			if stop, err := guard.failed(err); stop {
+				return err
+			}
+			continue
+		}
+		guard.succeeded()
+		if header.NextHeader != protocolICMPv6 {
+			continue
+		}
+		msg, err := ndp.ParseMessage(payload)
+		if err != nil {
+			continue
+		}
+		ns, ok := msg.(*ndp.NeighborSolicitation)
+		if !ok {
+			continue
+		}
+		log.Debugf("get a neighbor solicitation: %v", ns.TargetAddress)
+		if !bytes.Equal(srcHardwareAddr, opt.HardwareAddr) {
+			log.Debugf("get a neighbor solicitation from %v, not from vm", srcHardwareAddr)
+			continue
+		}
+		target := net.IP(ns.TargetAddress.AsSlice())
+		// Ignore:
+		//  1. Neighbor solicitations for vm, including duplicate address detection.
+		//  2. Neighbor solicitations not in k8s, only reply to requests in the same subnet.
+		if header.Src.IsUnspecified() || target.Equal(ip) || !ipNet.Contains(target) {
+			log.Debugf("get a neighbor solicitation for %v, ignore", target)
+			continue
+		}
+		na := &ndp.NeighborAdvertisement{
+			Solicited:     true,
+			Override:      true,
+			TargetAddress: ns.TargetAddress,
+			Options: []ndp.Option{
+				&ndp.LinkLayerAddress{Direction: ndp.Target, Addr: opt.GatewayHardwareAddr},
+			},
+		}
+		dst, _ := netip.AddrFromSlice(header.Src.To16())
+		b, err := ndp.MarshalMessageChecksum(na, ns.TargetAddress, dst)
+		if err != nil {
+			log.Errorf("failed to marshal neighbor advertisement: %v", err)
+			continue
+		}
+		if err = conn.Write(srcHardwareAddr, target, header.Src, protocolICMPv6, 255, b); err != nil {
+			log.Errorf("failed to answer neighbor solicitation: %v", err)
+			continue
+		}
+		log.Debugf("answered neighbor solicitation to %v", opt.GatewayHardwareAddr)
+	}
+}
@@ -0,0 +1,83 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/ndp"
+	"gotest.tools/v3/assert"
+)
+
+func TestServeNDP(t *testing.T) {
+	clientIface := "vethn0"
+	serverIface := "vethn1"
+	setupVethPair(t, clientIface, serverIface, "12:34:56:78:9a:bc")
+	hw, _ := net.ParseMAC("12:34:56:78:9a:bc")
+	gwHW, _ := net.ParseMAC("12:34:56:78:9a:02")
+	clientIP := net.ParseIP("2001:db8::3")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		_ = ServeNDP(ctx, serverIface, &NDPOption{
+			HardwareAddr:        hw,
+			Addr:                &net.IPNet{IP: clientIP, Mask: net.CIDRMask(64, 128)},
+			GatewayHardwareAddr: gwHW,
+		})
+	}()
+	// Wait for server to start
+	time.Sleep(time.Millisecond * 50)
+	conn, err := dialIPv6(clientIface)
+	assert.NilError(t, err)
+	defer conn.Close()
+	solicit := func(t *testing.T, target net.IP) (*ndp.NeighborAdvertisement, error) {
+		// Identical to the solicited-node multicast address of `target`.
+		dst := net.ParseIP("ff02::1:ff00:0")
+		copy(dst[13:], target.To16()[13:])
+		srcAddr, _ := netip.AddrFromSlice(clientIP.To16())
+		dstAddr, _ := netip.AddrFromSlice(dst)
+		targetAddr, _ := netip.AddrFromSlice(target.To16())
+		ns, err := ndp.MarshalMessageChecksum(&ndp.NeighborSolicitation{
+			TargetAddress: targetAddr,
+			Options:       []ndp.Option{&ndp.LinkLayerAddress{Direction: ndp.Source, Addr: hw}},
+		}, srcAddr, dstAddr)
+		assert.NilError(t, err)
+		err = conn.Write(multicastHardwareAddr(dst), clientIP, dst, protocolICMPv6, 255, ns)
+		assert.NilError(t, err)
+		assert.NilError(t, conn.conn.SetReadDeadline(time.Now().Add(time.Second)))
+		for {
+			header, payload, srcHardwareAddr, err := conn.Read()
+			if err != nil {
+				return nil, err
+			}
+			if header.NextHeader != protocolICMPv6 || bytes.Equal(srcHardwareAddr, hw) {
+				continue
+			}
+			msg, err := ndp.ParseMessage(payload)
+			if err != nil {
+				continue
+			}
+			if na, ok := msg.(*ndp.NeighborAdvertisement); ok {
+				return na, nil
+			}
+		}
+	}
+	t.Run("same_net", func(t *testing.T) {
+		na, err := solicit(t, net.ParseIP("2001:db8::4"))
+		assert.NilError(t, err)
+		t.Logf("%+v", na)
+		assert.Equal(t, na.TargetAddress.String(), "2001:db8::4")
+		assert.DeepEqual(t, na.Options, []ndp.Option{&ndp.LinkLayerAddress{Direction: ndp.Target, Addr: gwHW}})
+	})
+	t.Run("loop", func(t *testing.T) {
+		_, err := solicit(t, clientIP)
+		assert.ErrorContains(t, err, "i/o timeout")
+	})
+	t.Run("other_net", func(t *testing.T) {
+		_, err := solicit(t, net.ParseIP("2001:db9::4"))
+		assert.ErrorContains(t, err, "i/o timeout")
+	})
+}
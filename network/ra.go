@@ -0,0 +1,188 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/mdlayher/ndp"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// raInterval is the interval of unsolicited router advertisements.
+	raInterval = time.Minute * 10
+	// raRouterLifetime is the router lifetime in router advertisements, longer than raInterval.
+	raRouterLifetime = time.Minute * 30
+)
+
+type RAOption struct {
+	// Only response router solicitations from HardwareAddr, and advertise to it only.
+	HardwareAddr net.HardwareAddr
+	// Router is the link-local address of the gateway, which becomes the default router of the vm.
+	// If it's nil, the EUI-64 link-local address of RouterHardwareAddr is used, which is what most gateways have.
+	Router net.IP
+	// RouterHardwareAddr is the hardware address of the gateway.
+	RouterHardwareAddr net.HardwareAddr
+	// Prefixes are advertised as on-link prefixes, which guests without DHCPv6 clients configure addresses from
+	// by SLAAC. The DHCPv6 server still provides the address of the vm. A prefix of a single address, such as a /128
+	// pod address, is advertised as a route via the router (RFC 4191) instead.
+	Prefixes []*net.IPNet
+	// DNSServers are advertised as recursive DNS servers. IPv4 servers are ignored.
+	DNSServers []net.IP
+	// SearchDomains are advertised as DNS search list.
+	SearchDomains []string
+	// MTU is advertised if it's not zero.
+	MTU int
+	// Destination is the destination address of unsolicited advertisements, all nodes if it's nil.
+	// Links which dispatch frames by the destination address, such as ipvlan, need the address of the vm.
+	Destination net.IP
+}
+
+// ServeRA starts a router advertisement responder on `ifName`, pretending to be the gateway.
+// It answers router solicitations from `opt.HardwareAddr` and advertises periodically,
+// always in frames sent to `opt.HardwareAddr`, so that other hosts on the link are not affected.
+// It stops when ctx is done, or returns ErrInterfaceGone when `ifName` is deleted.
+func ServeRA(ctx context.Context, ifName string, opt *RAOption) error {
+	log.Debugf("listen on: %s", ifName)
+	router := opt.Router
+	if router == nil {
+		router = linkLocalAddr(opt.RouterHardwareAddr)
+	}
+	log.Debugf("advertise router %s(%s) to %s", router, opt.RouterHardwareAddr, opt.HardwareAddr)
+	ra, err := newRouterAdvertisement(opt, router)
+	if err != nil {
+		return errors.WithMessage(err, "failed to build router advertisement")
+	}
+	conn, err := dialIPv6(ifName)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+	advertise := func(dst net.IP) {
+		dstAddr, _ := netip.AddrFromSlice(dst.To16())
+		srcAddr, _ := netip.AddrFromSlice(router.To16())
+		b, err := ndp.MarshalMessageChecksum(ra, srcAddr, dstAddr)
+		if err != nil {
+			log.Errorf("failed to marshal router advertisement: %v", err)
+			return
+		}
+		if err = conn.Write(opt.HardwareAddr, router, dst, protocolICMPv6, 255, b); err != nil {
+			log.Errorf("failed to send router advertisement: %v", err)
+			return
+		}
+		log.Debugf("sent router advertisement to %s", dst)
+	}
+	dst := net.IPv6linklocalallnodes
+	if opt.Destination != nil {
+		dst = opt.Destination
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(raInterval)
+		defer ticker.Stop()
+		for {
+			advertise(dst)
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	log.Infof("router advertisement responder started at %s", ifName)
+	guard := newReadGuard(ctx, conn.iface)
+	for {
+		_ = conn.SetReadDeadline(guard.deadline())
+		header, payload, srcHardwareAddr, err := conn.Read()
+		if err != nil {
+			if stop, err := guard.failed(err); stop {
+				return err
+			}
+			continue
+		}
+		guard.succeeded()
+		if header.NextHeader != protocolICMPv6 || !bytes.Equal(srcHardwareAddr, opt.HardwareAddr) {
+			continue
+		}
+		msg, err := ndp.ParseMessage(payload)
+		if err != nil {
+			continue
+		}
+		if _, ok := msg.(*ndp.RouterSolicitation); !ok {
+			continue
+		}
+		log.Debugf("get a router solicitation from %s", header.Src)
+		if header.Src.IsUnspecified() {
+			advertise(dst)
+			continue
+		}
+		advertise(header.Src)
+	}
+}
+
+// newRouterAdvertisement builds the advertisement of `router` by `opt`.
+func newRouterAdvertisement(opt *RAOption, router net.IP) (*ndp.RouterAdvertisement, error) {
+	if router.To4() != nil || !router.IsLinkLocalUnicast() {
+		return nil, errors.Errorf("router %v is not an ipv6 link-local address", router)
+	}
+	ra := &ndp.RouterAdvertisement{
+		CurrentHopLimit: 64,
+		// Addresses and other configurations are available via DHCPv6.
+		ManagedConfiguration: true,
+		OtherConfiguration:   true,
+		RouterLifetime:       raRouterLifetime,
+		Options: []ndp.Option{
+			&ndp.LinkLayerAddress{Direction: ndp.Source, Addr: opt.RouterHardwareAddr},
+		},
+	}
+	if opt.MTU > 0 {
+		ra.Options = append(ra.Options, ndp.NewMTU(uint32(opt.MTU)))
+	}
+	for _, prefix := range opt.Prefixes {
+		ones, bits := prefix.Mask.Size()
+		if bits != 8*net.IPv6len || prefix.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		addr, _ := netip.AddrFromSlice(prefix.IP.Mask(prefix.Mask).To16())
+		if ones == bits {
+			ra.Options = append(ra.Options, &ndp.RouteInformation{
+				PrefixLength:  uint8(ones),
+				Preference:    ndp.Medium,
+				RouteLifetime: raRouterLifetime,
+				Prefix:        addr,
+			})
+			continue
+		}
+		ra.Options = append(ra.Options, &ndp.PrefixInformation{
+			PrefixLength:                   uint8(ones),
+			OnLink:                         true,
+			AutonomousAddressConfiguration: true,
+			ValidLifetime:                  ndp.Infinity,
+			PreferredLifetime:              ndp.Infinity,
+			Prefix:                         addr,
+		})
+	}
+	var servers []netip.Addr
+	for _, ip := range opt.DNSServers {
+		if ip.To4() == nil && ip.To16() != nil {
+			addr, _ := netip.AddrFromSlice(ip.To16())
+			servers = append(servers, addr)
+		}
+	}
+	if len(servers) > 0 {
+		ra.Options = append(ra.Options, &ndp.RecursiveDNSServer{Lifetime: raRouterLifetime, Servers: servers})
+	}
+	if len(opt.SearchDomains) > 0 {
+		ra.Options = append(ra.Options, &ndp.DNSSearchList{Lifetime: raRouterLifetime, DomainNames: opt.SearchDomains})
+	}
+	return ra, nil
+}
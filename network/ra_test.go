@@ -0,0 +1,96 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/ndp"
+	"gotest.tools/v3/assert"
+)
+
+func TestServeRA(t *testing.T) {
+	clientIface := "vethra0"
+	serverIface := "vethra1"
+	setupVethPair(t, clientIface, serverIface, "12:34:56:78:9a:bc")
+	hw, _ := net.ParseMAC("12:34:56:78:9a:bc")
+	gwHW, _ := net.ParseMAC("12:34:56:78:9a:02")
+	router := net.ParseIP("fe80::1")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		_ = ServeRA(ctx, serverIface, &RAOption{
+			HardwareAddr:       hw,
+			Router:             router,
+			RouterHardwareAddr: gwHW,
+			Prefixes: []*net.IPNet{
+				{IP: net.ParseIP("2001:db8::3"), Mask: net.CIDRMask(64, 128)},
+				{IP: net.ParseIP("fe80::1234"), Mask: net.CIDRMask(64, 128)},
+				{IP: net.ParseIP("2001:db8:1::3"), Mask: net.CIDRMask(128, 128)},
+			},
+			DNSServers: []net.IP{net.ParseIP("2001:db8::53")},
+			MTU:        1450,
+		})
+	}()
+	conn, err := dialIPv6(clientIface)
+	assert.NilError(t, err)
+	defer conn.Close()
+	readRA := func() (net.IP, *ndp.RouterAdvertisement) {
+		assert.NilError(t, conn.conn.SetReadDeadline(time.Now().Add(time.Second)))
+		for {
+			header, payload, srcHardwareAddr, err := conn.Read()
+			assert.NilError(t, err)
+			if header.NextHeader != protocolICMPv6 || bytes.Equal(srcHardwareAddr, hw) {
+				continue
+			}
+			msg, err := ndp.ParseMessage(payload)
+			if err != nil {
+				continue
+			}
+			if ra, ok := msg.(*ndp.RouterAdvertisement); ok {
+				return header.Src, ra
+			}
+		}
+	}
+	// The unsolicited one.
+	src, ra := readRA()
+	assert.Assert(t, src.Equal(router))
+	assert.Equal(t, ra.RouterLifetime, raRouterLifetime)
+	assert.Assert(t, ra.ManagedConfiguration)
+	t.Run("solicited", func(t *testing.T) {
+		clientIP := linkLocalAddr(hw)
+		dst := net.ParseIP("ff02::2")
+		srcAddr, _ := netip.AddrFromSlice(clientIP)
+		dstAddr, _ := netip.AddrFromSlice(dst)
+		rs, err := ndp.MarshalMessageChecksum(&ndp.RouterSolicitation{Options: []ndp.Option{
+			&ndp.LinkLayerAddress{Direction: ndp.Source, Addr: hw},
+		}}, srcAddr, dstAddr)
+		assert.NilError(t, err)
+		err = conn.Write(multicastHardwareAddr(dst), clientIP, dst, protocolICMPv6, 255, rs)
+		assert.NilError(t, err)
+		src, ra := readRA()
+		assert.Assert(t, src.Equal(router))
+		var prefixes, routes []string
+		for _, option := range ra.Options {
+			switch o := option.(type) {
+			case *ndp.LinkLayerAddress:
+				assert.DeepEqual(t, o.Addr, gwHW)
+			case *ndp.MTU:
+				assert.Equal(t, o.MTU, uint32(1450))
+			case *ndp.PrefixInformation:
+				prefixes = append(prefixes, o.Prefix.String())
+				// Guests only doing SLAAC get addresses as well.
+				assert.Assert(t, o.AutonomousAddressConfiguration)
+			case *ndp.RouteInformation:
+				routes = append(routes, fmt.Sprintf("%s/%d", o.Prefix, o.PrefixLength))
+			}
+		}
+		// The link-local prefix is not advertised, and the /128 one is a route.
+		assert.DeepEqual(t, prefixes, []string{"2001:db8::"})
+		assert.DeepEqual(t, routes, []string{"2001:db8:1::3/128"})
+	})
+}
@@ -0,0 +1,235 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/cox96de/containervm/util"
+	"github.com/mdlayher/arp"
+	"github.com/mdlayher/ndp"
+	"github.com/mdlayher/packet"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	etherTypeARP = 0x0806
+
+	defaultResolveAttempts = 3
+	defaultResolveTimeout  = time.Second
+)
+
+// Resolver resolves hardware addresses of neighbors by ARP for IPv4, or NDP for IPv6.
+// ARP requests are sent from the IPv4 address of the interface, such as the address of the pod NIC before it's
+// bridged, or serviceIP on the service interface, as proxy ARP gateways (e.g. 169.254.1.1 of Calico) don't answer
+// ARP probes (RFC 5227), and ipvlan dispatches replies by their target address. An interface without an IPv4
+// address sends ARP probes. Neighbor solicitations are sent as those of duplicate address detection
+// (RFC 4862 5.4.2), which are answered by proxy NDP as well.
+// If no reply arrives, the neighbor table of the interface is looked up.
+type Resolver struct {
+	// Attempts is how many requests are sent before giving up. Zero means 3.
+	Attempts int
+	// Timeout is how long a reply is waited for after each request. Zero means a second.
+	Timeout time.Duration
+}
+
+// ResolveHardwareAddr resolves the hardware address of `ip` on `ifName` by a Resolver with defaults.
+func ResolveHardwareAddr(ctx context.Context, ifName string, ip net.IP) (net.HardwareAddr, error) {
+	return (&Resolver{}).Resolve(ctx, ifName, ip)
+}
+
+// Resolve returns the hardware address of `ip` on `ifName`. The error wraps util.NotFoundError if `ip` doesn't
+// reply and isn't in the neighbor table, or the error of ctx if it's done.
+func (r *Resolver) Resolve(ctx context.Context, ifName string, ip net.IP) (net.HardwareAddr, error) {
+	attempts, timeout := r.Attempts, r.Timeout
+	if attempts == 0 {
+		attempts = defaultResolveAttempts
+	}
+	if timeout == 0 {
+		timeout = defaultResolveTimeout
+	}
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to get interface %s", ifName)
+	}
+	var (
+		conn interface {
+			SetReadDeadline(t time.Time) error
+			Close() error
+		}
+		send    func() error
+		receive func() (net.HardwareAddr, error)
+	)
+	if ip.To4() != nil {
+		conn, send, receive, err = dialARPResolver(iface, ip.To4())
+	} else {
+		conn, send, receive, err = dialNDPResolver(iface, ip.To16())
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+	for i := 0; i < attempts; i++ {
+		if err = send(); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, errors.WithMessagef(err, "failed to send request for %s on %s", ip, ifName)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		hardwareAddr, err := receive()
+		if err == nil {
+			log.Debugf("resolved %s on %s: %s", ip, ifName, hardwareAddr)
+			return hardwareAddr, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, errors.WithMessagef(err, "failed to read reply for %s on %s", ip, ifName)
+		}
+	}
+	if hardwareAddr := lookupNeighbor(iface.Index, ip); hardwareAddr != nil {
+		log.Debugf("no reply for %s on %s, found in the neighbor table: %s", ip, ifName, hardwareAddr)
+		return hardwareAddr, nil
+	}
+	return nil, errors.WithMessagef(util.NotFoundError, "no reply for %s on %s after %d attempts", ip, ifName,
+		attempts)
+}
+
+// lookupNeighbor returns the hardware address of `ip` in the neighbor table of the interface `ifIndex`, or nil if
+// there is no usable entry.
+func lookupNeighbor(ifIndex int, ip net.IP) net.HardwareAddr {
+	family := netlink.FAMILY_V4
+	if ip.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	neighs, err := netlink.NeighList(ifIndex, family)
+	if err != nil {
+		log.Debugf("failed to list neighbors of %d: %v", ifIndex, err)
+		return nil
+	}
+	for _, neigh := range neighs {
+		if !neigh.IP.Equal(ip) || len(neigh.HardwareAddr) == 0 ||
+			neigh.State&(netlink.NUD_INCOMPLETE|netlink.NUD_FAILED) != 0 {
+			continue
+		}
+		return neigh.HardwareAddr
+	}
+	return nil
+}
+
+// interfaceIPv4 returns the first IPv4 address of `iface`, or 0.0.0.0 if it has none.
+func interfaceIPv4(iface *net.Interface) net.IP {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		log.Debugf("failed to get addresses of %s: %v", iface.Name, err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP.To4()
+		}
+	}
+	return net.IPv4zero.To4()
+}
+
+// dialARPResolver returns the conn to resolve `ip` on `iface` by ARP, with functions to send an ARP request and to
+// receive the reply. Replies to others, such as those ServeARP sends to the vm, are ignored.
+func dialARPResolver(iface *net.Interface, ip net.IP) (*packet.Conn, func() error,
+	func() (net.HardwareAddr, error), error) {
+	req, err := arp.NewPacket(arp.OperationRequest, iface.HardwareAddr, interfaceIPv4(iface),
+		make(net.HardwareAddr, len(iface.HardwareAddr)), ip)
+	if err != nil {
+		return nil, nil, nil, errors.WithMessage(err, "failed to build arp request")
+	}
+	b, err := req.MarshalBinary()
+	if err != nil {
+		return nil, nil, nil, errors.WithMessage(err, "failed to marshal arp request")
+	}
+	conn, err := packet.Listen(iface, packet.Datagram, etherTypeARP, nil)
+	if err != nil {
+		return nil, nil, nil, errors.WithMessagef(err, "failed to listen to arp at %s", iface.Name)
+	}
+	send := func() error {
+		_, err := conn.WriteTo(b, &packet.Addr{HardwareAddr: broadcastHardwareAddr})
+		return err
+	}
+	buf := make([]byte, 128)
+	receive := func() (net.HardwareAddr, error) {
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return nil, err
+			}
+			var p arp.Packet
+			if err = p.UnmarshalBinary(buf[:n]); err != nil {
+				continue
+			}
+			if p.Operation == arp.OperationReply && p.SenderIP.Equal(ip) &&
+				bytes.Equal(p.TargetHardwareAddr, iface.HardwareAddr) {
+				return append(net.HardwareAddr(nil), p.SenderHardwareAddr...), nil
+			}
+		}
+	}
+	return conn, send, receive, nil
+}
+
+// dialNDPResolver is the NDP counterpart of dialARPResolver. Neighbors reply to solicitations from the unspecified
+// address by advertisements to all nodes.
+func dialNDPResolver(iface *net.Interface, ip net.IP) (*ipv6Conn, func() error,
+	func() (net.HardwareAddr, error), error) {
+	target, _ := netip.AddrFromSlice(ip)
+	dst, err := ndp.SolicitedNodeMulticast(target)
+	if err != nil {
+		return nil, nil, nil, errors.WithMessagef(err, "failed to get solicited-node multicast address of %s", ip)
+	}
+	// A solicitation from the unspecified address has no source link-layer address option.
+	b, err := ndp.MarshalMessageChecksum(&ndp.NeighborSolicitation{TargetAddress: target}, netip.IPv6Unspecified(),
+		dst)
+	if err != nil {
+		return nil, nil, nil, errors.WithMessage(err, "failed to marshal neighbor solicitation")
+	}
+	conn, err := dialIPv6(iface.Name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	send := func() error {
+		return conn.Write(multicastHardwareAddr(dst.AsSlice()), net.IPv6unspecified, dst.AsSlice(), protocolICMPv6,
+			255, b)
+	}
+	receive := func() (net.HardwareAddr, error) {
+		for {
+			header, payload, srcHardwareAddr, err := conn.Read()
+			if err != nil {
+				return nil, err
+			}
+			if header.NextHeader != protocolICMPv6 {
+				continue
+			}
+			msg, err := ndp.ParseMessage(payload)
+			if err != nil {
+				continue
+			}
+			na, ok := msg.(*ndp.NeighborAdvertisement)
+			if !ok || na.TargetAddress != target {
+				continue
+			}
+			for _, o := range na.Options {
+				if lla, ok := o.(*ndp.LinkLayerAddress); ok && lla.Direction == ndp.Target {
+					return append(net.HardwareAddr(nil), lla.Addr...), nil
+				}
+			}
+			return append(net.HardwareAddr(nil), srcHardwareAddr...), nil
+		}
+	}
+	return conn, send, receive, nil
+}
@@ -0,0 +1,114 @@
+package network
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cox96de/containervm/util"
+	"github.com/pkg/errors"
+	"gotest.tools/v3/assert"
+)
+
+func TestResolver(t *testing.T) {
+	nsName := "resolve-gateway"
+	gatewayIface := "vethr0"
+	localIface := "vethr1"
+	gatewayHW, _ := net.ParseMAC("12:34:56:78:9a:80")
+	clean := func() {
+		_, _ = util.Run("ip", "netns", "del", nsName)
+		_, _ = util.Run("ip", "link", "del", localIface)
+	}
+	clean()
+	t.Cleanup(clean)
+	// The local interface has no address, like the NIC bridged to the vm.
+	for _, args := range [][]string{
+		{"netns", "add", nsName},
+		{"link", "add", gatewayIface, "address", gatewayHW.String(), "type", "veth", "peer", "name", localIface},
+		{"link", "set", gatewayIface, "netns", nsName},
+		{"-n", nsName, "addr", "add", "192.168.80.1/24", "dev", gatewayIface},
+		{"-n", nsName, "addr", "add", "2001:db8:80::1/64", "dev", gatewayIface, "nodad"},
+		{"-n", nsName, "link", "set", gatewayIface, "up"},
+		{"link", "set", localIface, "up"},
+	} {
+		output, err := util.Run("ip", args...)
+		assert.NilError(t, err, output)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	t.Run("ipv4", func(t *testing.T) {
+		hw, err := ResolveHardwareAddr(ctx, localIface, net.ParseIP("192.168.80.1"))
+		assert.NilError(t, err)
+		assert.DeepEqual(t, hw, gatewayHW)
+	})
+	t.Run("ipv6", func(t *testing.T) {
+		hw, err := ResolveHardwareAddr(ctx, localIface, net.ParseIP("2001:db8:80::1"))
+		assert.NilError(t, err)
+		assert.DeepEqual(t, hw, gatewayHW)
+	})
+	t.Run("not_found", func(t *testing.T) {
+		r := &Resolver{Attempts: 2, Timeout: time.Millisecond * 100}
+		_, err := r.Resolve(ctx, localIface, net.ParseIP("192.168.80.2"))
+		assert.Assert(t, errors.Is(err, util.NotFoundError), err)
+		_, err = r.Resolve(ctx, localIface, net.ParseIP("2001:db8:80::2"))
+		assert.Assert(t, errors.Is(err, util.NotFoundError), err)
+	})
+	t.Run("neighbor_table", func(t *testing.T) {
+		// 192.168.80.9 doesn't reply, but the kernel knows it.
+		staticHW, _ := net.ParseMAC("12:34:56:78:9a:81")
+		output, err := util.Run("ip", "neigh", "add", "192.168.80.9", "lladdr", staticHW.String(), "dev", localIface,
+			"nud", "permanent")
+		assert.NilError(t, err, output)
+		r := &Resolver{Attempts: 1, Timeout: time.Millisecond * 100}
+		hw, err := r.Resolve(ctx, localIface, net.ParseIP("192.168.80.9"))
+		assert.NilError(t, err)
+		assert.DeepEqual(t, hw, staticHW)
+	})
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, time.Millisecond*100)
+		defer cancel()
+		start := time.Now()
+		_, err := (&Resolver{Timeout: time.Minute}).Resolve(ctx, localIface, net.ParseIP("192.168.80.2"))
+		assert.Assert(t, errors.Is(err, context.DeadlineExceeded), err)
+		assert.Assert(t, time.Since(start) < time.Second*10)
+	})
+}
+
+func TestResolverProxyARP(t *testing.T) {
+	nsName := "resolve-proxy"
+	gatewayIface := "vethpx0"
+	localIface := "vethpx1"
+	gatewayHW, _ := net.ParseMAC("12:34:56:78:9a:90")
+	clean := func() {
+		_, _ = util.Run("ip", "netns", "del", nsName)
+		_, _ = util.Run("ip", "link", "del", localIface)
+	}
+	clean()
+	t.Cleanup(clean)
+	// Like Calico, the gateway has no address on the link, and answers for 169.254.1.1 by proxy ARP as it routes
+	// it by vethpx2.
+	for _, args := range [][]string{
+		{"netns", "add", nsName},
+		{"link", "add", gatewayIface, "address", gatewayHW.String(), "type", "veth", "peer", "name", localIface},
+		{"link", "set", gatewayIface, "netns", nsName},
+		{"-n", nsName, "link", "add", "vethpx2", "type", "veth", "peer", "name", "vethpx3"},
+		{"netns", "exec", nsName, "sysctl", "-w", "net.ipv4.ip_forward=1",
+			"net.ipv4.conf." + gatewayIface + ".proxy_arp=1"},
+		{"-n", nsName, "link", "set", gatewayIface, "up"},
+		{"-n", nsName, "link", "set", "vethpx2", "up"},
+		{"-n", nsName, "link", "set", "vethpx3", "up"},
+		{"-n", nsName, "route", "add", "default", "dev", "vethpx2"},
+		{"-n", nsName, "route", "add", "10.0.90.3/32", "dev", gatewayIface},
+		{"addr", "add", "10.0.90.3/32", "dev", localIface},
+		{"link", "set", localIface, "up"},
+	} {
+		output, err := util.Run("ip", args...)
+		assert.NilError(t, err, output)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	hw, err := (&Resolver{Attempts: 2}).Resolve(ctx, localIface, net.ParseIP("169.254.1.1"))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, hw, gatewayHW)
+}
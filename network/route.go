@@ -0,0 +1,296 @@
+package network
+
+import (
+	"net"
+	"sort"
+	"syscall"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// snapshotRoutes returns all routes via `link` in every routing table,
+// and the policy routing rules which refer to `link` or to the tables of these routes.
+func snapshotRoutes(link netlink.Link) ([]netlink.Route, []netlink.Rule, error) {
+	var routes []netlink.Route
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		familyRoutes, err := netlink.RouteListFiltered(family, &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Table:     unix.RT_TABLE_UNSPEC,
+		}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return nil, nil, errors.WithMessagef(err, "failed to list routes of %s", link.Attrs().Name)
+		}
+		for _, route := range familyRoutes {
+			// Default routes have no destination, which loses the family of routes without a gateway.
+			if route.Dst == nil {
+				route.Dst = defaultDst(family)
+			}
+			routes = append(routes, route)
+		}
+	}
+	tables := make(map[int]bool)
+	for _, route := range routes {
+		tables[route.Table] = true
+	}
+	var rules []netlink.Rule
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		familyRules, err := netlink.RuleList(family)
+		if err != nil {
+			return nil, nil, errors.WithMessagef(err, "failed to list rules of family %d", family)
+		}
+		for _, rule := range familyRules {
+			rule.Family = family
+			if isDefaultRule(&rule) {
+				continue
+			}
+			if rule.IifName == link.Attrs().Name || rule.OifName == link.Attrs().Name || tables[rule.Table] {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	return routes, rules, nil
+}
+
+// defaultDst returns the destination of default routes of `family`.
+func defaultDst(family int) *net.IPNet {
+	if family == netlink.FAMILY_V6 {
+		return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
+	return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+}
+
+// isDefaultRule reports whether `rule` is one of the rules that always exist.
+// Identical to `ip rule` with `0: from all lookup local`, `32766: from all lookup main`
+// and `32767: from all lookup default`.
+func isDefaultRule(rule *netlink.Rule) bool {
+	switch rule.Table {
+	case unix.RT_TABLE_LOCAL, unix.RT_TABLE_MAIN, unix.RT_TABLE_DEFAULT:
+	default:
+		return false
+	}
+	return rule.Src == nil && rule.Dst == nil && rule.IifName == "" && rule.OifName == "" &&
+		rule.Mark <= 0 && !rule.Invert
+}
+
+// restoreRoutes adds `routes` to `link` and adds `rules`.
+// Routes and rules which already exist are skipped, e.g. the routes added by the kernel along with addresses.
+func restoreRoutes(link netlink.Link, routes []netlink.Route, rules []netlink.Rule) error {
+	routes = append([]netlink.Route{}, routes...)
+	// Routes with narrower scope go first, so on-link routes exist before the routes via a gateway on that link.
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].Scope > routes[j].Scope
+	})
+	for _, route := range routes {
+		route := route
+		if len(route.MultiPath) == 0 {
+			route.LinkIndex = link.Attrs().Index
+		}
+		// Flags such as linkdown and dead are reported by the kernel, they can't be set.
+		route.Flags &= settableRouteFlags
+		// Nexthops are pointers, copy them to keep the snapshot intact for another restore.
+		if len(route.MultiPath) > 0 {
+			multiPath := make([]*netlink.NexthopInfo, 0, len(route.MultiPath))
+			for _, nh := range route.MultiPath {
+				n := *nh
+				n.Flags &= settableRouteFlags
+				multiPath = append(multiPath, &n)
+			}
+			route.MultiPath = multiPath
+		}
+		log.Infof("add route %s", route.String())
+		if err := netlink.RouteAdd(&route); err != nil {
+			if errors.Is(err, syscall.EEXIST) {
+				log.Infof("route %s is already restored", route.String())
+				continue
+			}
+			return errors.WithMessagef(err, "failed to add route %s", route.String())
+		}
+	}
+	for _, rule := range rules {
+		rule := rule
+		log.Infof("add rule %s", rule.String())
+		if err := netlink.RuleAdd(&rule); err != nil {
+			if errors.Is(err, syscall.EEXIST) {
+				log.Infof("rule %s is already restored", rule.String())
+				continue
+			}
+			return errors.WithMessagef(err, "failed to add rule %s", rule.String())
+		}
+	}
+	return nil
+}
+
+// settableRouteFlags is the route flags which can be set by users.
+const settableRouteFlags = unix.RTNH_F_ONLINK | unix.RTNH_F_PERVASIVE
+
+// routeState is the persisted form of netlink.Route.
+type routeState struct {
+	Dst       string         `json:"dst,omitempty"`
+	Src       string         `json:"src,omitempty"`
+	Gw        string         `json:"gw,omitempty"`
+	MultiPath []nexthopState `json:"multipath,omitempty"`
+	Scope     int            `json:"scope"`
+	Protocol  int            `json:"protocol"`
+	Priority  int            `json:"priority"`
+	Table     int            `json:"table"`
+	Type      int            `json:"type"`
+	Tos       int            `json:"tos"`
+	Flags     int            `json:"flags"`
+	MTU       int            `json:"mtu,omitempty"`
+	AdvMSS    int            `json:"advmss,omitempty"`
+	Hoplimit  int            `json:"hoplimit,omitempty"`
+}
+
+type nexthopState struct {
+	LinkIndex int    `json:"link_index"`
+	Hops      int    `json:"hops"`
+	Gw        string `json:"gw,omitempty"`
+	Flags     int    `json:"flags"`
+}
+
+// ruleState is the persisted form of netlink.Rule.
+type ruleState struct {
+	Priority          int    `json:"priority"`
+	Family            int    `json:"family"`
+	Table             int    `json:"table"`
+	Mark              int    `json:"mark"`
+	Mask              int    `json:"mask"`
+	Goto              int    `json:"goto"`
+	Src               string `json:"src,omitempty"`
+	Dst               string `json:"dst,omitempty"`
+	Flow              int    `json:"flow"`
+	IifName           string `json:"iif_name,omitempty"`
+	OifName           string `json:"oif_name,omitempty"`
+	SuppressIfgroup   int    `json:"suppress_ifgroup"`
+	SuppressPrefixlen int    `json:"suppress_prefixlen"`
+	Invert            bool   `json:"invert,omitempty"`
+}
+
+func newRouteState(route *netlink.Route) routeState {
+	state := routeState{
+		Dst:      ipNetString(route.Dst),
+		Src:      ipString(route.Src),
+		Gw:       ipString(route.Gw),
+		Scope:    int(route.Scope),
+		Protocol: route.Protocol,
+		Priority: route.Priority,
+		Table:    route.Table,
+		Type:     route.Type,
+		Tos:      route.Tos,
+		Flags:    route.Flags,
+		MTU:      route.MTU,
+		AdvMSS:   route.AdvMSS,
+		Hoplimit: route.Hoplimit,
+	}
+	for _, nh := range route.MultiPath {
+		state.MultiPath = append(state.MultiPath, nexthopState{
+			LinkIndex: nh.LinkIndex,
+			Hops:      nh.Hops,
+			Gw:        ipString(nh.Gw),
+			Flags:     nh.Flags,
+		})
+	}
+	return state
+}
+
+func (s *routeState) toRoute() (*netlink.Route, error) {
+	dst, err := parseIPNet(s.Dst)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "bad route destination '%s'", s.Dst)
+	}
+	route := &netlink.Route{
+		Dst:      dst,
+		Src:      net.ParseIP(s.Src),
+		Gw:       net.ParseIP(s.Gw),
+		Scope:    netlink.Scope(s.Scope),
+		Protocol: s.Protocol,
+		Priority: s.Priority,
+		Table:    s.Table,
+		Type:     s.Type,
+		Tos:      s.Tos,
+		Flags:    s.Flags,
+		MTU:      s.MTU,
+		AdvMSS:   s.AdvMSS,
+		Hoplimit: s.Hoplimit,
+	}
+	for _, nh := range s.MultiPath {
+		route.MultiPath = append(route.MultiPath, &netlink.NexthopInfo{
+			LinkIndex: nh.LinkIndex,
+			Hops:      nh.Hops,
+			Gw:        net.ParseIP(nh.Gw),
+			Flags:     nh.Flags,
+		})
+	}
+	return route, nil
+}
+
+func newRuleState(rule *netlink.Rule) ruleState {
+	return ruleState{
+		Priority:          rule.Priority,
+		Family:            rule.Family,
+		Table:             rule.Table,
+		Mark:              rule.Mark,
+		Mask:              rule.Mask,
+		Goto:              rule.Goto,
+		Src:               ipNetString(rule.Src),
+		Dst:               ipNetString(rule.Dst),
+		Flow:              rule.Flow,
+		IifName:           rule.IifName,
+		OifName:           rule.OifName,
+		SuppressIfgroup:   rule.SuppressIfgroup,
+		SuppressPrefixlen: rule.SuppressPrefixlen,
+		Invert:            rule.Invert,
+	}
+}
+
+func (s *ruleState) toRule() (*netlink.Rule, error) {
+	src, err := parseIPNet(s.Src)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "bad rule source '%s'", s.Src)
+	}
+	dst, err := parseIPNet(s.Dst)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "bad rule destination '%s'", s.Dst)
+	}
+	rule := netlink.NewRule()
+	rule.Priority = s.Priority
+	rule.Family = s.Family
+	rule.Table = s.Table
+	rule.Mark = s.Mark
+	rule.Mask = s.Mask
+	rule.Goto = s.Goto
+	rule.Src = src
+	rule.Dst = dst
+	rule.Flow = s.Flow
+	rule.IifName = s.IifName
+	rule.OifName = s.OifName
+	rule.SuppressIfgroup = s.SuppressIfgroup
+	rule.SuppressPrefixlen = s.SuppressPrefixlen
+	rule.Invert = s.Invert
+	return rule, nil
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func ipNetString(ipNet *net.IPNet) string {
+	if ipNet == nil {
+		return ""
+	}
+	return ipNet.String()
+}
+
+// parseIPNet parses a CIDR, keeping the host part of the IP. Empty string means nil.
+func parseIPNet(s string) (*net.IPNet, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return netlink.ParseIPNet(s)
+}
@@ -0,0 +1,98 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"github.com/cox96de/containervm/util"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"gotest.tools/v3/assert"
+)
+
+func TestSnapshotAndRestoreRoutes(t *testing.T) {
+	nicName := "vethr0"
+	clean := func() {
+		_, _ = util.Run("ip", "rule", "del", "from", "192.168.78.2", "lookup", "100")
+		_, _ = util.Run("ip", "link", "del", nicName)
+	}
+	clean()
+	t.Cleanup(clean)
+	for _, args := range [][]string{
+		{"link", "add", nicName, "type", "veth", "peer", "name", "vethr1"},
+		{"link", "set", nicName, "up"},
+		{"addr", "add", "192.168.78.2/32", "dev", nicName},
+		{"route", "add", "169.254.1.1", "dev", nicName, "scope", "link"},
+		{"route", "add", "10.78.0.0/16", "via", "169.254.1.1", "dev", nicName, "metric", "50"},
+		{"route", "add", "default", "via", "192.168.78.1", "dev", nicName, "onlink", "table", "100"},
+		{"rule", "add", "from", "192.168.78.2", "lookup", "100"},
+	} {
+		output, err := util.Run("ip", args...)
+		assert.NilError(t, err, output)
+	}
+	link, err := netlink.LinkByName(nicName)
+	assert.NilError(t, err)
+	routes, rules, err := snapshotRoutes(link)
+	assert.NilError(t, err)
+	assert.Equal(t, len(rules), 1)
+	assert.Equal(t, rules[0].Table, 100)
+	// Routes and rules survive the journal.
+	for i, route := range routes {
+		state := newRouteState(&route)
+		r, err := state.toRoute()
+		assert.NilError(t, err)
+		// The link index is filled when restoring.
+		r.LinkIndex = link.Attrs().Index
+		assert.Equal(t, r.String(), routes[i].String())
+	}
+	ruleState := newRuleState(&rules[0])
+	rule, err := ruleState.toRule()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, *rule, rules[0])
+
+	output, err := util.Run("ip", "addr", "flush", "dev", nicName)
+	assert.NilError(t, err, output)
+	output, err = util.Run("ip", "route", "flush", "dev", nicName, "table", "all")
+	assert.NilError(t, err, output)
+	output, err = util.Run("ip", "rule", "del", "from", "192.168.78.2", "lookup", "100")
+	assert.NilError(t, err, output)
+
+	// Flags reported by the kernel are masked on restore, but not in the snapshot.
+	_, multiPathDst, _ := net.ParseCIDR("10.79.0.0/16")
+	routes = append(routes, netlink.Route{
+		Dst: multiPathDst,
+		MultiPath: []*netlink.NexthopInfo{{
+			LinkIndex: link.Attrs().Index,
+			Gw:        net.ParseIP("169.254.1.1"),
+			Flags:     unix.RTNH_F_LINKDOWN,
+		}},
+	})
+	err = restoreRoutes(link, routes, rules)
+	assert.NilError(t, err)
+	// Restoring twice is a no-op.
+	err = restoreRoutes(link, routes, rules)
+	assert.NilError(t, err)
+	assert.Equal(t, routes[len(routes)-1].MultiPath[0].Flags, unix.RTNH_F_LINKDOWN)
+	restoredRoutes, restoredRules, err := snapshotRoutes(link)
+	assert.NilError(t, err)
+	assert.Equal(t, len(restoredRules), 1)
+	find := func(dst string, table int) *netlink.Route {
+		_, dstNet, _ := net.ParseCIDR(dst)
+		for _, route := range restoredRoutes {
+			if route.Dst.String() == dstNet.String() && route.Table == table {
+				return &route
+			}
+		}
+		return nil
+	}
+	onLink := find("169.254.1.1/32", 254)
+	assert.Assert(t, onLink != nil)
+	assert.Equal(t, onLink.Scope, netlink.SCOPE_LINK)
+	viaGw := find("10.78.0.0/16", 254)
+	assert.Assert(t, viaGw != nil)
+	assert.Equal(t, viaGw.Priority, 50)
+	assert.Assert(t, viaGw.Gw.Equal(net.ParseIP("169.254.1.1")))
+	defaultRoute := find("0.0.0.0/0", 100)
+	assert.Assert(t, defaultRoute != nil)
+	assert.Equal(t, defaultRoute.Flags&int(netlink.FLAG_ONLINK), int(netlink.FLAG_ONLINK))
+}
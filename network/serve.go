@@ -0,0 +1,91 @@
+package network
+
+import (
+	"context"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// ErrInterfaceGone is returned by servers when the interface they run on is deleted, such as when the pod is
+// torn down.
+var ErrInterfaceGone = errors.New("interface is gone")
+
+const (
+	// linkCheckInterval is how often servers check whether their interface still exists while idle. Sockets bound to
+	// a deleted interface may block forever instead of failing.
+	linkCheckInterval = time.Second * 5
+
+	minReadBackoff = time.Millisecond * 10
+	maxReadBackoff = time.Second
+)
+
+// readGuard decides what servers do when reading from the interface fails: stop when ctx is done or the interface
+// is gone, otherwise retry with exponential backoff, so that persistent errors don't spin.
+type readGuard struct {
+	ctx     context.Context
+	iface   *net.Interface
+	backoff time.Duration
+}
+
+func newReadGuard(ctx context.Context, iface *net.Interface) *readGuard {
+	return &readGuard{ctx: ctx, iface: iface}
+}
+
+// deadline returns the read deadline of the next read.
+func (g *readGuard) deadline() time.Time {
+	return time.Now().Add(linkCheckInterval)
+}
+
+// failed handles the read error `err`. It returns true if the server should stop, with the error to return,
+// which is nil if ctx is done. Otherwise, it waits before the next read.
+func (g *readGuard) failed(err error) (bool, error) {
+	if g.ctx.Err() != nil {
+		return true, nil
+	}
+	if gone, checkErr := g.interfaceGone(); checkErr != nil {
+		log.Warnf("failed to check interface %s: %v", g.iface.Name, checkErr)
+	} else if gone {
+		return true, errors.WithMessagef(ErrInterfaceGone, "failed to read packet from %s", g.iface.Name)
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return false, nil
+	}
+	if g.backoff == 0 {
+		g.backoff = minReadBackoff
+	} else if g.backoff *= 2; g.backoff > maxReadBackoff {
+		g.backoff = maxReadBackoff
+	}
+	log.Errorf("failed to read packet from %s, retry in %s: %v", g.iface.Name, g.backoff, err)
+	timer := time.NewTimer(g.backoff)
+	defer timer.Stop()
+	select {
+	case <-g.ctx.Done():
+		return true, nil
+	case <-timer.C:
+		return false, nil
+	}
+}
+
+// succeeded resets the backoff after a successful read.
+func (g *readGuard) succeeded() {
+	g.backoff = 0
+}
+
+// interfaceGone reports whether the interface is deleted. It's identified by index, as the name of a deleted
+// interface may be taken by another.
+func (g *readGuard) interfaceGone() (bool, error) {
+	_, err := netlink.LinkByIndex(g.iface.Index)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, nil
+}
@@ -0,0 +1,138 @@
+package network
+
+import (
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// TapBridgeConfigure is the bridge Backend. The NIC and a tap device for the VM are enslaved to a Linux bridge,
+// and servers for the VM run on the bridge. It doesn't depend on macvlan, which is restricted on some CNIs and
+// kernels.
+type TapBridgeConfigure struct {
+	nicSnapshot
+	tapName    string
+	bridgeName string
+	newMac     net.HardwareAddr
+}
+
+// NewTapBridgeConfigure creates a bridge Backend for `defaultNIC`, which gets `newMac` after Setup.
+// `tapName` and `bridgeName` are names of the tap device and the bridge.
+func NewTapBridgeConfigure(defaultNIC string, newMac net.HardwareAddr, tapName string,
+	bridgeName string) *TapBridgeConfigure {
+	return &TapBridgeConfigure{
+		nicSnapshot: nicSnapshot{defaultNIC: defaultNIC},
+		tapName:     tapName,
+		bridgeName:  bridgeName,
+		newMac:      newMac,
+	}
+}
+
+// Setup implements Backend.
+func (b *TapBridgeConfigure) Setup() error {
+	nicName := b.defaultNIC
+	link, err := netlink.LinkByName(nicName)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to get link by name %s", nicName)
+	}
+	if err = b.snapshot(link); err != nil {
+		return err
+	}
+	if err = b.writeJournal(b.state()); err != nil {
+		return err
+	}
+	// The bridge delivers frames to the MACs of its ports locally, so the NIC must give up the original MAC,
+	// which the VM takes over.
+	if err = changeMac(link, b.newMac); err != nil {
+		return err
+	}
+	log.Infof("creating bridge %s for nic %s", b.bridgeName, nicName)
+	bridgeAttrs := netlink.NewLinkAttrs()
+	bridgeAttrs.Name = b.bridgeName
+	bridgeAttrs.MTU = link.Attrs().MTU
+	// Identical to `ip link add bridgeName type bridge`.
+	if err = netlink.LinkAdd(&netlink.Bridge{LinkAttrs: bridgeAttrs}); err != nil {
+		return errors.WithMessagef(err, "failed to create bridge %s", b.bridgeName)
+	}
+	bridge, err := netlink.LinkByName(b.bridgeName)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to get bridge by name %s", b.bridgeName)
+	}
+	// Identical to `ip link set nicName master bridgeName`.
+	if err = netlink.LinkSetMaster(link, bridge); err != nil {
+		return errors.WithMessagef(err, "failed to add nic %s to bridge %s", nicName, b.bridgeName)
+	}
+	log.Infof("creating tap device %s on bridge %s", b.tapName, b.bridgeName)
+	tapAttrs := netlink.NewLinkAttrs()
+	tapAttrs.Name = b.tapName
+	tapAttrs.MTU = link.Attrs().MTU
+	// Identical to `ip tuntap add tapName mode tap vnet_hdr multi_queue`.
+	if err = netlink.LinkAdd(&netlink.Tuntap{
+		LinkAttrs: tapAttrs,
+		Mode:      netlink.TUNTAP_MODE_TAP,
+		Flags:     netlink.TUNTAP_NO_PI | netlink.TUNTAP_VNET_HDR | netlink.TUNTAP_MULTI_QUEUE,
+	}); err != nil {
+		return errors.WithMessagef(err, "failed to create tap device %s", b.tapName)
+	}
+	tap, err := netlink.LinkByName(b.tapName)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to get tap device by name %s", b.tapName)
+	}
+	if err = netlink.LinkSetMTU(tap, link.Attrs().MTU); err != nil {
+		return errors.WithMessagef(err, "failed to set mtu of tap device %s", b.tapName)
+	}
+	if err = netlink.LinkSetMaster(tap, bridge); err != nil {
+		return errors.WithMessagef(err, "failed to add tap device %s to bridge %s", b.tapName, b.bridgeName)
+	}
+	if err = netlink.LinkSetUp(tap); err != nil {
+		return errors.WithMessagef(err, "failed to bring up tap device %s", b.tapName)
+	}
+	if err = netlink.LinkSetUp(bridge); err != nil {
+		return errors.WithMessagef(err, "failed to bring up bridge %s", b.bridgeName)
+	}
+	if err = flushAddresses(link); err != nil {
+		return err
+	}
+	addr, err := netlink.ParseAddr(serviceIP)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to parse ip address '%s'", serviceIP)
+	}
+	if err = netlink.AddrAdd(bridge, addr); err != nil {
+		return errors.WithMessagef(err, "failed to assign ip address '%s' to bridge %s", serviceIP, b.bridgeName)
+	}
+	return nil
+}
+
+// OpenTap implements Backend.
+func (b *TapBridgeConfigure) OpenTap(queues int) ([]*os.File, error) {
+	return openTap(b.tapName, queues)
+}
+
+// ServiceInterface implements Backend, it's the bridge.
+func (b *TapBridgeConfigure) ServiceInterface() string {
+	return b.bridgeName
+}
+
+// Recover implements Backend.
+func (b *TapBridgeConfigure) Recover() error {
+	if err := deleteLinkIfExists(b.tapName); err != nil {
+		return err
+	}
+	// Deleting the bridge releases the NIC.
+	if err := deleteLinkIfExists(b.bridgeName); err != nil {
+		return err
+	}
+	return b.restore(nil)
+}
+
+// state returns the state to be persisted in the journal.
+func (b *TapBridgeConfigure) state() *bridgeState {
+	state := b.nicSnapshot.state()
+	state.Backend = BackendBridge
+	state.TapName = b.tapName
+	state.LanName = b.bridgeName
+	return state
+}
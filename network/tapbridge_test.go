@@ -0,0 +1,97 @@
+package network
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/cox96de/containervm/util"
+	"github.com/vishvananda/netlink"
+	"gotest.tools/v3/assert"
+)
+
+func TestTapBridgeConfigure(t *testing.T) {
+	nicName := "vethb0"
+	clean := func() {
+		_, _ = util.Run("ip", "link", "del", nicName)
+		_, _ = util.Run("ip", "link", "del", "tapb0")
+		_, _ = util.Run("ip", "link", "del", "brb0")
+	}
+	clean()
+	t.Cleanup(clean)
+	output, err := util.Run("ip", "link", "add", nicName, "address", "02:00:00:00:00:02", "type", "veth",
+		"peer", "name", "vethb1")
+	assert.NilError(t, err, output)
+	for _, args := range [][]string{
+		{"link", "set", nicName, "up"},
+		{"link", "set", "vethb1", "up"},
+		{"addr", "add", "192.168.78.2/24", "dev", nicName},
+		{"route", "add", "10.78.0.0/16", "via", "192.168.78.1", "dev", nicName},
+	} {
+		output, err = util.Run("ip", args...)
+		assert.NilError(t, err, output)
+	}
+	newMac, _ := net.ParseMAC("02:00:00:00:00:03")
+	backend, err := NewBackend(BackendBridge, nicName, newMac, "tapb0", "brb0")
+	assert.NilError(t, err)
+	journal := filepath.Join(t.TempDir(), "network.json")
+	backend.SetJournal(journal)
+	assert.NilError(t, backend.Setup())
+	assert.Equal(t, backend.ServiceInterface(), "brb0")
+
+	nic, err := netlink.LinkByName(nicName)
+	assert.NilError(t, err)
+	bridge, err := netlink.LinkByName("brb0")
+	assert.NilError(t, err)
+	tap, err := netlink.LinkByName("tapb0")
+	assert.NilError(t, err)
+	assert.Equal(t, nic.Attrs().HardwareAddr.String(), newMac.String())
+	assert.Equal(t, nic.Attrs().MasterIndex, bridge.Attrs().Index)
+	assert.Equal(t, tap.Attrs().MasterIndex, bridge.Attrs().Index)
+	addrs, err := netlink.AddrList(nic, netlink.FAMILY_V4)
+	assert.NilError(t, err)
+	assert.Equal(t, len(addrs), 0)
+	addrs, err = netlink.AddrList(bridge, netlink.FAMILY_V4)
+	assert.NilError(t, err)
+	assert.Equal(t, len(addrs), 1)
+	assert.Equal(t, addrs[0].IPNet.String(), serviceIP)
+	tapFiles, err := backend.OpenTap(4)
+	assert.NilError(t, err)
+	assert.Equal(t, len(tapFiles), 4)
+	closeFiles(tapFiles)
+
+	// Recover as a new containervm does from the journal.
+	assert.NilError(t, RecoverFromJournal(journal))
+	assert.Assert(t, !JournalExists(journal))
+	for _, name := range []string{"tapb0", "brb0"} {
+		link, err := linkByNameIfExists(name)
+		assert.NilError(t, err)
+		assert.Assert(t, link == nil, name)
+	}
+	nic, err = netlink.LinkByName(nicName)
+	assert.NilError(t, err)
+	assert.Equal(t, nic.Attrs().HardwareAddr.String(), "02:00:00:00:00:02")
+	assert.Equal(t, nic.Attrs().MasterIndex, 0)
+	addrs, err = netlink.AddrList(nic, netlink.FAMILY_V4)
+	assert.NilError(t, err)
+	assert.Equal(t, len(addrs), 1)
+	assert.Equal(t, addrs[0].IPNet.String(), "192.168.78.2/24")
+	_, dst, _ := net.ParseCIDR("10.78.0.0/16")
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{LinkIndex: nic.Attrs().Index,
+		Dst: dst}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_DST)
+	assert.NilError(t, err)
+	assert.Equal(t, len(routes), 1)
+	// Recover is idempotent.
+	assert.NilError(t, backend.Recover())
+}
+
+func TestNewBackend(t *testing.T) {
+	backend, err := NewBackend("", "eth0", nil, "macvtap0", "macvlan0")
+	assert.NilError(t, err)
+	assert.Equal(t, backend.ServiceInterface(), "macvlan0")
+	backend, err = NewBackend(BackendIPVtap, "eth0", nil, "ipvtap0", "ipvlan0")
+	assert.NilError(t, err)
+	assert.Equal(t, backend.ServiceInterface(), "ipvlan0")
+	_, err = NewBackend("vxlan", "eth0", nil, "tap0", "br0")
+	assert.ErrorContains(t, err, "unknown network backend: vxlan")
+}
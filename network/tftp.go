@@ -0,0 +1,401 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	tftpPort = 69
+
+	tftpOpRRQ   = 1
+	tftpOpWRQ   = 2
+	tftpOpData  = 3
+	tftpOpAck   = 4
+	tftpOpError = 5
+	tftpOpOAck  = 6
+
+	tftpErrFileNotFound     = 1
+	tftpErrAccessViolation  = 2
+	tftpErrIllegalOperation = 4
+
+	tftpDefaultBlockSize = 512
+	tftpDefaultTimeout   = time.Second * 3
+	// tftpRetries is how many times a packet is sent before the transfer is given up.
+	tftpRetries = 5
+)
+
+// TFTPOption configures a TFTPServer.
+type TFTPOption struct {
+	// Root is the directory served. Files out of it are not accessible.
+	Root string
+	// IP is the address of the server, such as ServiceAddr. ServeARP must answer ARP requests for it with the
+	// hardware address of the interface, in case it's not assigned to the interface.
+	IP net.IP
+	// HardwareAddr is the MAC of the vm. Packets from others are ignored.
+	HardwareAddr net.HardwareAddr
+}
+
+// TFTPServer is a read-only TFTP server (RFC 1350) for the vm to boot from, it serves a directory on the macvlan
+// NIC. It supports the blksize, tsize and timeout options (RFC 2347, 2348 and 2349), which PXE ROMs use.
+type TFTPServer struct {
+	root         string
+	ip           net.IP
+	clientHwAddr net.HardwareAddr
+
+	conn *ipv4Conn
+	mu   sync.Mutex
+	// transfers are ongoing transfers by their local ports.
+	transfers map[int]*tftpTransfer
+}
+
+// NewTFTPServer creates a TFTPServer to serve `opt.Root`.
+func NewTFTPServer(opt *TFTPOption) (*TFTPServer, error) {
+	if opt.IP.To4() == nil {
+		return nil, errors.New("ipv6 is not supported")
+	}
+	root, err := filepath.Abs(opt.Root)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to get absolute path of %s", opt.Root)
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to stat tftp root %s", root)
+	}
+	if !info.IsDir() {
+		return nil, errors.Errorf("tftp root %s is not a directory", root)
+	}
+	return &TFTPServer{
+		root:         root,
+		ip:           opt.IP.To4(),
+		clientHwAddr: opt.HardwareAddr,
+		transfers:    map[int]*tftpTransfer{},
+	}, nil
+}
+
+// Run starts the server on the interface `ifName`. It stops when ctx is done, or returns ErrInterfaceGone when the
+// interface is deleted. Ongoing transfers are aborted before it returns.
+func (s *TFTPServer) Run(ctx context.Context, ifName string) error {
+	conn, err := dialIPv4(ifName)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+	s.conn = conn
+	if reserved := s.reservePort(tftpPort); reserved != nil {
+		defer reserved.Close()
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	log.Infof("tftp server started at %s:%d on %s, serving %s", s.ip, tftpPort, ifName, s.root)
+	guard := newReadGuard(ctx, conn.iface)
+	for {
+		_ = conn.SetReadDeadline(guard.deadline())
+		header, payload, srcHardwareAddr, err := conn.Read()
+		if err != nil {
+			if stop, err := guard.failed(err); stop {
+				return err
+			}
+			continue
+		}
+		guard.succeeded()
+		if header.Protocol != protocolUDP || !header.Dst.Equal(s.ip) {
+			continue
+		}
+		if !bytes.Equal(srcHardwareAddr, s.clientHwAddr) {
+			log.Debugf("get a tftp packet from %v, not from vm", srcHardwareAddr)
+			continue
+		}
+		srcPort, dstPort, udpPayload, err := parseUDP(payload)
+		if err != nil {
+			continue
+		}
+		// The buffer of conn is reused by the next Read.
+		udpPayload = append([]byte(nil), udpPayload...)
+		peer := &tftpPeer{
+			hardwareAddr: append(net.HardwareAddr(nil), srcHardwareAddr...),
+			ip:           header.Src,
+			port:         srcPort,
+		}
+		if dstPort == tftpPort {
+			s.startTransfer(ctx, &wg, peer, udpPayload)
+			continue
+		}
+		s.mu.Lock()
+		t := s.transfers[dstPort]
+		s.mu.Unlock()
+		if t == nil || t.peer.port != peer.port || !t.peer.ip.Equal(peer.ip) {
+			log.Debugf("get a tftp packet of unknown transfer from %s:%d to port %d", peer.ip, peer.port, dstPort)
+			continue
+		}
+		select {
+		case t.packets <- udpPayload:
+		default:
+			// The client sends faster than acks are handled, it will retransmit.
+		}
+	}
+}
+
+// startTransfer starts a transfer for the request `req` from `peer` on a new local port. The transfer is aborted
+// when ctx is done, `wg` waits for it.
+func (s *TFTPServer) startTransfer(ctx context.Context, wg *sync.WaitGroup, peer *tftpPeer, req []byte) {
+	reserved := s.reservePort(0)
+	s.mu.Lock()
+	port := 0
+	if reserved != nil {
+		port = reserved.LocalAddr().(*net.UDPAddr).Port
+	}
+	for port == 0 || s.transfers[port] != nil {
+		// The dynamic port range (RFC 6335).
+		port = 49152 + rand.Intn(65536-49152)
+	}
+	t := &tftpTransfer{ctx: ctx, s: s, peer: peer, port: port, packets: make(chan []byte, 8)}
+	s.transfers[port] = t
+	s.mu.Unlock()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			s.mu.Lock()
+			delete(s.transfers, port)
+			s.mu.Unlock()
+			if reserved != nil {
+				_ = reserved.Close()
+			}
+		}()
+		if err := t.serve(req); err != nil {
+			log.Warnf("tftp transfer to %s:%d failed: %+v", peer.ip, peer.port, err)
+		}
+	}()
+}
+
+// reservePort binds a UDP socket to `port` of the server, or a free port if it's zero. Packets are read from the
+// interface directly, but if the address of the server is assigned to the interface, such as ServiceAddr, the
+// kernel gets them as well, and answers ICMP port unreachable unless a socket is bound. It returns nil if the
+// address isn't local.
+func (s *TFTPServer) reservePort(port int) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: s.ip, Port: port})
+	if err != nil {
+		log.Debugf("not reserving port %d of %s: %v", port, s.ip, err)
+		return nil
+	}
+	return conn
+}
+
+// open opens `filename` in the root. Paths are relative to the root, so that ".." can't escape it.
+func (s *TFTPServer) open(filename string) (*os.File, int64, error) {
+	path := filepath.Join(s.root, filepath.Clean("/"+filename))
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, err
+	}
+	if info.IsDir() {
+		_ = f.Close()
+		return nil, 0, errors.Errorf("%s is a directory", path)
+	}
+	return f, info.Size(), nil
+}
+
+type tftpPeer struct {
+	hardwareAddr net.HardwareAddr
+	ip           net.IP
+	port         int
+}
+
+// tftpTransfer is a transfer of a file to a peer. The local port is the transfer identifier.
+type tftpTransfer struct {
+	ctx     context.Context
+	s       *TFTPServer
+	peer    *tftpPeer
+	port    int
+	packets chan []byte
+}
+
+func (t *tftpTransfer) serve(req []byte) error {
+	opcode, filename, mode, options, err := parseTFTPRequest(req)
+	if err != nil {
+		_ = t.sendError(tftpErrIllegalOperation, err.Error())
+		return err
+	}
+	if opcode == tftpOpWRQ {
+		_ = t.sendError(tftpErrAccessViolation, "write is not supported")
+		return errors.Errorf("the client tries to write %s", filename)
+	}
+	// netascii is sent as is, boot files are binary anyway.
+	if mode = strings.ToLower(mode); mode != "octet" && mode != "netascii" {
+		_ = t.sendError(tftpErrIllegalOperation, "unsupported mode "+mode)
+		return errors.Errorf("unsupported mode %s", mode)
+	}
+	f, size, err := t.s.open(filename)
+	if err != nil {
+		_ = t.sendError(tftpErrFileNotFound, "file not found")
+		return errors.WithMessagef(err, "failed to open %s", filename)
+	}
+	defer f.Close()
+	log.Infof("sending %s (%d bytes) to %s:%d by tftp", filename, size, t.peer.ip, t.peer.port)
+	blockSize, timeout, oack := t.negotiate(options, size)
+	if len(oack) > 0 {
+		if err = t.sendAndWait(marshalTFTPOAck(oack), 0, timeout); err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, blockSize)
+	// The block number rolls over to 0 after 65535, as most clients expect.
+	for block := uint16(1); ; block++ {
+		n, err := io.ReadFull(f, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			_ = t.sendError(tftpErrAccessViolation, "failed to read file")
+			return errors.WithMessagef(err, "failed to read %s", filename)
+		}
+		if err = t.sendAndWait(marshalTFTPData(block, buf[:n]), block, timeout); err != nil {
+			return err
+		}
+		// A block shorter than the block size ends the transfer.
+		if n < blockSize {
+			log.Infof("sent %s to %s:%d by tftp", filename, t.peer.ip, t.peer.port)
+			return nil
+		}
+	}
+}
+
+// negotiate accepts supported `options` of the request, and returns the options to be acknowledged by OACK.
+// `size` is the size of the file for the tsize option.
+func (t *tftpTransfer) negotiate(options map[string]string, size int64) (blockSize int, timeout time.Duration,
+	oack [][2]string) {
+	blockSize, timeout = tftpDefaultBlockSize, tftpDefaultTimeout
+	if v, ok := options["blksize"]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n >= 8 && n <= 65464 {
+			// A block must fit in a frame, IP fragments are not handled.
+			if maxBlockSize := t.s.conn.iface.MTU - 32; n > maxBlockSize {
+				n = maxBlockSize
+			}
+			blockSize = n
+			oack = append(oack, [2]string{"blksize", strconv.Itoa(n)})
+		}
+	}
+	if v, ok := options["tsize"]; ok && v == "0" {
+		oack = append(oack, [2]string{"tsize", strconv.FormatInt(size, 10)})
+	}
+	if v, ok := options["timeout"]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n >= 1 && n <= 255 {
+			timeout = time.Duration(n) * time.Second
+			oack = append(oack, [2]string{"timeout", v})
+		}
+	}
+	return blockSize, timeout, oack
+}
+
+// sendAndWait sends `packet` until the ack of `block` is received.
+func (t *tftpTransfer) sendAndWait(packet []byte, block uint16, timeout time.Duration) error {
+	for i := 0; i < tftpRetries; i++ {
+		if err := t.send(packet); err != nil {
+			return err
+		}
+		timer := time.NewTimer(timeout)
+	wait:
+		for {
+			select {
+			case p := <-t.packets:
+				if len(p) < 4 {
+					continue
+				}
+				switch binary.BigEndian.Uint16(p[0:2]) {
+				case tftpOpAck:
+					// Duplicate acks are ignored, resending on them doubles every packet afterward.
+					if binary.BigEndian.Uint16(p[2:4]) == block {
+						timer.Stop()
+						return nil
+					}
+				case tftpOpError:
+					timer.Stop()
+					return errors.Errorf("the client aborted the transfer: %s", bytes.TrimRight(p[4:], "\x00"))
+				}
+			case <-timer.C:
+				break wait
+			case <-t.ctx.Done():
+				timer.Stop()
+				return errors.New("the server is stopped")
+			}
+		}
+	}
+	return errors.Errorf("timed out waiting for the ack of block %d", block)
+}
+
+func (t *tftpTransfer) send(payload []byte) error {
+	s := t.s
+	udp := marshalUDP(s.ip, t.peer.ip, t.port, t.peer.port, payload)
+	if err := s.conn.Write(t.peer.hardwareAddr, s.ip, t.peer.ip, protocolUDP, 64, udp); err != nil {
+		return errors.WithMessage(err, "failed to send tftp packet")
+	}
+	return nil
+}
+
+func (t *tftpTransfer) sendError(code uint16, msg string) error {
+	b := make([]byte, 4, 5+len(msg))
+	binary.BigEndian.PutUint16(b[0:2], tftpOpError)
+	binary.BigEndian.PutUint16(b[2:4], code)
+	b = append(append(b, msg...), 0)
+	return t.send(b)
+}
+
+// parseTFTPRequest parses a read or write request. Names of options are lowercased.
+func parseTFTPRequest(b []byte) (opcode uint16, filename, mode string, options map[string]string, err error) {
+	if len(b) < 4 || b[len(b)-1] != 0 {
+		return 0, "", "", nil, errors.New("malformed request")
+	}
+	opcode = binary.BigEndian.Uint16(b[0:2])
+	if opcode != tftpOpRRQ && opcode != tftpOpWRQ {
+		return 0, "", "", nil, errors.Errorf("unexpected opcode %d", opcode)
+	}
+	fields := strings.Split(string(b[2:len(b)-1]), "\x00")
+	if len(fields) < 2 || len(fields)%2 != 0 {
+		return 0, "", "", nil, errors.New("malformed request")
+	}
+	options = map[string]string{}
+	for i := 2; i < len(fields); i += 2 {
+		options[strings.ToLower(fields[i])] = fields[i+1]
+	}
+	return opcode, fields[0], fields[1], options, nil
+}
+
+func marshalTFTPData(block uint16, data []byte) []byte {
+	b := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint16(b[0:2], tftpOpData)
+	binary.BigEndian.PutUint16(b[2:4], block)
+	copy(b[4:], data)
+	return b
+}
+
+func marshalTFTPOAck(options [][2]string) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b[0:2], tftpOpOAck)
+	for _, opt := range options {
+		b = append(append(b, opt[0]...), 0)
+		b = append(append(b, opt[1]...), 0)
+	}
+	return b
+}
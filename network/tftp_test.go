@@ -0,0 +1,190 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cox96de/containervm/util"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"gotest.tools/v3/assert"
+)
+
+// inNetns runs `f` in the network namespace `name`. Sockets created by `f` stay in the namespace.
+func inNetns(t *testing.T, name string, f func()) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := os.Open("/proc/thread-self/ns/net")
+	assert.NilError(t, err)
+	defer origin.Close()
+	ns, err := os.Open(filepath.Join("/var/run/netns", name))
+	assert.NilError(t, err)
+	defer ns.Close()
+	assert.NilError(t, unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET))
+	defer func() {
+		assert.NilError(t, unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET))
+	}()
+	f()
+}
+
+// tftpGet reads `filename` from the TFTP server at `server` by `conn`. `options` are pairs of names and values.
+func tftpGet(conn net.PacketConn, server net.IP, filename string, options ...string) (data []byte,
+	oack map[string]string, err error) {
+	req := binary.BigEndian.AppendUint16(nil, tftpOpRRQ)
+	for _, field := range append([]string{filename, "octet"}, options...) {
+		req = append(append(req, field...), 0)
+	}
+	if _, err = conn.WriteTo(req, &net.UDPAddr{IP: server, Port: tftpPort}); err != nil {
+		return nil, nil, err
+	}
+	blockSize := tftpDefaultBlockSize
+	buf := make([]byte, 65536)
+	for {
+		if err = conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			return nil, nil, err
+		}
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		p := buf[:n]
+		var block uint16
+		switch binary.BigEndian.Uint16(p[0:2]) {
+		case tftpOpOAck:
+			oack = map[string]string{}
+			fields := bytes.Split(bytes.TrimSuffix(p[2:], []byte{0}), []byte{0})
+			for i := 0; i+1 < len(fields); i += 2 {
+				oack[string(fields[i])] = string(fields[i+1])
+			}
+			if oack["blksize"] != "" {
+				blockSize, _ = strconv.Atoi(oack["blksize"])
+			}
+		case tftpOpData:
+			block = binary.BigEndian.Uint16(p[2:4])
+			data = append(data, p[4:]...)
+		case tftpOpError:
+			return nil, nil, errors.Errorf("error %d: %s", binary.BigEndian.Uint16(p[2:4]), p[4:n-1])
+		}
+		ack := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, tftpOpAck), block)
+		if _, err = conn.WriteTo(ack, peer); err != nil {
+			return nil, nil, err
+		}
+		if block > 0 && n-4 < blockSize {
+			return data, oack, nil
+		}
+	}
+}
+
+func TestTFTPServer(t *testing.T) {
+	nsName := "tftp-client"
+	clientIface := "vetht0"
+	serverIface := "vetht1"
+	hw, _ := net.ParseMAC("12:34:56:78:9a:50")
+	clean := func() {
+		_, _ = util.Run("ip", "netns", "del", nsName)
+		_, _ = util.Run("ip", "link", "del", serverIface)
+	}
+	clean()
+	t.Cleanup(clean)
+	for _, args := range [][]string{
+		{"netns", "add", nsName},
+		{"link", "add", clientIface, "address", hw.String(), "type", "veth", "peer", "name", serverIface},
+		{"link", "set", clientIface, "netns", nsName},
+		{"-n", nsName, "addr", "add", "192.168.50.3/24", "dev", clientIface},
+		{"-n", nsName, "link", "set", clientIface, "up"},
+		// Like the vm, the client reaches the server by an on-link route.
+		{"-n", nsName, "route", "add", serviceIP, "dev", clientIface},
+		{"addr", "add", serviceIP, "dev", serverIface},
+		{"link", "set", serverIface, "up"},
+	} {
+		output, err := util.Run("ip", args...)
+		assert.NilError(t, err, output)
+	}
+	root := t.TempDir()
+	bootFile := make([]byte, 3000)
+	rand.Read(bootFile)
+	assert.NilError(t, os.MkdirAll(filepath.Join(root, "boot"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(root, "boot", "ipxe.efi"), bootFile, 0o644))
+	aligned := bytes.Repeat([]byte{'a'}, tftpDefaultBlockSize*2)
+	assert.NilError(t, os.WriteFile(filepath.Join(root, "aligned"), aligned, 0o644))
+
+	serverIP := ServiceAddr()
+	s, err := NewTFTPServer(&TFTPOption{Root: root, IP: serverIP, HardwareAddr: hw})
+	assert.NilError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		_ = s.Run(ctx, serverIface)
+	}()
+	go func() {
+		addr := &net.IPNet{IP: net.ParseIP("192.168.50.3"), Mask: net.CIDRMask(24, 32)}
+		_ = ServeARP(ctx, serverIface, &ARPOption{HardwareAddr: hw, Addr: addr, LocalIPs: []net.IP{serverIP}})
+	}()
+	// Wait for servers to start
+	time.Sleep(time.Millisecond * 50)
+	// The port is reserved, so that the kernel doesn't answer ICMP port unreachable.
+	_, err = net.ListenUDP("udp4", &net.UDPAddr{IP: serverIP, Port: tftpPort})
+	assert.Assert(t, errors.Is(err, unix.EADDRINUSE), err)
+	var conn net.PacketConn
+	inNetns(t, nsName, func() {
+		conn, err = net.ListenPacket("udp4", "192.168.50.3:0")
+		assert.NilError(t, err)
+	})
+	defer conn.Close()
+
+	t.Run("options", func(t *testing.T) {
+		data, oack, err := tftpGet(conn, serverIP, "/boot/ipxe.efi", "blksize", "1024", "tsize", "0")
+		assert.NilError(t, err)
+		assert.DeepEqual(t, oack, map[string]string{"blksize": "1024", "tsize": "3000"})
+		assert.DeepEqual(t, data, bootFile)
+	})
+	t.Run("aligned", func(t *testing.T) {
+		// The transfer ends with an empty block.
+		data, oack, err := tftpGet(conn, serverIP, "aligned")
+		assert.NilError(t, err)
+		assert.Assert(t, oack == nil)
+		assert.DeepEqual(t, data, aligned)
+	})
+	t.Run("blksize_over_mtu", func(t *testing.T) {
+		data, oack, err := tftpGet(conn, serverIP, "boot/ipxe.efi", "blksize", "8192")
+		assert.NilError(t, err)
+		assert.Equal(t, oack["blksize"], "1468")
+		assert.DeepEqual(t, data, bootFile)
+	})
+	t.Run("escape_root", func(t *testing.T) {
+		_, _, err := tftpGet(conn, serverIP, "../../etc/passwd")
+		assert.ErrorContains(t, err, "error 1: file not found")
+	})
+	t.Run("directory", func(t *testing.T) {
+		_, _, err := tftpGet(conn, serverIP, "boot")
+		assert.ErrorContains(t, err, "error 1: file not found")
+	})
+	t.Run("write", func(t *testing.T) {
+		req := binary.BigEndian.AppendUint16(nil, tftpOpWRQ)
+		req = append(req, "boot/ipxe.efi\x00octet\x00"...)
+		_, err := conn.WriteTo(req, &net.UDPAddr{IP: serverIP, Port: tftpPort})
+		assert.NilError(t, err)
+		buf := make([]byte, 1024)
+		assert.NilError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		assert.NilError(t, err)
+		assert.Equal(t, binary.BigEndian.Uint16(buf[0:2]), uint16(tftpOpError))
+		assert.Equal(t, binary.BigEndian.Uint16(buf[2:4]), uint16(tftpErrAccessViolation))
+		assert.Equal(t, n, 4+len("write is not supported")+1)
+	})
+	t.Run("other_mac", func(t *testing.T) {
+		output, err := util.Run("ip", "-n", nsName, "link", "set", clientIface, "address", "12:34:56:78:9a:51")
+		assert.NilError(t, err, output)
+		_, _, err = tftpGet(conn, serverIP, "boot/ipxe.efi")
+		assert.ErrorContains(t, err, "i/o timeout")
+	})
+}
@@ -0,0 +1,292 @@
+// Package portforward proxies TCP connections and UDP datagrams from a listen address to a target address.
+package portforward
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// udpSessionTimeout is how long a UDP session without traffic is kept.
+const udpSessionTimeout = time.Minute
+
+// udpBufferSize is enough for any UDP datagram.
+const udpBufferSize = 65536
+
+// Stats are the connection metrics of a Forwarder. A UDP session counts as a connection.
+type Stats struct {
+	// Active is the number of open connections.
+	Active int64
+	// Total is the number of accepted connections.
+	Total int64
+	// Failed is the number of connections which couldn't reach the target.
+	Failed int64
+	// BytesIn is the number of bytes sent from clients to the target.
+	BytesIn int64
+	// BytesOut is the number of bytes sent from the target to clients.
+	BytesOut int64
+}
+
+// Forwarder proxies a protocol from a listen address to a target address.
+type Forwarder struct {
+	protocol   string
+	listenAddr string
+	targetAddr string
+
+	listener   net.Listener
+	packetConn net.PacketConn
+
+	active   atomic.Int64
+	total    atomic.Int64
+	failed   atomic.Int64
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	mu     sync.Mutex
+	conns  map[io.Closer]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Listen creates a Forwarder of `protocol` (tcp or udp) listening on `listenAddr`, which proxies to `targetAddr`.
+// Call Serve to start proxying.
+func Listen(protocol, listenAddr, targetAddr string) (*Forwarder, error) {
+	f := &Forwarder{protocol: protocol, targetAddr: targetAddr, conns: map[io.Closer]struct{}{}}
+	var err error
+	switch protocol {
+	case "tcp":
+		f.listener, err = net.Listen("tcp", listenAddr)
+		if err == nil {
+			f.listenAddr = f.listener.Addr().String()
+		}
+	case "udp":
+		f.packetConn, err = net.ListenPacket("udp", listenAddr)
+		if err == nil {
+			f.listenAddr = f.packetConn.LocalAddr().String()
+		}
+	default:
+		return nil, errors.Errorf("unsupported protocol: %s", protocol)
+	}
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to listen on %s/%s", listenAddr, protocol)
+	}
+	return f, nil
+}
+
+// Addr returns the address the Forwarder listens on.
+func (f *Forwarder) Addr() string {
+	return f.listenAddr
+}
+
+// Stats returns the connection metrics of the Forwarder.
+func (f *Forwarder) Stats() Stats {
+	return Stats{
+		Active:   f.active.Load(),
+		Total:    f.total.Load(),
+		Failed:   f.failed.Load(),
+		BytesIn:  f.bytesIn.Load(),
+		BytesOut: f.bytesOut.Load(),
+	}
+}
+
+// Serve proxies until Close is called. It always returns a non-nil error, which is net.ErrClosed after Close.
+func (f *Forwarder) Serve() error {
+	if f.protocol == "tcp" {
+		return f.serveTCP()
+	}
+	return f.serveUDP()
+}
+
+// Close stops listening, closes all connections and waits for proxying goroutines to exit.
+func (f *Forwarder) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	var err error
+	if f.listener != nil {
+		err = f.listener.Close()
+	} else {
+		err = f.packetConn.Close()
+	}
+	for conn := range f.conns {
+		_ = conn.Close()
+	}
+	f.mu.Unlock()
+	f.wg.Wait()
+	return err
+}
+
+// track registers `conns` to be closed by Close. It returns false if the Forwarder is closed already.
+func (f *Forwarder) track(conns ...io.Closer) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return false
+	}
+	for _, conn := range conns {
+		f.conns[conn] = struct{}{}
+	}
+	f.wg.Add(1)
+	return true
+}
+
+// untrack closes `conns` and marks a proxying goroutine done.
+func (f *Forwarder) untrack(conns ...io.Closer) {
+	f.mu.Lock()
+	for _, conn := range conns {
+		_ = conn.Close()
+		delete(f.conns, conn)
+	}
+	f.mu.Unlock()
+	f.wg.Done()
+}
+
+func (f *Forwarder) serveTCP() error {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return err
+		}
+		f.total.Add(1)
+		target, err := net.Dial("tcp", f.targetAddr)
+		if err != nil {
+			f.failed.Add(1)
+			log.Warnf("failed to forward %s to %s: %+v", conn.RemoteAddr(), f.targetAddr, err)
+			_ = conn.Close()
+			continue
+		}
+		if !f.track(conn, target) {
+			_ = conn.Close()
+			_ = target.Close()
+			continue
+		}
+		f.active.Add(1)
+		go func() {
+			defer f.active.Add(-1)
+			defer f.untrack(conn, target)
+			f.proxyTCP(conn.(*net.TCPConn), target.(*net.TCPConn))
+		}()
+	}
+}
+
+// proxyTCP copies both directions until both are done, half-closing a direction when its source is done.
+func (f *Forwarder) proxyTCP(client, target *net.TCPConn) {
+	done := make(chan struct{})
+	go func() {
+		n, _ := io.Copy(target, client)
+		f.bytesIn.Add(n)
+		_ = target.CloseWrite()
+		close(done)
+	}()
+	n, _ := io.Copy(client, target)
+	f.bytesOut.Add(n)
+	_ = client.CloseWrite()
+	<-done
+}
+
+// udpSession is the upstream of a UDP peer. lastSeen is guarded by the mutex of the sessions.
+type udpSession struct {
+	target   net.Conn
+	lastSeen time.Time
+}
+
+func (f *Forwarder) serveUDP() error {
+	var (
+		mu       sync.Mutex
+		sessions = map[string]*udpSession{}
+	)
+	// remove removes `session` of `peer` if it's still there. If `idle` is true, it's only removed without
+	// datagrams from the peer for udpSessionTimeout. Sessions are removed before they are closed, so that datagrams
+	// are never written to a closing session.
+	remove := func(peer net.Addr, session *udpSession, idle bool) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if idle && time.Since(session.lastSeen) < udpSessionTimeout {
+			return false
+		}
+		if sessions[peer.String()] == session {
+			delete(sessions, peer.String())
+		}
+		return true
+	}
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, peer, err := f.packetConn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		// The lock is held across lookup-or-create and write, so that a session can't be removed in between.
+		mu.Lock()
+		session, ok := sessions[peer.String()]
+		if !ok {
+			session = f.dialUDP(peer)
+			if session == nil {
+				mu.Unlock()
+				continue
+			}
+			sessions[peer.String()] = session
+			f.active.Add(1)
+			go func(peer net.Addr, session *udpSession) {
+				defer f.active.Add(-1)
+				defer f.untrack(session.target)
+				defer remove(peer, session, false)
+				f.replyUDP(peer, session.target, func() bool {
+					return remove(peer, session, true)
+				})
+			}(peer, session)
+		}
+		session.lastSeen = time.Now()
+		_, err = session.target.Write(buf[:n])
+		mu.Unlock()
+		if err != nil {
+			log.Debugf("failed to forward a datagram from %s to %s: %+v", peer, f.targetAddr, err)
+			continue
+		}
+		f.bytesIn.Add(int64(n))
+	}
+}
+
+// dialUDP creates a session for `peer`, or returns nil if it fails or the Forwarder is closed.
+func (f *Forwarder) dialUDP(peer net.Addr) *udpSession {
+	f.total.Add(1)
+	target, err := net.Dial("udp", f.targetAddr)
+	if err != nil {
+		f.failed.Add(1)
+		log.Warnf("failed to forward %s to %s: %+v", peer, f.targetAddr, err)
+		return nil
+	}
+	if !f.track(target) {
+		_ = target.Close()
+		return nil
+	}
+	return &udpSession{target: target}
+}
+
+// replyUDP sends datagrams from the target back to `peer`, until the session is closed, or neither side sends
+// for udpSessionTimeout and `expire` removes it.
+func (f *Forwarder) replyUDP(peer net.Addr, target net.Conn, expire func() bool) {
+	buf := make([]byte, udpBufferSize)
+	for {
+		_ = target.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+		n, err := target.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) && !expire() {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if _, err := f.packetConn.WriteTo(buf[:n], peer); err != nil {
+			return
+		}
+		f.bytesOut.Add(int64(n))
+	}
+}
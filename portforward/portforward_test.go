@@ -0,0 +1,132 @@
+package portforward
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+)
+
+func TestForwardTCP(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	f, err := Listen("tcp", "127.0.0.1:0", echo.Addr().String())
+	assert.NilError(t, err)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- f.Serve()
+	}()
+	conn, err := net.Dial("tcp", f.Addr())
+	assert.NilError(t, err)
+	_, err = conn.Write([]byte("hello"))
+	assert.NilError(t, err)
+	assert.NilError(t, conn.(*net.TCPConn).CloseWrite())
+	reply, err := io.ReadAll(conn)
+	assert.NilError(t, err)
+	assert.Equal(t, string(reply), "hello")
+	poll.WaitOn(t, func(t poll.LogT) poll.Result {
+		if f.Stats().Active != 0 {
+			return poll.Continue("connection is still active")
+		}
+		return poll.Success()
+	})
+	assert.DeepEqual(t, f.Stats(), Stats{Total: 1, BytesIn: 5, BytesOut: 5})
+
+	// Close closes open connections.
+	conn, err = net.Dial("tcp", f.Addr())
+	assert.NilError(t, err)
+	poll.WaitOn(t, func(t poll.LogT) poll.Result {
+		if f.Stats().Active != 1 {
+			return poll.Continue("connection is not accepted")
+		}
+		return poll.Success()
+	})
+	assert.NilError(t, f.Close())
+	assert.Assert(t, errors.Is(<-serveErr, net.ErrClosed))
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, err, io.EOF)
+	assert.Equal(t, f.Stats().Active, int64(0))
+}
+
+func TestForwardTCPUnreachable(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	// Nothing listens on the target.
+	assert.NilError(t, target.Close())
+	f, err := Listen("tcp", "127.0.0.1:0", target.Addr().String())
+	assert.NilError(t, err)
+	defer f.Close()
+	go func() {
+		_ = f.Serve()
+	}()
+	conn, err := net.Dial("tcp", f.Addr())
+	assert.NilError(t, err)
+	_, err = io.ReadAll(conn)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, f.Stats(), Stats{Total: 1, Failed: 1})
+}
+
+func TestForwardUDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, peer, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], peer)
+		}
+	}()
+	f, err := Listen("udp", "127.0.0.1:0", echo.LocalAddr().String())
+	assert.NilError(t, err)
+	go func() {
+		_ = f.Serve()
+	}()
+	conn, err := net.Dial("udp", f.Addr())
+	assert.NilError(t, err)
+	defer conn.Close()
+	buf := make([]byte, 1500)
+	for _, msg := range []string{"hello", "world"} {
+		_, err = conn.Write([]byte(msg))
+		assert.NilError(t, err)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		n, err := conn.Read(buf)
+		assert.NilError(t, err)
+		assert.Equal(t, string(buf[:n]), msg)
+	}
+	poll.WaitOn(t, func(t poll.LogT) poll.Result {
+		if f.Stats().BytesOut != 10 {
+			return poll.Continue("replies are not counted")
+		}
+		return poll.Success()
+	})
+	assert.DeepEqual(t, f.Stats(), Stats{Active: 1, Total: 1, BytesIn: 10, BytesOut: 10})
+	assert.NilError(t, f.Close())
+	assert.Equal(t, f.Stats().Active, int64(0))
+}
+
+func TestListenUnsupportedProtocol(t *testing.T) {
+	_, err := Listen("sctp", "127.0.0.1:0", "127.0.0.1:22")
+	assert.ErrorContains(t, err, "unsupported protocol: sctp")
+}
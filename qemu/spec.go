@@ -0,0 +1,234 @@
+// Package qemu builds qemu command lines from a declarative VM spec.
+package qemu
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultBinary is the qemu binary used when Spec.Binary is empty.
+const DefaultBinary = "qemu-system-x86_64"
+
+// DefaultMachine is the machine type used when Spec.Machine is empty.
+const DefaultMachine = "q35"
+
+// Spec describes a VM. It's usually loaded from a yaml file by LoadSpec.
+type Spec struct {
+	// Binary is the qemu binary. Empty means DefaultBinary.
+	Binary string `yaml:"binary,omitempty"`
+	// CPUs is the number of vCPUs. Zero means the default of qemu.
+	CPUs int `yaml:"cpus,omitempty"`
+	// Memory is the size of the guest RAM, in the format of qemu `-m`, such as 1024M or 2G.
+	// Empty means the default of qemu.
+	Memory string `yaml:"memory,omitempty"`
+	// Machine is the machine type. Empty means DefaultMachine.
+	Machine string `yaml:"machine,omitempty"`
+	// Firmware is the path of the BIOS or UEFI firmware. Empty means the default of qemu (SeaBIOS).
+	Firmware string `yaml:"firmware,omitempty"`
+	// Disks are attached as virtio block devices, in order.
+	Disks []*Disk `yaml:"disks,omitempty"`
+	// CDROMs are attached as read-only cdrom drives, in order.
+	CDROMs []*CDROM `yaml:"cdroms,omitempty"`
+	// Serial connects the first serial port to a unix socket.
+	Serial *Serial `yaml:"serial,omitempty"`
+	// VNC serves the display by VNC on a unix socket.
+	VNC *VNC `yaml:"vnc,omitempty"`
+	// ExtraArgs are appended to the command line as is.
+	ExtraArgs []string `yaml:"extraArgs,omitempty"`
+	// Network configures how the VM is connected to the network. It doesn't affect Args,
+	// the network options are generated by the launcher.
+	Network *Network `yaml:"network,omitempty"`
+}
+
+// Network is the network section of a Spec.
+type Network struct {
+	// Mode is the network mode of the launcher, such as pod or user.
+	Mode string `yaml:"mode,omitempty"`
+	// Forwards are port forwards in the format of "$PROTOCOL:$HOST_PORT:$GUEST_PORT", such as "tcp:2222:22".
+	Forwards []string `yaml:"forwards,omitempty"`
+	// DHCP configures the DHCP server of the VM in the pod mode.
+	DHCP *DHCP `yaml:"dhcp,omitempty"`
+	// PXE configures network boot in the pod mode.
+	PXE *PXE `yaml:"pxe,omitempty"`
+	// GratuitousARPCount is how many gratuitous ARP packets are sent for each address of the VM in the pod mode
+	// once the VM gets it. Zero disables them, nil means the default of the launcher.
+	GratuitousARPCount *int `yaml:"gratuitousARPCount,omitempty"`
+}
+
+// DHCP is the dhcp section of Network. Options detected from the pod, such as the MTU, are filled in by
+// the launcher.
+type DHCP struct {
+	// NTPServers are IP addresses of NTP servers.
+	NTPServers []string `yaml:"ntpServers,omitempty"`
+	// DomainName is the domain name of the VM. Empty means the first search domain of the pod.
+	DomainName string `yaml:"domainName,omitempty"`
+	// LeaseTime is the lease time of the address, such as 1h. Zero means infinite.
+	LeaseTime time.Duration `yaml:"leaseTime,omitempty"`
+	// RenewalTime and RebindingTime are T1 and T2 of the lease. Zero means the VM derives them from LeaseTime.
+	RenewalTime   time.Duration `yaml:"renewalTime,omitempty"`
+	RebindingTime time.Duration `yaml:"rebindingTime,omitempty"`
+	// Options are raw options in the format of "$CODE:$VALUE", such as "252:http://wpad/wpad.dat".
+	Options []string `yaml:"options,omitempty"`
+}
+
+// PXE is the pxe section of Network. The NIC must be in the boot order, such as by `-boot n` in ExtraArgs.
+type PXE struct {
+	// BootFile is the file PXE ROMs boot from, such as undionly.kpxe or ipxe.efi.
+	BootFile string `yaml:"bootFile,omitempty"`
+	// IPXEScript is handed to iPXE instead of BootFile, such as http://10.0.0.1/boot.ipxe.
+	IPXEScript string `yaml:"ipxeScript,omitempty"`
+	// TFTPRoot is the directory served to the VM by the built-in TFTP server.
+	TFTPRoot string `yaml:"tftpRoot,omitempty"`
+	// BootServer is the IP address of an external boot server, exclusive with TFTPRoot.
+	BootServer string `yaml:"bootServer,omitempty"`
+}
+
+// Disk is a disk image of the VM.
+type Disk struct {
+	// File is the path of the image.
+	File string `yaml:"file"`
+	// Format is the image format, such as qcow2 or raw. Empty means qemu probes it.
+	Format string `yaml:"format,omitempty"`
+	// Cache is the cache mode, such as none, writeback or unsafe. Empty means the default of qemu.
+	Cache string `yaml:"cache,omitempty"`
+	// Snapshot discards writes to the image when qemu exits.
+	Snapshot bool `yaml:"snapshot,omitempty"`
+	// ReadOnly attaches the image read-only.
+	ReadOnly bool `yaml:"readOnly,omitempty"`
+}
+
+// CDROM is an iso image of the VM.
+type CDROM struct {
+	// File is the path of the iso.
+	File string `yaml:"file"`
+}
+
+// Serial is the serial console of the VM.
+type Serial struct {
+	// Socket is the path of the unix socket, which is served by qemu.
+	Socket string `yaml:"socket"`
+}
+
+// VNC is the VNC display of the VM.
+type VNC struct {
+	// Socket is the path of the unix socket, which is served by qemu.
+	Socket string `yaml:"socket"`
+}
+
+// LoadSpec reads a Spec from the yaml file at `path` and validates it.
+func LoadSpec(path string) (*Spec, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read spec %s", path)
+	}
+	spec := &Spec{}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	// An empty file is an empty spec.
+	if err := decoder.Decode(spec); err != nil && !errors.Is(err, io.EOF) {
+		return nil, errors.WithMessagef(err, "failed to parse spec %s", path)
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, errors.WithMessagef(err, "invalid spec %s", path)
+	}
+	return spec, nil
+}
+
+// Validate checks that the spec can be built into a command line.
+func (s *Spec) Validate() error {
+	if s.CPUs < 0 {
+		return errors.Errorf("cpus must not be negative: %d", s.CPUs)
+	}
+	for i, disk := range s.Disks {
+		if disk == nil || disk.File == "" {
+			return errors.Errorf("file of disk %d is required", i)
+		}
+	}
+	for i, cdrom := range s.CDROMs {
+		if cdrom == nil || cdrom.File == "" {
+			return errors.Errorf("file of cdrom %d is required", i)
+		}
+	}
+	if s.Serial != nil && s.Serial.Socket == "" {
+		return errors.New("socket of serial is required")
+	}
+	if s.VNC != nil && s.VNC.Socket == "" {
+		return errors.New("socket of vnc is required")
+	}
+	return nil
+}
+
+// Args builds the qemu command line of the spec, starting with the binary.
+// `devices` such as network options are appended before ExtraArgs, so that ExtraArgs come last.
+func (s *Spec) Args(devices ...string) ([]string, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	binary := s.Binary
+	if binary == "" {
+		binary = DefaultBinary
+	}
+	machine := s.Machine
+	if machine == "" {
+		machine = DefaultMachine
+	}
+	args := []string{binary, "-nodefaults", "-display", "none", "-machine", "type=" + machine + ",usb=off"}
+	if s.CPUs > 0 {
+		cpus := strconv.Itoa(s.CPUs)
+		args = append(args, "-smp", cpus+",sockets=1,cores="+cpus+",threads=1")
+	}
+	if s.Memory != "" {
+		args = append(args, "-m", s.Memory)
+	}
+	if s.Firmware != "" {
+		args = append(args, "-bios", s.Firmware)
+	}
+	args = append(args, "-device", "virtio-balloon-pci,id=balloon0")
+	for _, disk := range s.Disks {
+		args = append(args, "-drive", disk.driveOpt())
+	}
+	for _, cdrom := range s.CDROMs {
+		args = append(args, "-drive", "file="+escapeOpt(cdrom.File)+",format=raw,media=cdrom,readonly=on")
+	}
+	if s.Serial != nil {
+		args = append(args, "-serial", "chardev:serial0",
+			"-chardev", "socket,id=serial0,path="+escapeOpt(s.Serial.Socket)+",server=on,wait=off")
+	}
+	if s.VNC != nil {
+		args = append(args, "-vnc", "unix:"+escapeOpt(s.VNC.Socket), "-device", "VGA")
+	}
+	args = append(args, devices...)
+	args = append(args, s.ExtraArgs...)
+	return args, nil
+}
+
+func (d *Disk) driveOpt() string {
+	opts := []string{"file=" + escapeOpt(d.File)}
+	if d.Format != "" {
+		opts = append(opts, "format="+d.Format)
+	}
+	opts = append(opts, "if=virtio", "aio=threads", "media=disk")
+	if d.Cache != "" {
+		opts = append(opts, "cache="+d.Cache)
+	}
+	if d.Snapshot {
+		opts = append(opts, "snapshot=on")
+	}
+	if d.ReadOnly {
+		opts = append(opts, "readonly=on")
+	}
+	return strings.Join(opts, ",")
+}
+
+// escapeOpt escapes `value` of a suboption in a qemu option string, where commas separate suboptions and are
+// written as ",,".
+func escapeOpt(value string) string {
+	return strings.ReplaceAll(value, ",", ",,")
+}
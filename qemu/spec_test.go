@@ -0,0 +1,68 @@
+package qemu
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/golden"
+)
+
+// networkOpt is what vm appends to the spec for the pod network.
+var networkOpt = []string{"-netdev", "tap,id=net0,vhost=on,fd=3",
+	"-device", "virtio-net-pci,netdev=net0,mac=02:42:ac:11:00:02,host_mtu=1500"}
+
+func TestSpecArgs(t *testing.T) {
+	for _, name := range []string{"full", "minimal"} {
+		t.Run(name, func(t *testing.T) {
+			spec, err := LoadSpec(filepath.Join("testdata", name+".yaml"))
+			assert.NilError(t, err)
+			args, err := spec.Args(networkOpt...)
+			assert.NilError(t, err)
+			// One argument per line, to keep golden files readable.
+			golden.Assert(t, strings.Join(args, "\n")+"\n", name+".golden")
+		})
+	}
+}
+
+func TestLoadSpec(t *testing.T) {
+	write := func(content string) string {
+		path := filepath.Join(t.TempDir(), "vm.yaml")
+		assert.NilError(t, os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+	t.Run("empty", func(t *testing.T) {
+		spec, err := LoadSpec(write(""))
+		assert.NilError(t, err)
+		args, err := spec.Args()
+		assert.NilError(t, err)
+		assert.DeepEqual(t, args, []string{"qemu-system-x86_64", "-nodefaults", "-display", "none",
+			"-machine", "type=q35,usb=off", "-device", "virtio-balloon-pci,id=balloon0"})
+	})
+	t.Run("unknown_field", func(t *testing.T) {
+		_, err := LoadSpec(write("cpu: 2\n"))
+		assert.ErrorContains(t, err, "field cpu not found")
+	})
+	t.Run("disk_without_file", func(t *testing.T) {
+		_, err := LoadSpec(write("disks:\n  - format: qcow2\n"))
+		assert.ErrorContains(t, err, "file of disk 0 is required")
+	})
+	t.Run("negative_cpus", func(t *testing.T) {
+		_, err := LoadSpec(write("cpus: -1\n"))
+		assert.ErrorContains(t, err, "cpus must not be negative")
+	})
+	t.Run("dhcp", func(t *testing.T) {
+		spec, err := LoadSpec(write("network:\n  dhcp:\n    leaseTime: 1h\n    renewalTime: 30m\n" +
+			"    options:\n      - 252:http://wpad/wpad.dat\n"))
+		assert.NilError(t, err)
+		assert.DeepEqual(t, spec.Network.DHCP, &DHCP{LeaseTime: time.Hour, RenewalTime: 30 * time.Minute,
+			Options: []string{"252:http://wpad/wpad.dat"}})
+	})
+	t.Run("not_exist", func(t *testing.T) {
+		_, err := LoadSpec(filepath.Join(t.TempDir(), "vm.yaml"))
+		assert.ErrorContains(t, err, "failed to read spec")
+	})
+}
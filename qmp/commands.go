@@ -0,0 +1,71 @@
+package qmp
+
+import "context"
+
+// Status is the run state of the VM, returned by QueryStatus.
+type Status struct {
+	Running    bool   `json:"running"`
+	Singlestep bool   `json:"singlestep"`
+	Status     string `json:"status"`
+}
+
+// QueryStatus returns the run state of the VM.
+func (c *Client) QueryStatus(ctx context.Context) (*Status, error) {
+	status := &Status{}
+	if err := c.Execute(ctx, "query-status", nil, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// SystemPowerdown requests the guest to power down by an ACPI power button event.
+// It returns before the guest powers down, which is notified by EventShutdown.
+func (c *Client) SystemPowerdown(ctx context.Context) error {
+	return c.Execute(ctx, "system_powerdown", nil, nil)
+}
+
+// SystemReset resets the VM.
+func (c *Client) SystemReset(ctx context.Context) error {
+	return c.Execute(ctx, "system_reset", nil, nil)
+}
+
+// Stop pauses the VM.
+func (c *Client) Stop(ctx context.Context) error {
+	return c.Execute(ctx, "stop", nil, nil)
+}
+
+// Cont resumes the paused VM.
+func (c *Client) Cont(ctx context.Context) error {
+	return c.Execute(ctx, "cont", nil, nil)
+}
+
+// Quit terminates qemu immediately.
+func (c *Client) Quit(ctx context.Context) error {
+	return c.Execute(ctx, "quit", nil, nil)
+}
+
+// Eject ejects the removable media of the block device whose qdev id is `id`.
+func (c *Client) Eject(ctx context.Context, id string, force bool) error {
+	return c.Execute(ctx, "eject", map[string]interface{}{"id": id, "force": force}, nil)
+}
+
+// BlockJob is a running block job, returned by QueryBlockJobs.
+type BlockJob struct {
+	Type   string `json:"type"`
+	Device string `json:"device"`
+	Len    int64  `json:"len"`
+	Offset int64  `json:"offset"`
+	Busy   bool   `json:"busy"`
+	Paused bool   `json:"paused"`
+	Speed  int64  `json:"speed"`
+	Ready  bool   `json:"ready"`
+}
+
+// QueryBlockJobs returns running block jobs.
+func (c *Client) QueryBlockJobs(ctx context.Context) ([]*BlockJob, error) {
+	var jobs []*BlockJob
+	if err := c.Execute(ctx, "query-block-jobs", nil, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
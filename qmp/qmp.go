@@ -0,0 +1,278 @@
+// Package qmp implements a client of the QEMU Machine Protocol, which controls a running qemu instance.
+// See https://www.qemu.org/docs/master/interop/qmp-spec.html.
+package qmp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Asynchronous events emitted by qemu.
+const (
+	EventShutdown          = "SHUTDOWN"
+	EventPowerdown         = "POWERDOWN"
+	EventReset             = "RESET"
+	EventStop              = "STOP"
+	EventResume            = "RESUME"
+	EventBlockJobCompleted = "BLOCK_JOB_COMPLETED"
+	EventBlockJobCancelled = "BLOCK_JOB_CANCELLED"
+	EventBlockJobError     = "BLOCK_JOB_ERROR"
+	EventBlockJobReady     = "BLOCK_JOB_READY"
+)
+
+// eventBufferSize is the number of events buffered for Events. Events are dropped if the buffer is full.
+const eventBufferSize = 64
+
+// Greeting is the first message sent by qemu after a client connects.
+type Greeting struct {
+	QMP struct {
+		Version struct {
+			QEMU struct {
+				Major int `json:"major"`
+				Minor int `json:"minor"`
+				Micro int `json:"micro"`
+			} `json:"qemu"`
+			Package string `json:"package"`
+		} `json:"version"`
+		Capabilities []string `json:"capabilities"`
+	} `json:"QMP"`
+}
+
+// Event is an asynchronous event emitted by qemu.
+type Event struct {
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp time.Time       `json:"-"`
+}
+
+// ShutdownEventData is the data of EventShutdown.
+type ShutdownEventData struct {
+	// Guest is true if the shutdown is requested by the guest.
+	Guest  bool   `json:"guest"`
+	Reason string `json:"reason"`
+}
+
+// BlockJobEventData is the data of block job events.
+type BlockJobEventData struct {
+	Type   string `json:"type"`
+	Device string `json:"device"`
+	Len    int64  `json:"len"`
+	Offset int64  `json:"offset"`
+	Speed  int64  `json:"speed"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Error is an error returned by qemu in response to a command.
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Class, e.Desc)
+}
+
+type command struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+	ID        string      `json:"id"`
+}
+
+// message is any message sent by qemu: a response, an error or an event.
+type message struct {
+	Return    json.RawMessage `json:"return,omitempty"`
+	Error     *Error          `json:"error,omitempty"`
+	Event     string          `json:"event,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Timestamp *struct {
+		Seconds      int64 `json:"seconds"`
+		Microseconds int64 `json:"microseconds"`
+	} `json:"timestamp,omitempty"`
+}
+
+// Client is a QMP client. It's safe for concurrent use.
+type Client struct {
+	conn     net.Conn
+	greeting *Greeting
+	events   chan Event
+
+	mu      sync.Mutex
+	nextID  int
+	pending map[string]chan *message
+	// err is the reason why the connection is closed.
+	err    error
+	closed chan struct{}
+}
+
+// Dial connects to the QMP unix socket at `path` and negotiates capabilities.
+func Dial(ctx context.Context, path string) (*Client, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to dial %s", path)
+	}
+	c, err := NewClient(ctx, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClient reads the greeting from `conn` and negotiates capabilities.
+// The returned Client owns `conn`.
+func NewClient(ctx context.Context, conn net.Conn) (*Client, error) {
+	reader := bufio.NewReader(conn)
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetReadDeadline(deadline)
+	}
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to read greeting")
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	greeting := &Greeting{}
+	if err = json.Unmarshal(line, greeting); err != nil {
+		return nil, errors.WithMessagef(err, "bad greeting: %s", line)
+	}
+	c := &Client{
+		conn:     conn,
+		greeting: greeting,
+		events:   make(chan Event, eventBufferSize),
+		pending:  make(map[string]chan *message),
+		closed:   make(chan struct{}),
+	}
+	go c.readLoop(reader)
+	if err = c.Execute(ctx, "qmp_capabilities", nil, nil); err != nil {
+		_ = c.Close()
+		return nil, errors.WithMessage(err, "failed to negotiate capabilities")
+	}
+	return c, nil
+}
+
+// Greeting returns the greeting sent by qemu.
+func (c *Client) Greeting() *Greeting {
+	return c.greeting
+}
+
+// Events returns the channel of asynchronous events. It's closed when the connection is closed.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// Done returns a channel which is closed when the connection is closed, e.g. qemu exits.
+func (c *Client) Done() <-chan struct{} {
+	return c.closed
+}
+
+// Execute runs `cmd` with `args`, and decodes its return value into `result` if it's not nil.
+func (c *Client) Execute(ctx context.Context, cmd string, args interface{}, result interface{}) error {
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return err
+	}
+	c.nextID++
+	id := strconv.Itoa(c.nextID)
+	respCh := make(chan *message, 1)
+	c.pending[id] = respCh
+	content, err := json.Marshal(&command{Execute: cmd, Arguments: args, ID: id})
+	if err == nil {
+		_, err = c.conn.Write(append(content, '\n'))
+	}
+	c.mu.Unlock()
+	if err != nil {
+		c.removePending(id)
+		return errors.WithMessagef(err, "failed to send command %s", cmd)
+	}
+	select {
+	case <-ctx.Done():
+		c.removePending(id)
+		return ctx.Err()
+	case <-c.closed:
+		return errors.WithMessagef(c.closeErr(), "connection is closed while running %s", cmd)
+	case resp := <-respCh:
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result == nil {
+			return nil
+		}
+		if err = json.Unmarshal(resp.Return, result); err != nil {
+			return errors.WithMessagef(err, "failed to decode return value of %s", cmd)
+		}
+		return nil
+	}
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) removePending(id string) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+func (c *Client) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Client) readLoop(reader *bufio.Reader) {
+	var err error
+	defer func() {
+		c.mu.Lock()
+		c.err = errors.WithMessage(err, "qmp connection is closed")
+		c.mu.Unlock()
+		close(c.closed)
+		close(c.events)
+	}()
+	for {
+		var line []byte
+		line, err = reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		msg := &message{}
+		if jsonErr := json.Unmarshal(line, msg); jsonErr != nil {
+			log.Warnf("ignoring bad qmp message: %s", line)
+			continue
+		}
+		if msg.Event != "" {
+			event := Event{Event: msg.Event, Data: msg.Data}
+			if msg.Timestamp != nil {
+				event.Timestamp = time.Unix(msg.Timestamp.Seconds, msg.Timestamp.Microseconds*1000)
+			}
+			select {
+			case c.events <- event:
+			default:
+				log.Warnf("qmp event buffer is full, dropping event %s", event.Event)
+			}
+			continue
+		}
+		c.mu.Lock()
+		respCh, ok := c.pending[msg.ID]
+		delete(c.pending, msg.ID)
+		c.mu.Unlock()
+		if !ok {
+			log.Debugf("ignoring qmp response to unknown command %q", msg.ID)
+			continue
+		}
+		respCh <- msg
+	}
+}
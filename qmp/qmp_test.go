@@ -0,0 +1,127 @@
+package qmp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+// fakeServer serves a single QMP connection on a unix socket, answering commands by `handle`.
+// Events sent to the returned channel are emitted to the client.
+func fakeServer(t *testing.T, handle func(cmd string, args json.RawMessage) (interface{}, *Error)) (string,
+	chan<- string) {
+	path := filepath.Join(t.TempDir(), "qmp.sock")
+	l, err := net.Listen("unix", path)
+	assert.NilError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	events := make(chan string)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		writes := make(chan []byte)
+		go func() {
+			for b := range writes {
+				_, _ = conn.Write(append(b, '\n'))
+			}
+		}()
+		writes <- []byte(`{"QMP": {"version": {"qemu": {"micro": 0, "minor": 2, "major": 8}, "package": ""},` +
+			` "capabilities": ["oob"]}}`)
+		go func() {
+			for event := range events {
+				writes <- []byte(`{"event": "` + event + `", "data": {"guest": true, "reason": "guest-shutdown"},` +
+					` "timestamp": {"seconds": 1700000000, "microseconds": 5}}`)
+			}
+		}()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			var cmd struct {
+				Execute   string          `json:"execute"`
+				Arguments json.RawMessage `json:"arguments"`
+				ID        string          `json:"id"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &cmd); err != nil {
+				return
+			}
+			resp := map[string]interface{}{"id": cmd.ID}
+			if cmd.Execute == "qmp_capabilities" {
+				resp["return"] = struct{}{}
+			} else if ret, qmpErr := handle(cmd.Execute, cmd.Arguments); qmpErr != nil {
+				resp["error"] = qmpErr
+			} else {
+				resp["return"] = ret
+			}
+			b, _ := json.Marshal(resp)
+			writes <- b
+		}
+	}()
+	return path, events
+}
+
+func TestClient(t *testing.T) {
+	var ejectArgs json.RawMessage
+	path, events := fakeServer(t, func(cmd string, args json.RawMessage) (interface{}, *Error) {
+		switch cmd {
+		case "query-status":
+			return &Status{Running: true, Status: "running"}, nil
+		case "system_powerdown":
+			return struct{}{}, nil
+		case "eject":
+			ejectArgs = args
+			return struct{}{}, nil
+		default:
+			return nil, &Error{Class: "CommandNotFound", Desc: "The command " + cmd + " has not been found"}
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	client, err := Dial(ctx, path)
+	assert.NilError(t, err)
+	defer client.Close()
+	assert.Equal(t, client.Greeting().QMP.Version.QEMU.Major, 8)
+	t.Run("query_status", func(t *testing.T) {
+		status, err := client.QueryStatus(ctx)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, status, &Status{Running: true, Status: "running"})
+	})
+	t.Run("powerdown", func(t *testing.T) {
+		assert.NilError(t, client.SystemPowerdown(ctx))
+	})
+	t.Run("eject", func(t *testing.T) {
+		assert.NilError(t, client.Eject(ctx, "cdrom0", true))
+		assert.Equal(t, string(ejectArgs), `{"force":true,"id":"cdrom0"}`)
+	})
+	t.Run("error", func(t *testing.T) {
+		err := client.SystemReset(ctx)
+		qmpErr, ok := err.(*Error)
+		assert.Assert(t, ok)
+		assert.Equal(t, qmpErr.Class, "CommandNotFound")
+	})
+	t.Run("event", func(t *testing.T) {
+		events <- EventShutdown
+		event := <-client.Events()
+		assert.Equal(t, event.Event, EventShutdown)
+		assert.Equal(t, event.Timestamp, time.Unix(1700000000, 5000))
+		data := &ShutdownEventData{}
+		assert.NilError(t, json.Unmarshal(event.Data, data))
+		assert.DeepEqual(t, data, &ShutdownEventData{Guest: true, Reason: "guest-shutdown"})
+	})
+	t.Run("closed", func(t *testing.T) {
+		assert.NilError(t, client.Close())
+		<-client.Done()
+		_, ok := <-client.Events()
+		assert.Assert(t, !ok)
+		err := client.Stop(ctx)
+		assert.ErrorContains(t, err, "qmp connection is closed")
+	})
+}
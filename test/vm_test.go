@@ -44,8 +44,7 @@ users:
 		"--nographic " +
 		"-display none " +
 		"-machine type=pc,usb=off " +
-		// KVM is not enabled in GitHub Actions.
-		//"--enable-kvm " +
+		// containervm selects kvm if it's usable, KVM is not enabled in GitHub Actions.
 		"-smp 4,sockets=1,cores=4,threads=1 " +
 		"-m 4096M -device virtio-balloon-pci,id=balloon0 " +
 		fmt.Sprintf("-drive file=%s,format=qcow2,if=virtio,aio=threads,media=disk,cache=unsafe,snapshot=on ", imagePath) +
@@ -3,9 +3,7 @@ package util
 import (
 	"crypto/rand"
 	"net"
-	"time"
 
-	"github.com/go-ping/ping"
 	"github.com/jackpal/gateway"
 	"github.com/pkg/errors"
 	"github.com/vishvananda/netlink"
@@ -64,12 +62,46 @@ func GetDefaultNIC() (*NIC, error) {
 	return nil, errors.WithMessage(err, "failed to find default interface")
 }
 
+// GetNIC returns the network interface named `name`.
+func GetNIC(name string) (*NIC, error) {
+	nic, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to get interface %s", name)
+	}
+	return &NIC{Interface: *nic}, nil
+}
+
+// ListNICs lists network interfaces which are up and have addresses, except the loopback one.
+func ListNICs() ([]*NIC, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to list interfaces")
+	}
+	var nics []*NIC
+	for _, nic := range interfaces {
+		if nic.Flags&net.FlagLoopback != 0 || nic.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := nic.Addrs()
+		if err != nil || len(addrs) == 0 {
+			continue
+		}
+		nics = append(nics, &NIC{Interface: nic})
+	}
+	return nics, nil
+}
+
 var NotFoundError = errors.New("not found")
 
-func GetIPv4DefaultGateway() (net.IP, error) {
-	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+// GetGateway returns the default gateway of `family` via the interface `ifIndex`.
+func GetGateway(ifIndex int, family int) (net.IP, error) {
+	link, err := netlink.LinkByIndex(ifIndex)
 	if err != nil {
-		return nil, errors.WithMessage(err, "failed to get ipv4 routes")
+		return nil, errors.WithMessagef(err, "failed to get link %d", ifIndex)
+	}
+	routes, err := netlink.RouteList(link, family)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to get routes of %d", ifIndex)
 	}
 	for _, route := range routes {
 		if route.Dst == nil && route.Gw != nil {
@@ -79,10 +111,10 @@ func GetIPv4DefaultGateway() (net.IP, error) {
 	return nil, NotFoundError
 }
 
-func GetIPv6DefaultGateway() (net.IP, error) {
-	routes, err := netlink.RouteList(nil, netlink.FAMILY_V6)
+func GetIPv4DefaultGateway() (net.IP, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
 	if err != nil {
-		return nil, errors.WithMessage(err, "failed to get ipv6 routes")
+		return nil, errors.WithMessage(err, "failed to get ipv4 routes")
 	}
 	for _, route := range routes {
 		if route.Dst == nil && route.Gw != nil {
@@ -92,23 +124,15 @@ func GetIPv6DefaultGateway() (net.IP, error) {
 	return nil, NotFoundError
 }
 
-func GetHardwareAddr(ifIndex int, ip net.IP) (net.HardwareAddr, error) {
-	pinger, err := ping.NewPinger(ip.String())
-	if err == nil {
-		pinger.Count = 1
-		pinger.Timeout = time.Millisecond * 100
-		pinger.SetNetwork("ipv4")
-		pinger.SetPrivileged(true)
-		_ = pinger.Run()
-	}
-	neighs, err := netlink.NeighList(ifIndex, netlink.FAMILY_V4)
+func GetIPv6DefaultGateway() (net.IP, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V6)
 	if err != nil {
-		return nil, errors.WithMessagef(err, "failed to get neighbors of %d", ifIndex)
+		return nil, errors.WithMessage(err, "failed to get ipv6 routes")
 	}
-	for _, neigh := range neighs {
-		if neigh.IP.Equal(ip) {
-			return neigh.HardwareAddr, nil
+	for _, route := range routes {
+		if route.Dst == nil && route.Gw != nil {
+			return route.Gw, nil
 		}
 	}
-	return nil, errors.WithMessagef(err, "failed to get hardware address of %v at %d", ip, ifIndex)
+	return nil, NotFoundError
 }
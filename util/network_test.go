@@ -14,6 +14,17 @@ func TestGetDefaultNIC(t *testing.T) {
 	t.Logf("%+v", defaultNIC)
 }
 
+func TestListNICs(t *testing.T) {
+	nics, err := ListNICs()
+	assert.NilError(t, err)
+	for _, nic := range nics {
+		assert.Assert(t, nic.Flags&net.FlagLoopback == 0, nic.Name)
+		nic, err := GetNIC(nic.Name)
+		assert.NilError(t, err)
+		t.Logf("%+v", nic)
+	}
+}
+
 func TestGetRandomMAC(t *testing.T) {
 	mac := GetRandomMAC()
 	hw, err := net.ParseMAC(mac.String())
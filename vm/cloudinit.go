@@ -0,0 +1,83 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/cox96de/containervm/cloudinit"
+	"github.com/cox96de/containervm/util"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"golang.org/x/sys/unix"
+)
+
+// generateCloudInitOpt generates a cloud-init seed iso in `workDir` with the network config of `nws`,
+// and returns qemu options to attach it.
+func generateCloudInitOpt(nws []*Network, workDir string) ([]string, error) {
+	content, err := cloudinit.GenerateNetworkConfig(networkConfigs(nws)...)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to generate network config")
+	}
+	err = os.WriteFile(filepath.Join(workDir, "network-config"), content, os.ModePerm)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to write network-config")
+	}
+	err = os.WriteFile(filepath.Join(workDir, "user-data"), []byte(`#cloud-config
+`), os.ModePerm)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to write user-data")
+	}
+	err = os.WriteFile(filepath.Join(workDir, "meta-data"), []byte(`#cloud-config
+instance-id: someid/somehost
+`), os.ModePerm)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to write meta-data")
+	}
+	isoFile := "seed.iso"
+
+	err = util.GenISO(workDir, isoFile, []string{"network-config", "meta-data", "user-data"}, "cidata")
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to generate seed iso")
+	}
+	return []string{"-drive", fmt.Sprintf("driver=raw,file=%s,if=virtio", filepath.Join(workDir, isoFile))}, nil
+}
+
+// isConnectedRoute reports whether `dst` is the subnet of one of `addrs`.
+func isConnectedRoute(dst *net.IPNet, addrs []*net.IPNet) bool {
+	return lo.ContainsBy(addrs, func(addr *net.IPNet) bool {
+		return addr.IP.Mask(addr.Mask).Equal(dst.IP) && bytes.Equal(addr.Mask, dst.Mask)
+	})
+}
+
+// networkConfigs converts `nws` to network configs of cloud-init.
+func networkConfigs(nws []*Network) []*cloudinit.NetworkConfig {
+	var configs []*cloudinit.NetworkConfig
+	for _, n := range nws {
+		c := &cloudinit.NetworkConfig{
+			Mac:       n.BridgeMacAddr,
+			Addresses: n.Address,
+			Gateway4:  n.Gateway,
+			Gateway6:  n.Gateway6,
+		}
+		for _, route := range n.Routes {
+			// Default routes are covered by gateways, and routes to the subnets of addresses by addresses. Snapshots
+			// give default routes a /0 destination. Other on-link routes are kept, such as the one to the gateway
+			// of a /32 address.
+			if route.Table != unix.RT_TABLE_MAIN || route.Dst == nil {
+				continue
+			}
+			if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+				continue
+			}
+			if route.Gw == nil && isConnectedRoute(route.Dst, n.Address) {
+				continue
+			}
+			c.Routes = append(c.Routes, &cloudinit.Route{To: route.Dst, Via: route.Gw})
+		}
+		configs = append(configs, c)
+	}
+	return configs
+}
@@ -0,0 +1,67 @@
+package vm
+
+import (
+	"net"
+	"time"
+
+	"github.com/cox96de/containervm/network"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/pkg/errors"
+)
+
+// DHCPOptions configures the DHCP server of the VM in NetworkModePod. Options detected from the pod, such as
+// the address, routes and MTU of the NIC, are always handed to the VM.
+type DHCPOptions struct {
+	// NTPServers are handed to the VM as NTP servers.
+	NTPServers []net.IP
+	// DomainName is the domain name of the VM. Empty means the first search domain of the pod.
+	DomainName string
+	// LeaseTime is the lease time of the address of the VM. Zero means infinite.
+	LeaseTime time.Duration
+	// RenewalTime and RebindingTime are T1 and T2 of the lease. Zero means the VM derives them from LeaseTime.
+	RenewalTime   time.Duration
+	RebindingTime time.Duration
+	// Options are raw DHCP options, they take precedence over others. See network.ParseDHCPOption.
+	Options []dhcpv4.Option
+}
+
+// validate checks that the times of the lease are in order: T1 < T2 < lease time.
+func (o *DHCPOptions) validate() error {
+	if o.LeaseTime < 0 || o.RenewalTime < 0 || o.RebindingTime < 0 {
+		return errors.New("dhcp lease times must not be negative")
+	}
+	leaseTime := o.LeaseTime
+	if leaseTime == 0 {
+		leaseTime = dhcpv4.MaxLeaseTime
+	}
+	if o.RebindingTime > 0 && o.RebindingTime >= leaseTime {
+		return errors.Errorf("dhcp rebinding time %s must be less than the lease time %s", o.RebindingTime, leaseTime)
+	}
+	if o.RenewalTime > 0 && o.RenewalTime >= leaseTime {
+		return errors.Errorf("dhcp renewal time %s must be less than the lease time %s", o.RenewalTime, leaseTime)
+	}
+	if o.RenewalTime > 0 && o.RebindingTime > 0 && o.RenewalTime >= o.RebindingTime {
+		return errors.Errorf("dhcp renewal time %s must be less than the rebinding time %s", o.RenewalTime,
+			o.RebindingTime)
+	}
+	return nil
+}
+
+// apply fills `opt` with the options, the domain name falls back to the first of `searchDomains`.
+// `o` may be nil.
+func (o *DHCPOptions) apply(opt *network.DHCPOption, searchDomains []string) {
+	if len(searchDomains) > 0 {
+		opt.DomainName = searchDomains[0]
+	}
+	if o == nil {
+		return
+	}
+	if o.DomainName != "" {
+		opt.DomainName = o.DomainName
+	}
+	opt.NTPServers = o.NTPServers
+	opt.LeaseTime = o.LeaseTime
+	opt.RenewalTime = o.RenewalTime
+	opt.RebindingTime = o.RebindingTime
+	opt.Options = o.Options
+}
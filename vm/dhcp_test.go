@@ -0,0 +1,41 @@
+package vm
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cox96de/containervm/network"
+	"gotest.tools/v3/assert"
+)
+
+func TestDHCPOptions(t *testing.T) {
+	for _, c := range []struct {
+		opt *DHCPOptions
+		err string
+	}{
+		{opt: &DHCPOptions{}},
+		{opt: &DHCPOptions{RenewalTime: time.Hour, RebindingTime: time.Hour * 2}},
+		{opt: &DHCPOptions{LeaseTime: time.Hour, RenewalTime: time.Minute * 30, RebindingTime: time.Minute * 50}},
+		{opt: &DHCPOptions{LeaseTime: -time.Hour}, err: "must not be negative"},
+		{opt: &DHCPOptions{LeaseTime: time.Hour, RenewalTime: time.Hour}, err: "renewal time 1h0m0s must be less"},
+		{opt: &DHCPOptions{LeaseTime: time.Hour, RebindingTime: time.Hour * 2}, err: "rebinding time 2h0m0s must be less"},
+		{opt: &DHCPOptions{RenewalTime: time.Hour, RebindingTime: time.Minute}, err: "must be less than the rebinding"},
+	} {
+		err := c.opt.validate()
+		if c.err == "" {
+			assert.NilError(t, err)
+		} else {
+			assert.ErrorContains(t, err, c.err)
+		}
+	}
+
+	opt := &network.DHCPOption{}
+	(*DHCPOptions)(nil).apply(opt, []string{"default.svc.cluster.local", "svc.cluster.local"})
+	assert.Equal(t, opt.DomainName, "default.svc.cluster.local")
+	ntp := []net.IP{net.ParseIP("10.0.0.123")}
+	(&DHCPOptions{DomainName: "example.com", NTPServers: ntp, LeaseTime: time.Hour}).apply(opt, nil)
+	assert.Equal(t, opt.DomainName, "example.com")
+	assert.DeepEqual(t, opt.NTPServers, ntp)
+	assert.Equal(t, opt.LeaseTime, time.Hour)
+}
@@ -0,0 +1,101 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Stage identifies the step of launching a VM in which an error occurred.
+type Stage string
+
+const (
+	// StageOptions means the given Options are invalid.
+	StageOptions Stage = "options"
+	// StageAccel means kvm is required but not usable.
+	StageAccel Stage = "accel"
+	// StageResources means the VM doesn't fit in the cgroup limits of the container.
+	StageResources Stage = "resources"
+	// StageResolv means nameservers or search domains can't be read.
+	StageResolv Stage = "resolv"
+	// StageNetwork means the pod network can't be bridged into the VM.
+	StageNetwork Stage = "network"
+	// StageCloudInit means the cloud-init seed can't be generated.
+	StageCloudInit Stage = "cloud-init"
+	// StageQEMU means qemu can't be started or waited.
+	StageQEMU Stage = "qemu"
+	// StageCleanup means the pod network can't be restored.
+	StageCleanup Stage = "cleanup"
+)
+
+// Error is returned by Launcher when one of the launching stages fails.
+type Error struct {
+	Stage Stage
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(stage Stage, err error) error {
+	return &Error{Stage: stage, Err: err}
+}
+
+// Exit codes of containervm when launching fails before qemu runs, or the network can't be restored.
+// They are outside the range of qemu's own exit codes (0 and 1).
+const (
+	ExitCodeOptions   = 64
+	ExitCodeResolv    = 65
+	ExitCodeNetwork   = 66
+	ExitCodeCloudInit = 67
+	ExitCodeQEMU      = 68
+	ExitCodeCleanup   = 69
+	ExitCodeResources = 70
+	ExitCodeAccel     = 71
+)
+
+var stageExitCodes = map[Stage]int{
+	StageOptions:   ExitCodeOptions,
+	StageResolv:    ExitCodeResolv,
+	StageNetwork:   ExitCodeNetwork,
+	StageCloudInit: ExitCodeCloudInit,
+	StageQEMU:      ExitCodeQEMU,
+	StageCleanup:   ExitCodeCleanup,
+	StageResources: ExitCodeResources,
+	StageAccel:     ExitCodeAccel,
+}
+
+// ExitCode returns the exit code for containervm to exit with, given the error returned by Launcher.
+// If qemu has exited, it's the exit code of qemu, or 128+signo if qemu is killed by a signal like a shell does.
+// Otherwise, it's the exit code of the failed stage.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitStatus(exitErr.ProcessState)
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		if code, ok := stageExitCodes[e.Stage]; ok {
+			return code
+		}
+	}
+	return 1
+}
+
+// exitStatus returns the exit code of an exited process, or 128+signo if it's killed by a signal.
+func exitStatus(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
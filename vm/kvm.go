@@ -0,0 +1,86 @@
+package vm
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultKVMPath is the path of the KVM device.
+const DefaultKVMPath = "/dev/kvm"
+
+const (
+	// kvmGetAPIVersion is the KVM_GET_API_VERSION ioctl, _IO(KVMIO, 0x00).
+	kvmGetAPIVersion = 0xAE00
+	// kvmAPIVersion is the only stable KVM API version, qemu refuses others.
+	kvmAPIVersion = 12
+)
+
+// probeKVM checks that the KVM device at `path` exists, is accessible and speaks the stable API.
+func probeKVM(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return errors.Errorf("%s doesn't exist, the container may not be privileged or the host has no kvm", path)
+		}
+		return errors.WithMessagef(err, "failed to stat %s", path)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return errors.Errorf("no permission to open %s", path)
+		}
+		return errors.WithMessagef(err, "failed to open %s", path)
+	}
+	defer f.Close()
+	version, err := unix.IoctlRetInt(int(f.Fd()), kvmGetAPIVersion)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to get kvm api version from %s", path)
+	}
+	if version != kvmAPIVersion {
+		return errors.Errorf("unsupported kvm api version %d of %s", version, path)
+	}
+	return nil
+}
+
+// accelArgs returns the qemu option to select the accelerator: kvm if it's usable, otherwise tcg.
+// Nothing is returned if the qemu command selects an accelerator already.
+func (l *Launcher) accelArgs() ([]string, error) {
+	path := l.opt.KVMPath
+	if path == "" {
+		path = DefaultKVMPath
+	}
+	kvmErr := probeKVM(path)
+	if kvmErr != nil && l.opt.RequireKVM {
+		return nil, errors.WithMessage(kvmErr, "kvm is required but not usable")
+	}
+	args, err := l.qemuArgs(nil)
+	if err != nil {
+		return nil, err
+	}
+	if hasAccel(args) {
+		return nil, nil
+	}
+	if kvmErr != nil {
+		log.Warnf("kvm is not usable, fall back to tcg, the vm will be much slower: %+v", kvmErr)
+		return []string{"-accel", "tcg"}, nil
+	}
+	return []string{"-accel", "kvm"}, nil
+}
+
+// hasAccel reports whether qemu `args` select an accelerator.
+func hasAccel(args []string) bool {
+	for i, arg := range args {
+		switch arg {
+		case "-accel", "--accel", "-enable-kvm", "--enable-kvm":
+			return true
+		case "-machine", "--machine", "-M":
+			if i+1 < len(args) && strings.Contains(args[i+1], "accel=") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestProbeKVM(t *testing.T) {
+	err := probeKVM(filepath.Join(t.TempDir(), "kvm"))
+	assert.ErrorContains(t, err, "doesn't exist")
+	// /dev/null doesn't speak the kvm api.
+	err = probeKVM(os.DevNull)
+	assert.ErrorContains(t, err, "failed to get kvm api version")
+	if _, err := os.Stat(DefaultKVMPath); err == nil && os.Geteuid() == 0 {
+		assert.NilError(t, probeKVM(DefaultKVMPath))
+	}
+}
+
+func TestAccelArgs(t *testing.T) {
+	noKVM := filepath.Join(t.TempDir(), "kvm")
+	l, err := NewLauncher(&Options{QEMUArgs: []string{"qemu-system-x86_64"}, KVMPath: noKVM})
+	assert.NilError(t, err)
+	args, err := l.accelArgs()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, args, []string{"-accel", "tcg"})
+
+	l, err = NewLauncher(&Options{QEMUArgs: []string{"qemu-system-x86_64", "-machine", "type=q35,accel=tcg"},
+		KVMPath: noKVM})
+	assert.NilError(t, err)
+	args, err = l.accelArgs()
+	assert.NilError(t, err)
+	assert.Assert(t, args == nil)
+
+	l, err = NewLauncher(&Options{QEMUArgs: []string{"qemu-system-x86_64", "--enable-kvm"}, KVMPath: noKVM,
+		RequireKVM: true})
+	assert.NilError(t, err)
+	_, err = l.accelArgs()
+	assert.ErrorContains(t, err, "kvm is required but not usable")
+}
@@ -0,0 +1,509 @@
+// Package vm launches a qemu VM which takes over the network of the pod it runs in.
+package vm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cox96de/containervm/network"
+	"github.com/cox96de/containervm/qemu"
+	"github.com/cox96de/containervm/qmp"
+	"github.com/cox96de/containervm/util"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Options configures a Launcher.
+type Options struct {
+	// QEMUArgs is the qemu launch command, the first element is the qemu binary.
+	// Network options are appended by Launcher.
+	QEMUArgs []string
+	// Spec describes the VM declaratively. It's used instead of QEMUArgs, which must be empty.
+	Spec *qemu.Spec
+	// NetworkMode is how the VM is connected to the network. Empty means NetworkModePod.
+	NetworkMode NetworkMode
+	// NetworkBackend is how the pod NIC is connected to the VM in NetworkModePod, network.BackendMacvtap,
+	// network.BackendBridge or network.BackendIPVtap. Empty means network.BackendMacvtap.
+	NetworkBackend string
+	// Interfaces are names of pod interfaces bridged into the VM in NetworkModePod, in order.
+	// Empty means the default NIC only.
+	Interfaces []string
+	// AllInterfaces bridges all pod interfaces into the VM in NetworkModePod, the default NIC first.
+	// It's exclusive with Interfaces.
+	AllInterfaces bool
+	// NetworkQueues is the number of queues of each NIC of the VM in NetworkModePod.
+	// Zero means the number of vCPUs, up to 16.
+	NetworkQueues int
+	// DisableVhost makes qemu process packets of the VM in userspace instead of vhost-net.
+	// vhost-net is disabled anyway if its device is not usable.
+	DisableVhost bool
+	// VhostNetPath is the path of the vhost-net device. Empty means DefaultVhostNetPath.
+	VhostNetPath string
+	// PortForwards forward ports of the pod into the VM. They are only supported in NetworkModeUser.
+	PortForwards []*PortForward
+	// InheritResolv hands nameservers and search domains in /etc/resolv.conf to the VM.
+	InheritResolv bool
+	// Nameservers are extra nameservers handed to the VM.
+	Nameservers []string
+	// DHCP configures the DHCP server of the VM in NetworkModePod. Nil means defaults.
+	DHCP *DHCPOptions
+	// PXE configures network boot of the VM in NetworkModePod. Nil disables it.
+	PXE *PXEOptions
+	// GratuitousARPCount is how many gratuitous ARP packets, or unsolicited neighbor advertisements for IPv6, are
+	// sent for each address of the VM in NetworkModePod once the VM gets it by DHCP, so that neighbors learn the
+	// new location of the MAC of the pod quickly. Zero disables them, see DefaultGratuitousARPCount.
+	GratuitousARPCount int
+	// JournalPath is where the original state of the pod NIC is persisted, so the network can be recovered
+	// by RecoverNetwork if containervm is killed. Empty means no journal.
+	JournalPath string
+	// QMPSocketPath is the path of the QMP socket appended to qemu. Empty means a socket in a temporary directory.
+	QMPSocketPath string
+	// ShutdownTimeout is how long Shutdown waits for the guest to power off before terminating qemu.
+	// Zero means DefaultShutdownTimeout.
+	ShutdownTimeout time.Duration
+	// KVMPath is the path of the KVM device. Empty means DefaultKVMPath.
+	// qemu runs with kvm if the device is usable, otherwise with tcg, unless the qemu command selects one.
+	KVMPath string
+	// RequireKVM makes Start fail if kvm isn't usable, instead of falling back to tcg.
+	RequireKVM bool
+	// Resources sizes vCPUs and memory of the VM from the cgroup limits of the container. Nil disables it.
+	Resources *ResourceOptions
+	// Stdin, Stdout and Stderr are connected to qemu. Nil means the null device.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Launcher bridges the pod network into a qemu VM and manages the qemu process.
+// A Launcher is used once: Start, then Wait. Stop can be called at any time after Start.
+type Launcher struct {
+	opt *Options
+
+	networks  []*Network
+	cleanFunc func() error
+	workDir   string
+	cmd       *exec.Cmd
+	waitOnce  sync.Once
+	waitErr   error
+	// exited is closed when qemu exits.
+	exited chan struct{}
+
+	// forwarders serve port forwards in NetworkModeUser.
+	forwarders []*forwarder
+
+	qmpSocketPath string
+	qmpClient     *qmp.Client
+	// qmpReady is closed when qmpClient is connected.
+	qmpReady chan struct{}
+}
+
+// NewLauncher validates `opt` and creates a Launcher.
+func NewLauncher(opt *Options) (*Launcher, error) {
+	if opt == nil || (len(opt.QEMUArgs) == 0 && opt.Spec == nil) {
+		return nil, newError(StageOptions, errors.New("qemu launch command or spec is required"))
+	}
+	if len(opt.QEMUArgs) > 0 && opt.Spec != nil {
+		return nil, newError(StageOptions, errors.New("qemu launch command and spec are mutually exclusive"))
+	}
+	switch opt.NetworkBackend {
+	case "", network.BackendMacvtap, network.BackendBridge, network.BackendIPVtap:
+	default:
+		return nil, newError(StageOptions, errors.Errorf("unknown network backend: %s", opt.NetworkBackend))
+	}
+	if opt.NetworkQueues < 0 {
+		return nil, newError(StageOptions, errors.Errorf("bad number of network queues: %d", opt.NetworkQueues))
+	}
+	if opt.GratuitousARPCount < 0 {
+		return nil, newError(StageOptions, errors.Errorf("bad number of gratuitous arp: %d", opt.GratuitousARPCount))
+	}
+	if opt.DHCP != nil {
+		if err := opt.DHCP.validate(); err != nil {
+			return nil, newError(StageOptions, err)
+		}
+	}
+	if opt.PXE != nil {
+		if err := opt.PXE.validate(opt.NetworkBackend); err != nil {
+			return nil, newError(StageOptions, err)
+		}
+	}
+	if opt.AllInterfaces && len(opt.Interfaces) > 0 {
+		return nil, newError(StageOptions, errors.New("all interfaces and selected interfaces are mutually exclusive"))
+	}
+	switch opt.NetworkMode {
+	case "", NetworkModePod:
+		if len(opt.PortForwards) > 0 {
+			return nil, newError(StageOptions, errors.Errorf("port forwards are not supported in %s network mode",
+				NetworkModePod))
+		}
+	case NetworkModeUser:
+		for _, f := range opt.PortForwards {
+			if err := f.validate(); err != nil {
+				return nil, newError(StageOptions, err)
+			}
+		}
+	default:
+		return nil, newError(StageOptions, errors.Errorf("unknown network mode: %s", opt.NetworkMode))
+	}
+	if opt.Spec != nil {
+		if err := opt.Spec.Validate(); err != nil {
+			return nil, newError(StageOptions, errors.WithMessage(err, "invalid spec"))
+		}
+	}
+	return &Launcher{opt: opt, exited: make(chan struct{}), qmpReady: make(chan struct{})}, nil
+}
+
+// Network returns the first pod network bridged into the VM. It's nil before Start succeeds.
+func (l *Launcher) Network() *Network {
+	if len(l.networks) == 0 {
+		return nil
+	}
+	return l.networks[0]
+}
+
+// Networks returns the pod networks bridged into the VM, in the order of VM interfaces.
+func (l *Launcher) Networks() []*Network {
+	return l.networks
+}
+
+// Start configures the network and starts qemu. qemu is killed when `ctx` is done.
+// The network is restored if Start fails.
+func (l *Launcher) Start(ctx context.Context) (err error) {
+	hostArgs, err := l.accelArgs()
+	if err != nil {
+		return newError(StageAccel, err)
+	}
+	if l.opt.Resources != nil {
+		sizing, err := l.sizeResources()
+		if err != nil {
+			return newError(StageResources, err)
+		}
+		hostArgs = append(hostArgs, sizing...)
+	}
+	l.workDir, err = os.MkdirTemp("", "containervm-*")
+	if err != nil {
+		return newError(StageQEMU, errors.WithMessage(err, "failed to create temp dir"))
+	}
+	defer func() {
+		if err != nil {
+			if cleanErr := l.cleanup(); cleanErr != nil {
+				log.Errorf("failed to clean up: %+v", cleanErr)
+			}
+		}
+	}()
+	var (
+		networkArgs []string
+		extraFiles  []*os.File
+	)
+	switch l.opt.NetworkMode {
+	case NetworkModeUser:
+		networkArgs, err = l.setupUserNetwork()
+		if err != nil {
+			return err
+		}
+	default:
+		networkArgs, extraFiles, err = l.setupPodNetwork(hostArgs)
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range extraFiles {
+		// The child process closes its copy at exit.
+		defer f.Close()
+	}
+	devices := append(hostArgs, networkArgs...)
+	l.qmpSocketPath = l.opt.QMPSocketPath
+	if l.qmpSocketPath == "" {
+		l.qmpSocketPath = filepath.Join(l.workDir, "qmp.sock")
+	}
+	devices = append(devices, generateQMPOpt(l.qmpSocketPath)...)
+	args, err := l.qemuArgs(devices)
+	if err != nil {
+		return newError(StageOptions, err)
+	}
+	log.Infof("run qemu with command: %s", strings.Join(args, " "))
+	l.cmd = exec.CommandContext(ctx, args[0], args[1:]...)
+	l.cmd.Stdin = l.opt.Stdin
+	l.cmd.Stdout = l.opt.Stdout
+	l.cmd.Stderr = l.opt.Stderr
+	l.cmd.ExtraFiles = extraFiles
+	if err := l.cmd.Start(); err != nil {
+		return newError(StageQEMU, errors.WithMessage(err, "failed to start qemu"))
+	}
+	go l.connectQMP(ctx)
+	l.serveForwards()
+	return nil
+}
+
+// setupPodNetwork bridges the pod network into the VM. It returns qemu options of the network and the files
+// passed to qemu by them. `hostArgs` are qemu options decided by the host, such as -smp.
+func (l *Launcher) setupPodNetwork(hostArgs []string) (args []string, extraFiles []*os.File, err error) {
+	var (
+		nameservers   []string
+		searchDomains []string
+	)
+	if l.opt.InheritResolv {
+		nameservers, searchDomains, err = getNameserversAndSearchDomain()
+		if err != nil {
+			return nil, nil, newError(StageResolv, errors.WithMessage(err,
+				"failed to get nameservers and search domains"))
+		}
+	}
+	nameservers = append(nameservers, l.opt.Nameservers...)
+	if l.opt.JournalPath != "" && len(journalPaths(l.opt.JournalPath)) > 0 {
+		log.Warnf("found journal %s of an unfinished run, recover network first", l.opt.JournalPath)
+		if err = RecoverNetwork(l.opt.JournalPath); err != nil {
+			return nil, nil, newError(StageNetwork, err)
+		}
+	}
+	queues, err := l.networkQueues(hostArgs)
+	if err != nil {
+		return nil, nil, newError(StageOptions, err)
+	}
+	vhost := l.vhostEnabled()
+	nics, err := l.podNICs()
+	if err != nil {
+		return nil, nil, newError(StageNetwork, err)
+	}
+	nws, cleanFunc, err := configureNetworks(l.opt.NetworkBackend, nics, parseNameservers(nameservers), searchDomains,
+		l.opt.DHCP, l.opt.PXE, l.opt.GratuitousARPCount, l.opt.JournalPath)
+	if err != nil {
+		return nil, nil, newError(StageNetwork, err)
+	}
+	l.networks = nws
+	l.cleanFunc = cleanFunc
+	defer func() {
+		if err != nil {
+			for _, f := range extraFiles {
+				_ = f.Close()
+			}
+		}
+	}()
+	var cloudInit bool
+	for i, nw := range nws {
+		tapFiles, err := nw.openTap(queues)
+		if err != nil {
+			return nil, extraFiles, newError(StageNetwork, err)
+		}
+		var fds []int
+		for range tapFiles {
+			// ExtraFiles[i] becomes file descriptor 3+i in qemu.
+			fds = append(fds, 3+len(extraFiles)+len(fds))
+		}
+		args = append(args, generateQEMUNetworkOpt(fmt.Sprintf("net%d", i), fds, vhost, nw.BridgeMacAddr,
+			nw.MTU)...)
+		extraFiles = append(extraFiles, tapFiles...)
+		cloudInit = cloudInit || nw.Gateway6 != nil
+	}
+	// Guests only configure the first interface by DHCP without a network config.
+	if cloudInit || len(nws) > 1 {
+		log.Infof("use cloud-init to setup network...")
+		cloudInitOpt, err := generateCloudInitOpt(nws, l.workDir)
+		if err != nil {
+			return nil, extraFiles, newError(StageCloudInit, err)
+		}
+		args = append(args, cloudInitOpt...)
+	}
+	return args, extraFiles, nil
+}
+
+// podNICs returns the pod interfaces to be bridged into the VM, see Options.Interfaces.
+func (l *Launcher) podNICs() ([]*util.NIC, error) {
+	if len(l.opt.Interfaces) > 0 {
+		var nics []*util.NIC
+		for _, name := range l.opt.Interfaces {
+			nic, err := util.GetNIC(name)
+			if err != nil {
+				return nil, err
+			}
+			nics = append(nics, nic)
+		}
+		return nics, nil
+	}
+	defaultNIC, err := util.GetDefaultNIC()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to get default nic")
+	}
+	nics := []*util.NIC{defaultNIC}
+	if !l.opt.AllInterfaces {
+		return nics, nil
+	}
+	all, err := util.ListNICs()
+	if err != nil {
+		return nil, err
+	}
+	for _, nic := range all {
+		if nic.Index != defaultNIC.Index {
+			nics = append(nics, nic)
+		}
+	}
+	return nics, nil
+}
+
+// qemuArgs builds the qemu command line from Options.Spec or Options.QEMUArgs, with `devices` appended.
+func (l *Launcher) qemuArgs(devices []string) ([]string, error) {
+	if l.opt.Spec != nil {
+		return l.opt.Spec.Args(devices...)
+	}
+	return append(append([]string{}, l.opt.QEMUArgs...), devices...), nil
+}
+
+// Wait waits for qemu to exit, stops servers for the VM and restores the network.
+// The returned error is *exec.ExitError wrapped in *Error if qemu exits with a non-zero code, a failed cleanup is
+// logged then, so that ExitCode still reports qemu's code.
+func (l *Launcher) Wait() error {
+	if l.cmd == nil {
+		return newError(StageQEMU, errors.New("qemu is not started"))
+	}
+	l.waitOnce.Do(func() {
+		waitErr := l.cmd.Wait()
+		close(l.exited)
+		if waitErr != nil {
+			l.waitErr = newError(StageQEMU, waitErr)
+		}
+		if err := l.cleanup(); err != nil {
+			if l.waitErr == nil {
+				l.waitErr = err
+				return
+			}
+			if l.opt.JournalPath == "" {
+				log.Errorf("%+v", err)
+				return
+			}
+			log.Errorf("%+v, run `containervm recover --journal %s` to restore the network", err,
+				l.opt.JournalPath)
+		}
+	})
+	return l.waitErr
+}
+
+// ExitCode returns the exit code of qemu, 128+signo if qemu was killed by a signal, or -1 if qemu hasn't exited.
+func (l *Launcher) ExitCode() int {
+	if l.cmd == nil || l.cmd.ProcessState == nil {
+		return -1
+	}
+	return exitStatus(l.cmd.ProcessState)
+}
+
+// DefaultShutdownTimeout is the default Options.ShutdownTimeout.
+// With the SIGTERM grace period, it fits in the default termination grace period of kubernetes pods (30s).
+const DefaultShutdownTimeout = time.Second * 20
+
+// sigtermGracePeriod is how long Shutdown waits for qemu to exit after SIGTERM before killing it.
+const sigtermGracePeriod = time.Second * 5
+
+// Shutdown powers off the guest gracefully by an ACPI power button event, so that guest filesystems are not
+// corrupted. If the guest doesn't power off in Options.ShutdownTimeout, qemu is terminated by SIGTERM,
+// and then killed by SIGKILL. The network is restored by Wait.
+func (l *Launcher) Shutdown() error {
+	if l.cmd == nil || l.cmd.Process == nil {
+		return nil
+	}
+	timeout := l.opt.ShutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	if err := l.powerdown(); err != nil {
+		log.Warnf("failed to power down the guest: %+v", err)
+	} else {
+		log.Infof("waiting up to %s for the guest to power off", timeout)
+		if l.waitExit(timeout) {
+			return nil
+		}
+		log.Warnf("guest didn't power off in %s", timeout)
+	}
+	log.Warnf("sending SIGTERM to qemu")
+	if err := l.cmd.Process.Signal(syscall.SIGTERM); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		log.Warnf("failed to send SIGTERM to qemu: %+v", err)
+	}
+	if l.waitExit(sigtermGracePeriod) {
+		return nil
+	}
+	log.Warnf("qemu didn't exit in %s after SIGTERM, sending SIGKILL", sigtermGracePeriod)
+	return l.Stop()
+}
+
+// powerdown requests the guest to power down via QMP.
+func (l *Launcher) powerdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	client, err := l.QMP(ctx)
+	if err != nil {
+		return errors.WithMessage(err, "qmp is not available")
+	}
+	log.Infof("sending ACPI powerdown to the guest")
+	return client.SystemPowerdown(ctx)
+}
+
+// waitExit reports whether qemu exits in `timeout`. It requires Wait to be running.
+func (l *Launcher) waitExit(timeout time.Duration) bool {
+	select {
+	case <-l.exited:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Stop kills qemu. The network is restored by Wait.
+func (l *Launcher) Stop() error {
+	if l.cmd == nil || l.cmd.Process == nil {
+		return nil
+	}
+	if err := l.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return newError(StageQEMU, errors.WithMessage(err, "failed to kill qemu"))
+	}
+	return nil
+}
+
+// cleanup restores the network and removes temporary files.
+func (l *Launcher) cleanup() error {
+	l.closeForwards()
+	select {
+	case <-l.qmpReady:
+		_ = l.qmpClient.Close()
+	default:
+	}
+	if l.workDir != "" {
+		if err := os.RemoveAll(l.workDir); err != nil {
+			log.Warnf("failed to remove %s: %+v", l.workDir, err)
+		}
+	}
+	if l.cleanFunc == nil {
+		return nil
+	}
+	log.Infof("cleaning up network...")
+	cleanFunc := l.cleanFunc
+	l.cleanFunc = nil
+	if err := cleanFunc(); err != nil {
+		return newError(StageCleanup, errors.WithMessage(err, "failed to clean up network"))
+	}
+	return nil
+}
+
+// DefaultJournalPath is the default path of the network journal.
+const DefaultJournalPath = "/run/containervm/network.json"
+
+// RecoverNetwork restores the pod network from the journal at `journalPath`, and journals of other NICs beside it.
+// It's used to clean up after a containervm which was killed without restoring the network.
+func RecoverNetwork(journalPath string) error {
+	paths := journalPaths(journalPath)
+	if len(paths) == 0 {
+		log.Infof("journal %s doesn't exist, nothing to recover", journalPath)
+		return nil
+	}
+	for _, path := range paths {
+		if err := network.RecoverFromJournal(path); err != nil {
+			return newError(StageCleanup, errors.WithMessagef(err, "failed to recover network from journal %s", path))
+		}
+		log.Infof("network is recovered from journal %s", path)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package vm
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cox96de/containervm/cloudinit"
+	"github.com/cox96de/containervm/qemu"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"gotest.tools/v3/assert"
+)
+
+func TestNewLauncher(t *testing.T) {
+	_, err := NewLauncher(&Options{})
+	var e *Error
+	assert.Assert(t, errors.As(err, &e))
+	assert.Equal(t, e.Stage, StageOptions)
+	l, err := NewLauncher(&Options{QEMUArgs: []string{"qemu-system-x86_64"}})
+	assert.NilError(t, err)
+	assert.Assert(t, l.Network() == nil)
+	assert.Equal(t, len(l.Networks()), 0)
+	assert.Equal(t, l.ExitCode(), -1)
+	assert.NilError(t, l.Stop())
+	_, err = NewLauncher(&Options{QEMUArgs: []string{"qemu-system-x86_64"}, AllInterfaces: true,
+		Interfaces: []string{"eth0"}})
+	assert.ErrorContains(t, err, "mutually exclusive")
+	_, err = NewLauncher(&Options{QEMUArgs: []string{"qemu-system-x86_64"}, GratuitousARPCount: -1})
+	assert.ErrorContains(t, err, "bad number of gratuitous arp")
+}
+
+func TestGenerateQEMUNetworkOpt(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:ac:11:00:02")
+	opt := generateQEMUNetworkOpt("net0", []int{3}, true, mac, 1450)
+	assert.DeepEqual(t, opt, []string{"-netdev", "tap,id=net0,vhost=on,fd=3",
+		"-device", "virtio-net-pci,netdev=net0,mac=02:42:ac:11:00:02,host_mtu=1450"})
+	opt = generateQEMUNetworkOpt("net1", []int{4, 5, 6, 7}, false, mac, 1500)
+	assert.DeepEqual(t, opt, []string{"-netdev", "tap,id=net1,vhost=off,fds=4:5:6:7,queues=4",
+		"-device", "virtio-net-pci,netdev=net1,mq=on,vectors=10,mac=02:42:ac:11:00:02,host_mtu=1500"})
+}
+
+func TestJournalPaths(t *testing.T) {
+	dir := t.TempDir()
+	journalPath := filepath.Join(dir, "network.json")
+	assert.Equal(t, nicJournalPath(journalPath, "net1"), filepath.Join(dir, "network-net1.json"))
+	assert.Equal(t, len(journalPaths(journalPath)), 0)
+	for _, path := range []string{journalPath, nicJournalPath(journalPath, "net1"), journalPath + ".123"} {
+		assert.NilError(t, os.WriteFile(path, []byte("{}"), 0o644))
+	}
+	assert.DeepEqual(t, journalPaths(journalPath), []string{journalPath, nicJournalPath(journalPath, "net1")})
+}
+
+func TestNetworkConfigs(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("10.18.0.0/16")
+	addr, _ := netlink.ParseIPNet("172.18.0.2/16")
+	_, subnet, _ := net.ParseCIDR("172.18.0.0/16")
+	// Routes are shaped as snapshots, which give default routes a /0 destination.
+	_, defaultDst, _ := net.ParseCIDR("0.0.0.0/0")
+	_, defaultDst6, _ := net.ParseCIDR("::/0")
+	// Like Calico, a /32 pod address reaches its gateway by an on-link host route.
+	podAddr, _ := netlink.ParseIPNet("10.0.0.5/32")
+	_, podGwDst, _ := net.ParseCIDR("169.254.1.1/32")
+	configs := networkConfigs([]*Network{{
+		BridgeMacAddr: net.HardwareAddr{2, 0x42, 0xac, 0x12, 0, 2},
+		Address:       []*net.IPNet{addr},
+		Gateway:       net.ParseIP("172.18.0.1"),
+		Gateway6:      net.ParseIP("fe80::1"),
+		Routes: []netlink.Route{
+			{Table: unix.RT_TABLE_MAIN, Dst: defaultDst, Gw: net.ParseIP("172.18.0.1")},
+			{Table: unix.RT_TABLE_MAIN, Dst: defaultDst6, Gw: net.ParseIP("fe80::1")},
+			{Table: unix.RT_TABLE_MAIN, Dst: subnet, Scope: netlink.SCOPE_LINK},
+			{Table: unix.RT_TABLE_MAIN, Dst: dst, Gw: net.ParseIP("172.18.0.1")},
+		},
+	}, {
+		BridgeMacAddr: net.HardwareAddr{2, 0x42, 0xac, 0x12, 0, 3},
+		Address:       []*net.IPNet{podAddr},
+		Gateway:       net.ParseIP("169.254.1.1"),
+		Routes: []netlink.Route{
+			{Table: unix.RT_TABLE_MAIN, Dst: defaultDst, Gw: net.ParseIP("169.254.1.1")},
+			{Table: unix.RT_TABLE_MAIN, Dst: podGwDst, Scope: netlink.SCOPE_LINK},
+		},
+	}})
+	assert.Equal(t, len(configs), 2)
+	assert.DeepEqual(t, configs[0].Routes, []*cloudinit.Route{{To: dst, Via: net.ParseIP("172.18.0.1")}})
+	assert.DeepEqual(t, configs[1].Routes, []*cloudinit.Route{{To: podGwDst}})
+}
+
+func TestParseNameservers(t *testing.T) {
+	ns := parseNameservers([]string{"127.0.0.11", "8.8.8.8", "::1", "2001:4860:4860::8888"})
+	assert.DeepEqual(t, ns, []net.IP{net.ParseIP("8.8.8.8"), net.ParseIP("2001:4860:4860::8888")})
+}
+
+func TestGenerateQMPOpt(t *testing.T) {
+	assert.DeepEqual(t, generateQMPOpt("/tmp/qmp.sock"), []string{"-qmp", "unix:/tmp/qmp.sock,server=on,wait=off"})
+}
+
+func TestShutdownWithoutQMP(t *testing.T) {
+	l, err := NewLauncher(&Options{QEMUArgs: []string{"sleep", "30"}, ShutdownTimeout: time.Second})
+	assert.NilError(t, err)
+	l.cmd = exec.Command("sleep", "30")
+	assert.NilError(t, l.cmd.Start())
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- l.Wait()
+	}()
+	// QMP is never connected, so qemu is terminated by SIGTERM.
+	assert.NilError(t, l.Shutdown())
+	var exitErr *exec.ExitError
+	assert.Assert(t, errors.As(<-waitErr, &exitErr))
+	assert.Equal(t, exitErr.Sys().(syscall.WaitStatus).Signal(), syscall.SIGTERM)
+	assert.Equal(t, l.ExitCode(), 128+int(syscall.SIGTERM))
+}
+
+func TestWaitCleanupError(t *testing.T) {
+	hook := logtest.NewGlobal()
+	t.Cleanup(hook.Reset)
+	l, err := NewLauncher(&Options{QEMUArgs: []string{"sh"}, JournalPath: "/run/test/network.json"})
+	assert.NilError(t, err)
+	l.cmd = exec.Command("sh", "-c", "exit 3")
+	l.cleanFunc = func() error {
+		return errors.New("failed to restore routes")
+	}
+	assert.NilError(t, l.cmd.Start())
+	// qemu's error and exit code are kept, and the cleanup error is logged.
+	err = l.Wait()
+	var exitErr *exec.ExitError
+	assert.Assert(t, errors.As(err, &exitErr))
+	assert.Equal(t, l.ExitCode(), 3)
+	entry := hook.LastEntry()
+	assert.Assert(t, entry != nil)
+	assert.Equal(t, entry.Level, log.ErrorLevel)
+	assert.Assert(t, strings.Contains(entry.Message, "failed to restore routes"), entry.Message)
+	assert.Assert(t, strings.Contains(entry.Message, "recover --journal /run/test/network.json"), entry.Message)
+}
+
+func TestExitCode(t *testing.T) {
+	run := func(name string, args ...string) error {
+		return exec.Command(name, args...).Run()
+	}
+	assert.Equal(t, ExitCode(nil), 0)
+	assert.Equal(t, ExitCode(newError(StageQEMU, run("sh", "-c", "exit 3"))), 3)
+	assert.Equal(t, ExitCode(newError(StageQEMU, run("sh", "-c", "kill -KILL $$"))), 128+int(syscall.SIGKILL))
+	assert.Equal(t, ExitCode(newError(StageNetwork, errors.New("no default nic"))), ExitCodeNetwork)
+	assert.Equal(t, ExitCode(newError(StageQEMU, run("/nonexistent/qemu"))), ExitCodeQEMU)
+	assert.Equal(t, ExitCode(errors.New("unknown")), 1)
+}
+
+func TestQEMUArgs(t *testing.T) {
+	_, err := NewLauncher(&Options{QEMUArgs: []string{"qemu-system-x86_64"}, Spec: &qemu.Spec{}})
+	assert.ErrorContains(t, err, "mutually exclusive")
+	_, err = NewLauncher(&Options{Spec: &qemu.Spec{CPUs: -1}})
+	assert.ErrorContains(t, err, "invalid spec")
+	devices := generateQEMUNetworkOpt("net0", []int{3}, true, net.HardwareAddr{2, 0x42, 0xac, 0x11, 0, 2}, 1500)
+	l, err := NewLauncher(&Options{Spec: &qemu.Spec{Memory: "1G", ExtraArgs: []string{"-device", "VGA"}}})
+	assert.NilError(t, err)
+	args, err := l.qemuArgs(devices)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, args[len(args)-6:], []string{"-netdev", "tap,id=net0,vhost=on,fd=3",
+		"-device", "virtio-net-pci,netdev=net0,mac=02:42:ac:11:00:02,host_mtu=1500", "-device", "VGA"})
+	l, err = NewLauncher(&Options{QEMUArgs: []string{"qemu-system-x86_64", "-m", "1G"}})
+	assert.NilError(t, err)
+	args, err = l.qemuArgs(devices)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, args, append([]string{"qemu-system-x86_64", "-m", "1G"}, devices...))
+}
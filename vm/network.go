@@ -0,0 +1,442 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cox96de/containervm/network"
+	"github.com/cox96de/containervm/util"
+	"github.com/jackpal/gateway"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/exp/rand"
+)
+
+// DefaultGratuitousARPCount is the number of gratuitous ARP packets sent for an address, as many as arping sends by
+// default.
+const DefaultGratuitousARPCount = 3
+
+// Network describes a pod network which is bridged into the VM.
+type Network struct {
+	// NIC is the pod NIC the VM is bridged to.
+	NIC *util.NIC
+	// Address is the addresses of NIC, they are handed to the VM.
+	Address []*net.IPNet
+	// Gateway is the ipv4 default gateway, nil if absent.
+	Gateway net.IP
+	// Gateway6 is the ipv6 default gateway, nil if absent.
+	Gateway6 net.IP
+	// BridgeName is the tap device of the VM: the path of the macvtap device file, or the name of the tap device.
+	BridgeName string
+	// BridgeMacAddr is the MAC address of the VM, it's the original MAC of NIC.
+	BridgeMacAddr net.HardwareAddr
+	// MTU is the MTU of NIC.
+	MTU int
+	// Routes are the routes via NIC.
+	Routes []netlink.Route
+
+	backend network.Backend
+}
+
+// openTap opens `queues` queues of the tap device of the VM, which are passed to qemu.
+func (n *Network) openTap(queues int) ([]*os.File, error) {
+	return n.backend.OpenTap(queues)
+}
+
+// configureNetworks bridges `nics` to tap devices for the VM by the network backend `backendKind`, in order.
+// `dhcpOpt` configures dhcp servers of the NICs, and `pxeOpt` configures network boot of the first NIC.
+// They may be nil. `announceCount` is how many times addresses of the VM are announced once it gets them,
+// see network.Announce.
+// The original states of the NICs are journaled beside `journalPath` if it's not empty, see journalPaths.
+// Networks configured are rolled back if any of them fails.
+func configureNetworks(backendKind string, nics []*util.NIC, dnsServers []net.IP, searchDomains []string,
+	dhcpOpt *DHCPOptions, pxeOpt *PXEOptions, announceCount int, journalPath string) (nws []*Network,
+	clean func() error, err error) {
+	var cleans []func() error
+	clean = func() error {
+		var firstErr error
+		// Roll back in the reverse order.
+		for i := len(cleans) - 1; i >= 0; i-- {
+			if err := cleans[i](); err != nil {
+				log.Errorf("failed to clean up network: %+v", err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		return firstErr
+	}
+	for i, nic := range nics {
+		nicJournal := journalPath
+		nicPXE := pxeOpt
+		if i > 0 {
+			if journalPath != "" {
+				nicJournal = nicJournalPath(journalPath, nic.Name)
+			}
+			nicPXE = nil
+		}
+		nw, nicClean, err := configureNetwork(backendKind, nic, dnsServers, searchDomains, dhcpOpt, nicPXE,
+			announceCount, nicJournal)
+		if err != nil {
+			return nil, nil, recoverOnError(clean, errors.WithMessagef(err, "failed to configure nic %s", nic.Name))
+		}
+		cleans = append(cleans, nicClean)
+		nws = append(nws, nw)
+	}
+	return nws, clean, nil
+}
+
+// configureNetwork bridges `nic` to a tap device for the VM by the network backend `backendKind`.
+// The original state of the NIC is journaled at `journalPath` if it's not empty.
+func configureNetwork(backendKind string, nic *util.NIC, dnsServers []net.IP, searchDomains []string,
+	dhcpOpt *DHCPOptions, pxeOpt *PXEOptions, announceCount int, journalPath string) (nw *Network,
+	clean func() error, err error) {
+	nw = &Network{
+		NIC:           nic,
+		BridgeMacAddr: nic.HardwareAddr,
+		MTU:           nic.MTU,
+	}
+	ipv4Gateway, err := util.GetGateway(nic.Index, netlink.FAMILY_V4)
+	if err != nil {
+		log.Warnf("failed to get ipv4 gateway address of nic %s: %+v", nic.Name, err)
+	}
+	nw.Gateway = ipv4Gateway
+	ipv6Gateway, err := util.GetGateway(nic.Index, netlink.FAMILY_V6)
+	if err != nil {
+		log.Warnf("failed to get ipv6 gateway address of nic %s: %+v", nic.Name, err)
+	}
+	nw.Gateway6 = ipv6Gateway
+	ifIP, err := gateway.DiscoverInterface()
+	if err != nil {
+		log.Warnf("failed to get default gateway interface: %+v", err)
+	}
+	log.Infof("reconfiguring nic %s", nic.Name)
+	defaultNIC, err := net.InterfaceByName(nic.Name)
+	if err != nil {
+		return nil, nil, errors.WithMessagef(err, "failed to get nic %s", nic.Name)
+	}
+	addrs, err := defaultNIC.Addrs()
+	if err != nil {
+		return nil, nil, errors.WithMessagef(err, "failed to get addresses of nic %s", nic.Name)
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		nw.Address = append(nw.Address, ipNet)
+	}
+	var ipv6Addr *net.IPNet
+	for _, addr := range nw.Address {
+		if addr.IP.To4() == nil && !addr.IP.IsLinkLocalUnicast() {
+			ipv6Addr = addr
+			break
+		}
+	}
+	// Resolve gateways before the NIC is bridged to the VM.
+	var gatewayMacAddr, gateway6MacAddr net.HardwareAddr
+	if ipv4Gateway != nil {
+		gatewayMacAddr, err = network.ResolveHardwareAddr(context.Background(), nic.Name, ipv4Gateway)
+		if err != nil {
+			log.Warnf("failed to get gateway mac address for ipv4 gateway %+v: %+v", ipv4Gateway, err)
+		}
+	}
+	if ipv6Gateway != nil {
+		gateway6MacAddr, err = network.ResolveHardwareAddr(context.Background(), nic.Name, ipv6Gateway)
+		if err != nil {
+			log.Warnf("failed to get gateway mac address for ipv6 gateway %+v: %+v", ipv6Gateway, err)
+		}
+	}
+	var ipv4Addr net.Addr
+	for _, addr := range addrs {
+		switch ip := addr.(type) {
+		case *net.IPAddr:
+			if !ifIP.Equal(ip.IP) {
+				continue
+			}
+		case *net.IPNet:
+			if !ifIP.Equal(ip.IP) {
+				continue
+			}
+		default:
+			continue
+		}
+		ipv4Addr = addr
+		break
+	}
+	if ipv4Addr == nil {
+		// It's not the default NIC, use its first ipv4 address.
+		for _, addr := range nw.Address {
+			if addr.IP.To4() != nil {
+				ipv4Addr = addr
+				break
+			}
+		}
+	}
+
+	tapName := fmt.Sprintf("macvtap%s", randomString(3))
+	lanName := fmt.Sprintf("macvlan%s", randomString(3))
+	switch backendKind {
+	case network.BackendBridge:
+		tapName = fmt.Sprintf("tap%s", randomString(3))
+		lanName = fmt.Sprintf("br%s", randomString(3))
+	case network.BackendIPVtap:
+		tapName = fmt.Sprintf("ipvtap%s", randomString(3))
+		lanName = fmt.Sprintf("ipvlan%s", randomString(3))
+	}
+	configure, err := network.NewBackend(backendKind, nic.Name, util.GetRandomMAC(), tapName, lanName)
+	if err != nil {
+		return nil, nil, err
+	}
+	configure.SetJournal(journalPath)
+	servers := newServerGroup()
+	clean = func() error {
+		// Servers must leave the interfaces before the backend deletes them.
+		servers.stop()
+		return configure.Recover()
+	}
+	err = configure.Setup()
+	if err != nil {
+		// Recover also rolls back a half-done Setup.
+		return nil, nil, recoverOnError(clean, errors.WithMessagef(err, "failed to set up %s backend", backendKind))
+	}
+	nw.backend = configure
+	nw.Routes = configure.GetRoutes()
+	// Servers for the VM run on the interface sharing the link with the VM.
+	lanName = configure.ServiceInterface()
+
+	log.Infof("tap device %s is created", tapName)
+	// Start a DHCP server.
+	hostname, _ := os.Hostname()
+	// Neighbors learn the VM is at the MAC of the pod once it gets the address, before it sends any traffic.
+	announce := func(ip net.IP) {
+		if announceCount <= 0 {
+			return
+		}
+		servers.run(fmt.Sprintf("announcement of %s", ip), func(ctx context.Context) error {
+			return network.Announce(ctx, lanName, ip, nic.HardwareAddr, announceCount)
+		})
+	}
+
+	var tftpIP net.IP
+	if ipv4Addr != nil && pxeOpt != nil && pxeOpt.TFTPRoot != "" {
+		// The TFTP server uses the service address rather than one in the subnet of the VM, which may belong to
+		// another pod. The VM reaches it by an on-link classless static route, see PXEOptions.apply.
+		tftpIP = network.ServiceAddr()
+		ts, err := network.NewTFTPServer(&network.TFTPOption{
+			Root:         pxeOpt.TFTPRoot,
+			IP:           tftpIP,
+			HardwareAddr: nic.HardwareAddr,
+		})
+		if err != nil {
+			return nil, nil, recoverOnError(clean, errors.WithMessage(err, "failed to create tftp server"))
+		}
+		log.Infof("start tftp server at %s on %s", tftpIP, lanName)
+		servers.run("tftp server", func(ctx context.Context) error {
+			return ts.Run(ctx, lanName)
+		})
+	}
+	if ipv4Addr != nil {
+		log.Infof("start dhcp server on %s", lanName)
+		serverOpt := &network.DHCPOption{
+			HardwareAddr:  nic.HardwareAddr,
+			IP:            ipv4Addr,
+			GatewayIP:     ipv4Gateway,
+			DNSServers:    dnsServers,
+			SearchDomains: searchDomains,
+			Hostname:      hostname,
+			Routes:        configure.GetRoutes(),
+			MTU:           nic.MTU,
+			OnLease:       announce,
+		}
+		dhcpOpt.apply(serverOpt, searchDomains)
+		pxeOpt.apply(serverOpt, tftpIP)
+		ds, err := network.NewDHCPServerFromAddr(serverOpt)
+		if err != nil {
+			return nil, nil, recoverOnError(clean, errors.WithMessage(err, "failed to create dhcp server"))
+		}
+		servers.run("dhcp server", func(ctx context.Context) error {
+			return ds.Run(ctx, lanName)
+		})
+	}
+	// The ARP server resolves the gateway again if it fails here.
+	if (ipv4Addr != nil && ipv4Gateway != nil) || tftpIP != nil {
+		log.Infof("start arp server")
+		arpOpt := &network.ARPOption{
+			HardwareAddr:        nic.HardwareAddr,
+			Addr:                ipv4Addr,
+			Gateway:             ipv4Gateway,
+			GatewayHardwareAddr: gatewayMacAddr,
+		}
+		if tftpIP != nil {
+			arpOpt.LocalIPs = append(arpOpt.LocalIPs, tftpIP)
+		}
+		servers.run("arp server", func(ctx context.Context) error {
+			return network.ServeARP(ctx, lanName, arpOpt)
+		})
+	}
+	if ipv6Addr != nil && ipv6Gateway != nil {
+		log.Infof("start dhcpv6 server")
+		ds, err := network.NewDHCPv6Server(&network.DHCPv6Option{
+			HardwareAddr:  nic.HardwareAddr,
+			IP:            ipv6Addr.IP,
+			DNSServers:    dnsServers,
+			SearchDomains: searchDomains,
+			OnLease:       announce,
+		})
+		if err != nil {
+			return nil, nil, recoverOnError(clean, errors.WithMessage(err, "failed to create dhcpv6 server"))
+		}
+		servers.run("dhcpv6 server", func(ctx context.Context) error {
+			return ds.Run(ctx, lanName)
+		})
+	}
+	if ipv6Addr != nil && ipv6Gateway != nil && gateway6MacAddr != nil {
+		log.Infof("start router advertisement responder")
+		raOpt := &network.RAOption{
+			HardwareAddr:       nic.HardwareAddr,
+			RouterHardwareAddr: gateway6MacAddr,
+			Prefixes:           []*net.IPNet{ipv6Addr},
+			DNSServers:         dnsServers,
+			SearchDomains:      searchDomains,
+			MTU:                nic.MTU,
+		}
+		if ipv6Gateway.IsLinkLocalUnicast() {
+			raOpt.Router = ipv6Gateway
+		}
+		if backendKind == network.BackendIPVtap {
+			// ipvlan drops frames to addresses which are not of the VM, such as the all nodes address.
+			raOpt.Destination = linkLocalAddr(nw.Address)
+		}
+		servers.run("router advertisement responder", func(ctx context.Context) error {
+			return network.ServeRA(ctx, lanName, raOpt)
+		})
+		log.Infof("start ndp server")
+		ndpOpt := &network.NDPOption{
+			HardwareAddr:        nic.HardwareAddr,
+			Addr:                ipv6Addr,
+			GatewayHardwareAddr: gateway6MacAddr,
+		}
+		servers.run("ndp server", func(ctx context.Context) error {
+			return network.ServeNDP(ctx, lanName, ndpOpt)
+		})
+	}
+	nw.BridgeName = tapName
+	switch b := configure.(type) {
+	case *network.BridgeConfigure:
+		nw.BridgeName = b.GetMacVtapDevicePath()
+	case *network.IPVtapConfigure:
+		nw.BridgeName = b.GetTapDevicePath()
+	}
+	return nw, clean, nil
+}
+
+// linkLocalAddr returns the ipv6 link-local address in `addrs`, or nil if absent.
+func linkLocalAddr(addrs []*net.IPNet) net.IP {
+	for _, addr := range addrs {
+		if addr.IP.To4() == nil && addr.IP.IsLinkLocalUnicast() {
+			return addr.IP
+		}
+	}
+	return nil
+}
+
+// serverGroup runs servers for the VM, such as the DHCP server, until they are stopped.
+type serverGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	// mu makes run and stop exclusive, servers may be run by others, such as announcements by the DHCP server.
+	mu sync.Mutex
+	wg sync.WaitGroup
+}
+
+func newServerGroup() *serverGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &serverGroup{ctx: ctx, cancel: cancel}
+}
+
+// run runs `serve` in background. `name` is logged if it fails. It's a no-op after stop.
+func (g *serverGroup) run(name string, serve func(ctx context.Context) error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.ctx.Err() != nil {
+		return
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := serve(g.ctx); err != nil {
+			log.Errorf("%s stopped: %+v", name, err)
+		}
+	}()
+}
+
+// stop stops all servers and waits for them to return.
+func (g *serverGroup) stop() {
+	g.mu.Lock()
+	g.cancel()
+	g.mu.Unlock()
+	g.wg.Wait()
+}
+
+// recoverOnError runs clean to roll back a half-configured network and returns err.
+func recoverOnError(clean func() error, err error) error {
+	if cleanErr := clean(); cleanErr != nil {
+		log.Errorf("failed to clean up network: %+v", cleanErr)
+	}
+	return err
+}
+
+// generateQEMUNetworkOpt generates qemu options to attach the tap device to the VM as the netdev `id`.
+// `fds` are file descriptors of queues of the tap device in the qemu process, the NIC is multi-queue if there
+// are more than one. `vhost` enables vhost-net.
+func generateQEMUNetworkOpt(id string, fds []int, vhost bool, macAddr net.HardwareAddr, mtu int) []string {
+	vhostOpt := "off"
+	if vhost {
+		vhostOpt = "on"
+	}
+	netdev := fmt.Sprintf("tap,id=%s,vhost=%s,fd=%d", id, vhostOpt, fds[0])
+	device := "virtio-net-pci,netdev=" + id
+	if len(fds) > 1 {
+		var fdList []string
+		for _, fd := range fds {
+			fdList = append(fdList, strconv.Itoa(fd))
+		}
+		netdev = fmt.Sprintf("tap,id=%s,vhost=%s,fds=%s,queues=%d", id, vhostOpt, strings.Join(fdList, ":"), len(fds))
+		// A vector for each of the rx and tx queues, plus ones for config and control.
+		device += fmt.Sprintf(",mq=on,vectors=%d", 2*len(fds)+2)
+	}
+	return []string{"-netdev", netdev,
+		"-device", device + ",mac=" + macAddr.String() + ",host_mtu=" + strconv.Itoa(mtu)}
+}
+
+// nicJournalPath returns the journal path of the NIC `name` besides the first one, such as network-net1.json
+// for network.json.
+func nicJournalPath(journalPath string, name string) string {
+	ext := filepath.Ext(journalPath)
+	return strings.TrimSuffix(journalPath, ext) + "-" + name + ext
+}
+
+// journalPaths returns paths of existing journals of `journalPath`, including ones of NICs besides the first one.
+func journalPaths(journalPath string) []string {
+	var paths []string
+	if network.JournalExists(journalPath) {
+		paths = append(paths, journalPath)
+	}
+	ext := filepath.Ext(journalPath)
+	matches, _ := filepath.Glob(strings.TrimSuffix(journalPath, ext) + "-*" + ext)
+	return append(paths, matches...)
+}
+
+func randomString(b int) string {
+	bs := make([]byte, b)
+	_, _ = rand.Read(bs)
+	return fmt.Sprintf("%x", bs)
+}
@@ -0,0 +1,73 @@
+package vm
+
+import (
+	"net"
+	"os"
+
+	"github.com/cox96de/containervm/network"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// PXEOptions configures network boot of the first NIC of the VM in NetworkModePod. qemu boots from the network if
+// the NIC is in its boot order, such as by `-boot n`.
+type PXEOptions struct {
+	// BootFile is the file PXE ROMs boot from, such as undionly.kpxe or ipxe.efi.
+	BootFile string
+	// IPXEScript is handed to iPXE instead of BootFile, such as http://10.0.0.1/boot.ipxe.
+	IPXEScript string
+	// TFTPRoot is the directory served to the VM by the built-in TFTP server, which is the boot server.
+	// The server listens on the service address, which the VM reaches by an on-link classless static route.
+	TFTPRoot string
+	// BootServer is an external boot server, such as a TFTP server. It's exclusive with TFTPRoot.
+	BootServer net.IP
+}
+
+// validate checks the options for the network backend `backendKind`.
+func (o *PXEOptions) validate(backendKind string) error {
+	if o.BootFile == "" && o.IPXEScript == "" {
+		return errors.New("boot file or ipxe script is required for pxe")
+	}
+	if o.TFTPRoot != "" && o.BootServer != nil {
+		return errors.New("tftp root and boot server are mutually exclusive")
+	}
+	if o.BootServer != nil && o.BootServer.To4() == nil {
+		return errors.Errorf("boot server %s is not an ipv4 address", o.BootServer)
+	}
+	if o.TFTPRoot == "" {
+		return nil
+	}
+	if backendKind == network.BackendIPVtap {
+		// ipvlan only delivers packets to addresses assigned to its devices.
+		return errors.Errorf("the tftp server is not supported by the %s backend", network.BackendIPVtap)
+	}
+	info, err := os.Stat(o.TFTPRoot)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to stat tftp root %s", o.TFTPRoot)
+	}
+	if !info.IsDir() {
+		return errors.Errorf("tftp root %s is not a directory", o.TFTPRoot)
+	}
+	return nil
+}
+
+// apply fills the boot options of `opt`, the boot server is `tftpIP` if the TFTP server runs. `tftpIP` is out of
+// the subnet of the VM, so an on-link route to it is added to the classless static routes. `o` may be nil.
+func (o *PXEOptions) apply(opt *network.DHCPOption, tftpIP net.IP) {
+	if o == nil {
+		return
+	}
+	opt.BootServer = o.BootServer
+	if tftpIP != nil {
+		opt.BootServer = tftpIP
+		opt.Routes = append(append([]netlink.Route(nil), opt.Routes...), netlink.Route{
+			Dst:   &net.IPNet{IP: tftpIP.To4(), Mask: net.CIDRMask(32, 32)},
+			Scope: netlink.SCOPE_LINK,
+			Table: unix.RT_TABLE_MAIN,
+			Type:  unix.RTN_UNICAST,
+		})
+	}
+	opt.BootFile = o.BootFile
+	opt.IPXEScript = o.IPXEScript
+}
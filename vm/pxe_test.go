@@ -0,0 +1,49 @@
+package vm
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/cox96de/containervm/network"
+	"gotest.tools/v3/assert"
+)
+
+func TestPXEOptions(t *testing.T) {
+	dir := t.TempDir()
+	for _, c := range []struct {
+		opt     *PXEOptions
+		backend string
+		err     string
+	}{
+		{opt: &PXEOptions{BootFile: "undionly.kpxe", TFTPRoot: dir}},
+		{opt: &PXEOptions{IPXEScript: "http://10.0.0.1/boot.ipxe", BootServer: net.ParseIP("10.0.0.1")}},
+		{opt: &PXEOptions{TFTPRoot: dir}, err: "boot file or ipxe script is required"},
+		{opt: &PXEOptions{BootFile: "undionly.kpxe", TFTPRoot: dir, BootServer: net.ParseIP("10.0.0.1")},
+			err: "mutually exclusive"},
+		{opt: &PXEOptions{BootFile: "undionly.kpxe", BootServer: net.ParseIP("fd00::1")}, err: "not an ipv4 address"},
+		{opt: &PXEOptions{BootFile: "undionly.kpxe", TFTPRoot: filepath.Join(dir, "not-exist")},
+			err: "failed to stat tftp root"},
+		{opt: &PXEOptions{BootFile: "undionly.kpxe", TFTPRoot: dir}, backend: network.BackendIPVtap,
+			err: "not supported"},
+	} {
+		err := c.opt.validate(c.backend)
+		if c.err == "" {
+			assert.NilError(t, err)
+		} else {
+			assert.ErrorContains(t, err, c.err)
+		}
+	}
+
+	opt := &network.DHCPOption{}
+	(*PXEOptions)(nil).apply(opt, nil)
+	assert.Assert(t, opt.BootServer == nil && opt.BootFile == "")
+	tftpIP := network.ServiceAddr()
+	(&PXEOptions{BootFile: "undionly.kpxe", TFTPRoot: dir}).apply(opt, tftpIP)
+	assert.Assert(t, opt.BootServer.Equal(tftpIP))
+	assert.Equal(t, opt.BootFile, "undionly.kpxe")
+	// The VM reaches the TFTP server by an on-link route.
+	assert.Equal(t, len(opt.Routes), 1)
+	assert.Equal(t, opt.Routes[0].Dst.String(), "240.0.0.1/32")
+	assert.Assert(t, opt.Routes[0].Gw == nil)
+}
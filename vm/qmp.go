@@ -0,0 +1,56 @@
+package vm
+
+import (
+	"context"
+	"time"
+
+	"github.com/cox96de/containervm/qmp"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// qmpDialInterval is the interval of retries to connect to the QMP socket, which is created by qemu after start.
+const qmpDialInterval = time.Millisecond * 100
+
+// generateQMPOpt generates qemu options to serve QMP on the unix socket `path`.
+func generateQMPOpt(path string) []string {
+	return []string{"-qmp", "unix:" + path + ",server=on,wait=off"}
+}
+
+// QMP returns the QMP client of the running qemu, waiting until it's connected.
+func (l *Launcher) QMP(ctx context.Context) (*qmp.Client, error) {
+	select {
+	case <-l.qmpReady:
+		return l.qmpClient, nil
+	case <-l.exited:
+		return nil, errors.New("qemu has exited")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// connectQMP connects to the QMP socket of qemu, retrying until it succeeds or qemu exits.
+func (l *Launcher) connectQMP(ctx context.Context) {
+	for {
+		dialCtx, cancel := context.WithTimeout(ctx, time.Second)
+		client, err := qmp.Dial(dialCtx, l.qmpSocketPath)
+		cancel()
+		if err == nil {
+			log.Infof("qmp is connected at %s", l.qmpSocketPath)
+			l.qmpClient = client
+			close(l.qmpReady)
+			for event := range client.Events() {
+				log.Infof("qmp event: %s %s", event.Event, event.Data)
+			}
+			return
+		}
+		log.Debugf("failed to connect to qmp: %+v", err)
+		select {
+		case <-l.exited:
+			return
+		case <-ctx.Done():
+			return
+		case <-time.After(qmpDialInterval):
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package vm
+
+import (
+	"net"
+	"os"
+
+	"github.com/cox96de/containervm/resolvconf"
+	"github.com/pkg/errors"
+)
+
+func getNameserversAndSearchDomain() (nameservers []string, searchDomains []string, err error) {
+	resolvFile, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, nil, errors.WithMessagef(err, "failed to read /etc/resolv.conf")
+	}
+	nameservers = resolvconf.GetNameservers(resolvFile)
+	searchDomains = resolvconf.GetSearchDomains(resolvFile)
+	return nameservers, searchDomains, nil
+}
+
+// parseNameservers parses nameservers and drops the ones unreachable from the VM.
+func parseNameservers(nameservers []string) []net.IP {
+	// TODO: validate nameservers
+	ns := make([]net.IP, 0, len(nameservers))
+	for _, nameserver := range nameservers {
+		ip := net.ParseIP(nameserver)
+		if ip.IsLoopback() {
+			// Nameserver in containers might be a loopback address.
+			// It can be seen in docker-compose.
+			continue
+		}
+		ns = append(ns, ip)
+	}
+	return ns
+}
@@ -0,0 +1,305 @@
+package vm
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultCgroupRoot is where the cgroup filesystem of the container is mounted.
+const DefaultCgroupRoot = "/sys/fs/cgroup"
+
+// DefaultMemoryOverhead is the memory reserved for qemu itself by default, which is enough for qemu with a few devices.
+const DefaultMemoryOverhead = 256 << 20
+
+// unlimitedMemory is the threshold above which a cgroup v1 memory limit means no limit.
+// cgroup v1 reports a huge page-aligned number instead of "max".
+const unlimitedMemory = int64(1) << 62
+
+// ResourceOptions sizes vCPUs and memory of the VM from the cgroup limits of the container.
+type ResourceOptions struct {
+	// CgroupRoot is where the cgroup filesystem is mounted. Empty means DefaultCgroupRoot.
+	CgroupRoot string
+	// CPUOverhead is the number of CPUs reserved for qemu itself.
+	CPUOverhead float64
+	// MemoryOverhead is the bytes of memory reserved for qemu itself, usually DefaultMemoryOverhead.
+	MemoryOverhead int64
+}
+
+// cgroupLimits are the resource limits of a cgroup. Zero means no limit.
+type cgroupLimits struct {
+	CPUs   float64
+	Memory int64
+}
+
+// readCgroupLimits reads the cpu and memory limits of the cgroup mounted at `root`, either cgroup v1 or v2.
+func readCgroupLimits(root string) (*cgroupLimits, error) {
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err == nil {
+		return readCgroupV2Limits(root)
+	}
+	return readCgroupV1Limits(root)
+}
+
+func readCgroupV2Limits(root string) (*cgroupLimits, error) {
+	limits := &cgroupLimits{}
+	// cpu.max is "$MAX $PERIOD", $MAX is "max" if there is no limit.
+	cpuMax, err := readCgroupFile(filepath.Join(root, "cpu.max"))
+	if err != nil {
+		return nil, err
+	}
+	if cpuMax != "" {
+		fields := strings.Fields(cpuMax)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("malformed cpu.max: %s", cpuMax)
+		}
+		if fields[0] != "max" {
+			limits.CPUs, err = cpuQuota(fields[0], fields[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	memoryMax, err := readCgroupFile(filepath.Join(root, "memory.max"))
+	if err != nil {
+		return nil, err
+	}
+	if memoryMax != "" && memoryMax != "max" {
+		limits.Memory, err = strconv.ParseInt(memoryMax, 10, 64)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "malformed memory.max: %s", memoryMax)
+		}
+	}
+	return limits, nil
+}
+
+func readCgroupV1Limits(root string) (*cgroupLimits, error) {
+	limits := &cgroupLimits{}
+	for _, cpuDir := range []string{"cpu", "cpu,cpuacct"} {
+		quota, err := readCgroupFile(filepath.Join(root, cpuDir, "cpu.cfs_quota_us"))
+		if err != nil {
+			return nil, err
+		}
+		if quota == "" {
+			continue
+		}
+		// The quota is -1 if there is no limit.
+		if quota != "-1" {
+			period, err := readCgroupFile(filepath.Join(root, cpuDir, "cpu.cfs_period_us"))
+			if err != nil {
+				return nil, err
+			}
+			limits.CPUs, err = cpuQuota(quota, period)
+			if err != nil {
+				return nil, err
+			}
+		}
+		break
+	}
+	limit, err := readCgroupFile(filepath.Join(root, "memory", "memory.limit_in_bytes"))
+	if err != nil {
+		return nil, err
+	}
+	if limit != "" {
+		limits.Memory, err = strconv.ParseInt(limit, 10, 64)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "malformed memory.limit_in_bytes: %s", limit)
+		}
+		if limits.Memory >= unlimitedMemory {
+			limits.Memory = 0
+		}
+	}
+	return limits, nil
+}
+
+// readCgroupFile reads a cgroup file, returns empty string if the file doesn't exist.
+func readCgroupFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.WithMessagef(err, "failed to read %s", path)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+func cpuQuota(quota, period string) (float64, error) {
+	q, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil {
+		return 0, errors.WithMessagef(err, "malformed cpu quota: %s", quota)
+	}
+	p, err := strconv.ParseInt(period, 10, 64)
+	if err != nil || p <= 0 {
+		return 0, errors.Errorf("malformed cpu period: %s", period)
+	}
+	return float64(q) / float64(p), nil
+}
+
+// resourceArgs returns -smp and -m options to append to qemu `args` according to `limits`, minus the overhead in
+// `opt`. If `args` have -smp or -m already, they are validated against the limits instead.
+func resourceArgs(args []string, limits *cgroupLimits, opt *ResourceOptions) ([]string, error) {
+	memoryOverhead := opt.MemoryOverhead
+	var sizing []string
+	if limits.CPUs > 0 {
+		vcpus := int(math.Floor(limits.CPUs - opt.CPUOverhead))
+		if vcpus < 1 {
+			return nil, errors.Errorf("cpu limit %.2f leaves no cpu for the vm after the overhead %.2f",
+				limits.CPUs, opt.CPUOverhead)
+		}
+		if value, ok := findQEMUOpt(args, "smp"); ok {
+			requested, err := parseSMP(value)
+			if err != nil {
+				return nil, err
+			}
+			if requested > vcpus {
+				return nil, errors.Errorf("%d vcpus exceed the cpu limit %.2f minus the overhead %.2f",
+					requested, limits.CPUs, opt.CPUOverhead)
+			}
+		} else {
+			log.Infof("size the vm to %d vcpus by the cpu limit %.2f", vcpus, limits.CPUs)
+			sizing = append(sizing, "-smp", strconv.Itoa(vcpus))
+		}
+	}
+	if limits.Memory > 0 {
+		memory := (limits.Memory - memoryOverhead) >> 20
+		if memory <= 0 {
+			return nil, errors.Errorf("memory limit %d leaves no memory for the vm after the overhead %d",
+				limits.Memory, memoryOverhead)
+		}
+		if value, ok := findQEMUOpt(args, "m"); ok {
+			requested, err := parseQEMUMemory(value)
+			if err != nil {
+				return nil, err
+			}
+			if requested > memory<<20 {
+				return nil, errors.Errorf("memory %s exceeds the memory limit %d minus the overhead %d",
+					value, limits.Memory, memoryOverhead)
+			}
+		} else {
+			log.Infof("size the vm to %dM memory by the memory limit %d", memory, limits.Memory)
+			sizing = append(sizing, "-m", strconv.FormatInt(memory, 10)+"M")
+		}
+	}
+	return sizing, nil
+}
+
+// sizeResources reads the cgroup limits and returns -smp and -m options for the VM, see resourceArgs.
+func (l *Launcher) sizeResources() ([]string, error) {
+	root := l.opt.Resources.CgroupRoot
+	if root == "" {
+		root = DefaultCgroupRoot
+	}
+	limits, err := readCgroupLimits(root)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to read cgroup limits")
+	}
+	args, err := l.qemuArgs(nil)
+	if err != nil {
+		return nil, err
+	}
+	return resourceArgs(args, limits, l.opt.Resources)
+}
+
+// findQEMUOpt returns the value of the last qemu option `name` in `args`. qemu accepts both -name and --name.
+func findQEMUOpt(args []string, name string) (string, bool) {
+	var (
+		value string
+		found bool
+	)
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "-"+name || args[i] == "--"+name {
+			value = args[i+1]
+			found = true
+		}
+	}
+	return value, found
+}
+
+// smpTopology are the -smp options whose product is the number of vcpus if it's not given, as qemu computes.
+var smpTopology = []string{"drawers", "books", "sockets", "dies", "clusters", "cores", "threads"}
+
+// parseSMP returns the number of vcpus of a qemu -smp value, such as "4", "cpus=4,sockets=1", or a topology only,
+// such as "sockets=2,cores=2".
+func parseSMP(value string) (int, error) {
+	if cpus, ok := qemuOptValue(value, "cpus"); ok {
+		n, err := strconv.Atoi(cpus)
+		if err != nil {
+			return 0, errors.WithMessagef(err, "malformed -smp %s", value)
+		}
+		return n, nil
+	}
+	n, found := 1, false
+	for _, key := range smpTopology {
+		v, ok := qemuOptValue(value, key)
+		if !ok {
+			continue
+		}
+		count, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, errors.WithMessagef(err, "malformed -smp %s", value)
+		}
+		n *= count
+		found = true
+	}
+	if !found {
+		return 0, errors.Errorf("-smp %s doesn't specify the number of cpus", value)
+	}
+	return n, nil
+}
+
+// parseQEMUMemory returns the bytes of a qemu -m value, such as "1024", "2G" or "size=2G,maxmem=4G".
+func parseQEMUMemory(value string) (int64, error) {
+	size, ok := qemuOptValue(value, "size")
+	if !ok {
+		return 0, errors.Errorf("-m %s doesn't specify the memory size", value)
+	}
+	return ParseSize(size)
+}
+
+// qemuOptValue returns the value of `key` in qemu option string `value`, the first field may omit the key.
+func qemuOptValue(value, key string) (string, bool) {
+	for i, field := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(field, "=")
+		if !ok && i == 0 {
+			return field, true
+		}
+		if ok && k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// ParseSize parses a size in the format of qemu, such as "512M" or "2G". The unit is MiB if there is no suffix.
+func ParseSize(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.TrimSuffix(size, "B"), "i")
+	shift := 20
+	if s != "" {
+		suffixed := true
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			shift = 10
+		case 'm', 'M':
+			shift = 20
+		case 'g', 'G':
+			shift = 30
+		case 't', 'T':
+			shift = 40
+		default:
+			suffixed = false
+		}
+		if suffixed {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("malformed size: %s", size)
+	}
+	return int64(n * float64(int64(1)<<shift)), nil
+}
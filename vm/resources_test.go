@@ -0,0 +1,95 @@
+package vm
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/fs"
+)
+
+func TestReadCgroupLimits(t *testing.T) {
+	t.Run("v2", func(t *testing.T) {
+		dir := fs.NewDir(t, "cgroup",
+			fs.WithFile("cgroup.controllers", "cpu memory\n"),
+			fs.WithFile("cpu.max", "250000 100000\n"),
+			fs.WithFile("memory.max", "2147483648\n"))
+		limits, err := readCgroupLimits(dir.Path())
+		assert.NilError(t, err)
+		assert.DeepEqual(t, limits, &cgroupLimits{CPUs: 2.5, Memory: 2 << 30})
+	})
+	t.Run("v2_unlimited", func(t *testing.T) {
+		dir := fs.NewDir(t, "cgroup",
+			fs.WithFile("cgroup.controllers", "cpu memory\n"),
+			fs.WithFile("cpu.max", "max 100000\n"),
+			fs.WithFile("memory.max", "max\n"))
+		limits, err := readCgroupLimits(dir.Path())
+		assert.NilError(t, err)
+		assert.DeepEqual(t, limits, &cgroupLimits{})
+	})
+	t.Run("v1", func(t *testing.T) {
+		dir := fs.NewDir(t, "cgroup",
+			fs.WithDir("cpu,cpuacct",
+				fs.WithFile("cpu.cfs_quota_us", "200000\n"),
+				fs.WithFile("cpu.cfs_period_us", "100000\n")),
+			fs.WithDir("memory", fs.WithFile("memory.limit_in_bytes", "1073741824\n")))
+		limits, err := readCgroupLimits(dir.Path())
+		assert.NilError(t, err)
+		assert.DeepEqual(t, limits, &cgroupLimits{CPUs: 2, Memory: 1 << 30})
+	})
+	t.Run("v1_unlimited", func(t *testing.T) {
+		dir := fs.NewDir(t, "cgroup",
+			fs.WithDir("cpu", fs.WithFile("cpu.cfs_quota_us", "-1\n")),
+			fs.WithDir("memory", fs.WithFile("memory.limit_in_bytes", "9223372036854771712\n")))
+		limits, err := readCgroupLimits(dir.Path())
+		assert.NilError(t, err)
+		assert.DeepEqual(t, limits, &cgroupLimits{})
+	})
+}
+
+func TestResourceArgs(t *testing.T) {
+	limits := &cgroupLimits{CPUs: 2.5, Memory: 2 << 30}
+	opt := &ResourceOptions{CPUOverhead: 0.25, MemoryOverhead: DefaultMemoryOverhead}
+	for _, c := range []struct {
+		name string
+		args []string
+		want []string
+		err  string
+	}{
+		{name: "inject", args: []string{"qemu-system-x86_64"}, want: []string{"-smp", "2", "-m", "1792M"}},
+		{name: "fit", args: []string{"qemu-system-x86_64", "-smp", "2,sockets=1,cores=2,threads=1", "-m", "1G"}},
+		{name: "fit_keyed", args: []string{"qemu-system-x86_64", "--smp", "cpus=1", "-m", "size=1792M,maxmem=4G"}},
+		{name: "fit_topology", args: []string{"qemu-system-x86_64", "-smp", "sockets=1,cores=2"},
+			want: []string{"-m", "1792M"}},
+		{name: "too_many_cpus", args: []string{"qemu-system-x86_64", "-smp", "3"}, err: "3 vcpus exceed"},
+		{name: "too_many_cpus_topology", args: []string{"qemu-system-x86_64", "-smp", "sockets=2,cores=2,threads=2"},
+			err: "8 vcpus exceed"},
+		{name: "too_much_memory", args: []string{"qemu-system-x86_64", "-m", "2048"}, err: "memory 2048 exceeds"},
+		{name: "malformed_memory", args: []string{"qemu-system-x86_64", "-m", "lots"}, err: "malformed size"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			args, err := resourceArgs(c.args, limits, opt)
+			if c.err != "" {
+				assert.ErrorContains(t, err, c.err)
+				return
+			}
+			assert.NilError(t, err)
+			assert.DeepEqual(t, args, c.want)
+		})
+	}
+	_, err := resourceArgs(nil, &cgroupLimits{Memory: 128 << 20}, opt)
+	assert.ErrorContains(t, err, "leaves no memory")
+	args, err := resourceArgs(nil, &cgroupLimits{}, opt)
+	assert.NilError(t, err)
+	assert.Assert(t, args == nil)
+}
+
+func TestParseSize(t *testing.T) {
+	for size, want := range map[string]int64{"512": 512 << 20, "512M": 512 << 20, "2G": 2 << 30, "1.5g": 3 << 29,
+		"64k": 64 << 10, "1T": 1 << 40, "256MiB": 256 << 20} {
+		got, err := ParseSize(size)
+		assert.NilError(t, err)
+		assert.Equal(t, got, want, size)
+	}
+	_, err := ParseSize("")
+	assert.ErrorContains(t, err, "malformed size")
+}
@@ -0,0 +1,178 @@
+package vm
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/cox96de/containervm/portforward"
+	"github.com/jackpal/gateway"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// NetworkMode is how the VM is connected to the network.
+type NetworkMode string
+
+const (
+	// NetworkModePod hands the pod NIC, its IP and MAC, over to the VM. It requires a privileged container.
+	NetworkModePod NetworkMode = "pod"
+	// NetworkModeUser connects the VM by the user-mode network stack of qemu (slirp), the pod NIC is untouched.
+	// The VM is behind a NAT, so services in the VM are only reachable by port forwards.
+	NetworkModeUser NetworkMode = "user"
+)
+
+// PortForward forwards a port of the pod into the VM.
+type PortForward struct {
+	// Protocol is tcp or udp.
+	Protocol string
+	// HostPort is the port listened on the pod.
+	HostPort int
+	// GuestPort is the port in the VM.
+	GuestPort int
+}
+
+func (f *PortForward) String() string {
+	return fmt.Sprintf("%s:%d:%d", f.Protocol, f.HostPort, f.GuestPort)
+}
+
+// ParsePortForward parses a port forward in the format of "$PROTOCOL:$HOST_PORT:$GUEST_PORT", such as "tcp:2222:22".
+func ParsePortForward(s string) (*PortForward, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 3 {
+		return nil, errors.Errorf("malformed port forward %s, expect protocol:hostPort:guestPort", s)
+	}
+	forward := &PortForward{Protocol: fields[0]}
+	var err error
+	if forward.HostPort, err = parsePort(fields[1]); err != nil {
+		return nil, errors.WithMessagef(err, "malformed port forward %s", s)
+	}
+	if forward.GuestPort, err = parsePort(fields[2]); err != nil {
+		return nil, errors.WithMessagef(err, "malformed port forward %s", s)
+	}
+	if err := forward.validate(); err != nil {
+		return nil, err
+	}
+	return forward, nil
+}
+
+func (f *PortForward) validate() error {
+	if f.Protocol != "tcp" && f.Protocol != "udp" {
+		return errors.Errorf("unsupported protocol %s of port forward %s", f.Protocol, f)
+	}
+	if f.HostPort <= 0 || f.HostPort > 65535 || f.GuestPort <= 0 || f.GuestPort > 65535 {
+		return errors.Errorf("port out of range in port forward %s", f)
+	}
+	return nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, errors.Errorf("invalid port: %s", s)
+	}
+	return port, nil
+}
+
+// generateUserNetworkOpt generates qemu options to connect the VM by the user-mode network stack,
+// with `forwards` listened by qemu on the loopback address.
+func generateUserNetworkOpt(forwards []*PortForward) []string {
+	netdev := []string{"user", "id=net0"}
+	for _, f := range forwards {
+		netdev = append(netdev, fmt.Sprintf("hostfwd=%s:127.0.0.1:%d-:%d", f.Protocol, f.HostPort, f.GuestPort))
+	}
+	return []string{"-netdev", strings.Join(netdev, ","), "-device", "virtio-net-pci,netdev=net0"}
+}
+
+// forwarder serves a PortForward.
+type forwarder struct {
+	*PortForward
+	*portforward.Forwarder
+}
+
+// setupUserNetwork listens on the pod IP for port forwards, which proxy to loopback ports forwarded into the VM by
+// qemu. It returns qemu options of the network.
+func (l *Launcher) setupUserNetwork() ([]string, error) {
+	listenIP := ""
+	if ip, err := gateway.DiscoverInterface(); err == nil {
+		listenIP = ip.String()
+	} else {
+		log.Warnf("failed to discover the pod IP, listen on all addresses for port forwards: %+v", err)
+	}
+	hostForwards := make([]*PortForward, 0, len(l.opt.PortForwards))
+	for _, f := range l.opt.PortForwards {
+		loopbackPort, err := freeLoopbackPort(f.Protocol)
+		if err != nil {
+			return nil, newError(StageNetwork, err)
+		}
+		fw, err := portforward.Listen(f.Protocol, net.JoinHostPort(listenIP, strconv.Itoa(f.HostPort)),
+			net.JoinHostPort("127.0.0.1", strconv.Itoa(loopbackPort)))
+		if err != nil {
+			return nil, newError(StageNetwork, errors.WithMessagef(err, "failed to listen for port forward %s", f))
+		}
+		log.Infof("forward %s on %s to the vm through 127.0.0.1:%d", f, fw.Addr(), loopbackPort)
+		l.forwarders = append(l.forwarders, &forwarder{PortForward: f, Forwarder: fw})
+		hostForwards = append(hostForwards, &PortForward{Protocol: f.Protocol, HostPort: loopbackPort,
+			GuestPort: f.GuestPort})
+	}
+	return generateUserNetworkOpt(hostForwards), nil
+}
+
+// freeLoopbackPort returns a free port of `protocol` on the loopback address, for qemu to listen on.
+// The port may be taken by others before qemu listens on it, which is unlikely in a pod.
+func freeLoopbackPort(protocol string) (int, error) {
+	var addr net.Addr
+	switch protocol {
+	case "tcp":
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return 0, errors.WithMessage(err, "failed to find a free tcp port")
+		}
+		addr = l.Addr()
+		_ = l.Close()
+	case "udp":
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return 0, errors.WithMessage(err, "failed to find a free udp port")
+		}
+		addr = conn.LocalAddr()
+		_ = conn.Close()
+	default:
+		return 0, errors.Errorf("unsupported protocol: %s", protocol)
+	}
+	_, port, _ := net.SplitHostPort(addr.String())
+	return strconv.Atoi(port)
+}
+
+// serveForwards starts proxying port forwards.
+func (l *Launcher) serveForwards() {
+	for _, f := range l.forwarders {
+		go func(f *forwarder) {
+			if err := f.Serve(); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Errorf("port forward %s stopped: %+v", f.PortForward, err)
+			}
+		}(f)
+	}
+}
+
+// closeForwards stops port forwards, closing their connections, and logs their metrics.
+func (l *Launcher) closeForwards() {
+	for _, f := range l.forwarders {
+		if err := f.Close(); err != nil {
+			log.Warnf("failed to close port forward %s: %+v", f.PortForward, err)
+		}
+		stats := f.Stats()
+		log.Infof("port forward %s is closed, connections: %d, failed: %d, bytes in: %d, bytes out: %d",
+			f.PortForward, stats.Total, stats.Failed, stats.BytesIn, stats.BytesOut)
+	}
+}
+
+// ForwardStats returns the connection metrics of port forwards, keyed by PortForward.String().
+func (l *Launcher) ForwardStats() map[string]portforward.Stats {
+	stats := make(map[string]portforward.Stats, len(l.forwarders))
+	for _, f := range l.forwarders {
+		stats[f.PortForward.String()] = f.Stats()
+	}
+	return stats
+}
@@ -0,0 +1,63 @@
+package vm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/cox96de/containervm/portforward"
+	"gotest.tools/v3/assert"
+)
+
+func TestParsePortForward(t *testing.T) {
+	forward, err := ParsePortForward("tcp:2222:22")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, forward, &PortForward{Protocol: "tcp", HostPort: 2222, GuestPort: 22})
+	assert.Equal(t, forward.String(), "tcp:2222:22")
+	for s, e := range map[string]string{
+		"tcp:2222":     "malformed port forward",
+		"sctp:2222:22": "unsupported protocol sctp",
+		"udp:0:53":     "invalid port: 0",
+		"udp:53:65536": "invalid port: 65536",
+		"udp:dns:53":   "invalid port: dns",
+	} {
+		_, err := ParsePortForward(s)
+		assert.ErrorContains(t, err, e, s)
+	}
+}
+
+func TestGenerateUserNetworkOpt(t *testing.T) {
+	opt := generateUserNetworkOpt([]*PortForward{{Protocol: "tcp", HostPort: 2222, GuestPort: 22},
+		{Protocol: "udp", HostPort: 5353, GuestPort: 53}})
+	assert.DeepEqual(t, opt, []string{"-netdev", "user,id=net0,hostfwd=tcp:127.0.0.1:2222-:22,hostfwd=udp:127.0.0.1:5353-:53",
+		"-device", "virtio-net-pci,netdev=net0"})
+}
+
+func TestNetworkModeOptions(t *testing.T) {
+	forwards := []*PortForward{{Protocol: "tcp", HostPort: 2222, GuestPort: 22}}
+	_, err := NewLauncher(&Options{QEMUArgs: []string{"qemu-system-x86_64"}, PortForwards: forwards})
+	assert.ErrorContains(t, err, "port forwards are not supported in pod network mode")
+	_, err = NewLauncher(&Options{QEMUArgs: []string{"qemu-system-x86_64"}, NetworkMode: "nat"})
+	assert.ErrorContains(t, err, "unknown network mode: nat")
+	_, err = NewLauncher(&Options{QEMUArgs: []string{"qemu-system-x86_64"}, NetworkMode: NetworkModeUser,
+		PortForwards: forwards})
+	assert.NilError(t, err)
+}
+
+func TestStartUserNetwork(t *testing.T) {
+	// `true` stands in for qemu, the pod network must not be touched in user mode.
+	l, err := NewLauncher(&Options{QEMUArgs: []string{"true"}, NetworkMode: NetworkModeUser,
+		PortForwards: []*PortForward{{Protocol: "tcp", HostPort: 32222, GuestPort: 22},
+			{Protocol: "udp", HostPort: 32222, GuestPort: 53}}})
+	assert.NilError(t, err)
+	assert.NilError(t, l.Start(context.Background()))
+	args := strings.Join(l.cmd.Args, " ")
+	assert.Assert(t, strings.Contains(args, "hostfwd=tcp:127.0.0.1:"), args)
+	assert.Assert(t, strings.Contains(args, "hostfwd=udp:127.0.0.1:"), args)
+	assert.NilError(t, l.Wait())
+	assert.DeepEqual(t, l.ForwardStats(), map[string]portforward.Stats{"tcp:32222:22": {}, "udp:32222:53": {}})
+	assert.Equal(t, l.ExitCode(), 0)
+	assert.Assert(t, l.Network() == nil)
+	assert.Assert(t, l.cleanFunc == nil)
+	assert.Assert(t, l.cmd.ExtraFiles == nil)
+}
@@ -0,0 +1,77 @@
+package vm
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultVhostNetPath is the path of the vhost-net device, which moves the virtio-net datapath into the kernel.
+const DefaultVhostNetPath = "/dev/vhost-net"
+
+// maxNetworkQueues caps the number of queues derived from vCPUs, each queue takes a file descriptor and
+// interrupt vectors.
+const maxNetworkQueues = 16
+
+// probeVhostNet checks that the vhost-net device at `path` exists and is accessible.
+func probeVhostNet(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return errors.Errorf("%s doesn't exist, the container may not be privileged or the host has no vhost-net",
+				path)
+		}
+		if errors.Is(err, os.ErrPermission) {
+			return errors.Errorf("no permission to open %s", path)
+		}
+		return errors.WithMessagef(err, "failed to open %s", path)
+	}
+	return f.Close()
+}
+
+// vhostEnabled reports whether qemu uses vhost-net: it's not disabled and the device is usable.
+func (l *Launcher) vhostEnabled() bool {
+	if l.opt.DisableVhost {
+		return false
+	}
+	path := l.opt.VhostNetPath
+	if path == "" {
+		path = DefaultVhostNetPath
+	}
+	if err := probeVhostNet(path); err != nil {
+		log.Warnf("vhost-net is not usable, fall back to the userspace virtio-net: %+v", err)
+		return false
+	}
+	return true
+}
+
+// networkQueues returns the number of queues of each NIC of the VM. Unless Options.NetworkQueues is set,
+// it's the number of vCPUs in the qemu command with `hostArgs`, up to maxNetworkQueues, or 1 if the number can't
+// be told from -smp.
+func (l *Launcher) networkQueues(hostArgs []string) (int, error) {
+	if l.opt.NetworkQueues > 0 {
+		return l.opt.NetworkQueues, nil
+	}
+	args, err := l.qemuArgs(hostArgs)
+	if err != nil {
+		return 0, err
+	}
+	smp, ok := findQEMUOpt(args, "smp")
+	if !ok {
+		// qemu defaults to 1 vCPU.
+		return 1, nil
+	}
+	cpus, err := parseSMP(smp)
+	if err != nil {
+		log.Warnf("use 1 network queue: %v", err)
+		return 1, nil
+	}
+	if cpus > maxNetworkQueues {
+		return maxNetworkQueues, nil
+	}
+	if cpus < 1 {
+		return 1, nil
+	}
+	return cpus, nil
+}
@@ -0,0 +1,56 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cox96de/containervm/qemu"
+	"gotest.tools/v3/assert"
+)
+
+func TestProbeVhostNet(t *testing.T) {
+	noVhost := filepath.Join(t.TempDir(), "vhost-net")
+	assert.ErrorContains(t, probeVhostNet(noVhost), "doesn't exist")
+	l, err := NewLauncher(&Options{QEMUArgs: []string{"qemu-system-x86_64"}, VhostNetPath: noVhost})
+	assert.NilError(t, err)
+	assert.Assert(t, !l.vhostEnabled())
+	l, err = NewLauncher(&Options{QEMUArgs: []string{"qemu-system-x86_64"}, VhostNetPath: os.DevNull})
+	assert.NilError(t, err)
+	assert.Assert(t, l.vhostEnabled())
+	l, err = NewLauncher(&Options{QEMUArgs: []string{"qemu-system-x86_64"}, VhostNetPath: os.DevNull,
+		DisableVhost: true})
+	assert.NilError(t, err)
+	assert.Assert(t, !l.vhostEnabled())
+}
+
+func TestNetworkQueues(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		opt      *Options
+		hostArgs []string
+		queues   int
+	}{
+		{name: "default", opt: &Options{QEMUArgs: []string{"qemu-system-x86_64"}}, queues: 1},
+		{name: "smp", opt: &Options{QEMUArgs: []string{"qemu-system-x86_64", "-smp", "cpus=4,sockets=1"}}, queues: 4},
+		{name: "topology", opt: &Options{QEMUArgs: []string{"qemu-system-x86_64", "-smp", "sockets=2,cores=2"}},
+			queues: 4},
+		{name: "unknown", opt: &Options{QEMUArgs: []string{"qemu-system-x86_64", "-smp", "maxcpus=8"}}, queues: 1},
+		{name: "sized", opt: &Options{QEMUArgs: []string{"qemu-system-x86_64"}}, hostArgs: []string{"-smp", "2"},
+			queues: 2},
+		{name: "spec", opt: &Options{Spec: &qemu.Spec{CPUs: 8}}, queues: 8},
+		{name: "capped", opt: &Options{QEMUArgs: []string{"qemu-system-x86_64", "-smp", "64"}}, queues: 16},
+		{name: "explicit", opt: &Options{QEMUArgs: []string{"qemu-system-x86_64", "-smp", "64"}, NetworkQueues: 32},
+			queues: 32},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			l, err := NewLauncher(c.opt)
+			assert.NilError(t, err)
+			queues, err := l.networkQueues(c.hostArgs)
+			assert.NilError(t, err)
+			assert.Equal(t, queues, c.queues)
+		})
+	}
+	_, err := NewLauncher(&Options{QEMUArgs: []string{"qemu-system-x86_64"}, NetworkQueues: -1})
+	assert.ErrorContains(t, err, "bad number of network queues")
+}